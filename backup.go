@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// Version of the backup format, it has to change when a backup can't be restored by a previous version
+const BACKUP_VERSION = 3
+
+// All the data of the bot
+type Backup struct {
+	Version           int                  `json:"version"`
+	DbVersion         int                  `json:"db_version"` // Version of the database the backup was made from
+	Date              string               `json:"date"`
+	Parameters        []Parameter          `json:"parameters"`
+	Contacts          []Contact            `json:"contacts"`
+	Stocks            []Stock              `json:"stocks"`
+	Conversions       []CurrencyConversion `json:"currency_conversions"`
+	Alerts            []Alert              `json:"alerts"`
+	PositionAlerts    []PositionAlert      `json:"position_alerts"`
+	Holdings          []backupHolding      `json:"holdings,omitempty"` // Only in version 1
+	Portfolios        []Portfolio          `json:"portfolios"`
+	PortfolioAlerts   []PortfolioAlert     `json:"portfolio_alerts"`
+	Transactions      []Transaction        `json:"transactions"`
+	Triggers          []AlertTrigger       `json:"alert_triggers"`
+	MarketPreferences []MarketPreference   `json:"market_preferences,omitempty"`
+	Watchlists        []Watchlist          `json:"watchlists,omitempty"`
+	WatchlistStocks   []WatchlistStock     `json:"watchlist_stocks,omitempty"`
+	CorporateActions  []CorporateAction    `json:"corporate_actions,omitempty"`
+	Values            []Value              `json:"values,omitempty"`
+	DailyRates        []DailyRate          `json:"daily_rates,omitempty"` // With the values
+}
+
+// The holdings of the version 1 backups, they are restored as purchases of an unknown date
+type backupHolding struct {
+	Id      int64
+	Contact int64
+	Stock   int64
+	Nb      int64
+	Value   Decimal
+}
+
+type BackupRepository interface {
+	Dump(withValues bool) (*Backup, error)
+	// Tells if there are no contacts and no stocks
+	IsEmpty() bool
+	// Replaces all the data with the backup
+	Restore(b *Backup) error
+}
+
+// All the rows of the backup, parents first
+func (b *Backup) rows() []interface{} {
+	rows := []interface{}{}
+	for i := range b.Parameters {
+		if b.Parameters[i].Name != PARAMETER_DB_VERSION {
+			rows = append(rows, &b.Parameters[i])
+		}
+	}
+	for i := range b.Contacts {
+		rows = append(rows, &b.Contacts[i])
+	}
+	for i := range b.Stocks {
+		rows = append(rows, &b.Stocks[i])
+	}
+	for i := range b.Conversions {
+		rows = append(rows, &b.Conversions[i])
+	}
+	for i := range b.Alerts {
+		rows = append(rows, &b.Alerts[i])
+	}
+	for i := range b.PositionAlerts {
+		rows = append(rows, &b.PositionAlerts[i])
+	}
+	for i := range b.Portfolios {
+		rows = append(rows, &b.Portfolios[i])
+	}
+	for i := range b.PortfolioAlerts {
+		rows = append(rows, &b.PortfolioAlerts[i])
+	}
+	for i := range b.Transactions {
+		rows = append(rows, &b.Transactions[i])
+	}
+	for i := range b.Triggers {
+		rows = append(rows, &b.Triggers[i])
+	}
+	for i := range b.MarketPreferences {
+		rows = append(rows, &b.MarketPreferences[i])
+	}
+	for i := range b.Watchlists {
+		rows = append(rows, &b.Watchlists[i])
+	}
+	for i := range b.WatchlistStocks {
+		rows = append(rows, &b.WatchlistStocks[i])
+	}
+	for i := range b.CorporateActions {
+		rows = append(rows, &b.CorporateActions[i])
+	}
+	for i := range b.Values {
+		rows = append(rows, &b.Values[i])
+	}
+	for i := range b.DailyRates {
+		rows = append(rows, &b.DailyRates[i])
+	}
+	return rows
+}
+
+func dbVersion(store *Storage) int {
+	version := 0
+	if sVersion := store.Parameters.GetParameter(PARAMETER_DB_VERSION); sVersion != nil {
+		version, _ = strconv.Atoi(*sVersion)
+	}
+	return version
+}
+
+func makeBackup(store *Storage, withValues bool) (*Backup, error) {
+	b, err := store.Backups.Dump(withValues)
+	if err != nil {
+		return nil, err
+	}
+	b.Version = BACKUP_VERSION
+	b.DbVersion = dbVersion(store)
+	b.Date = time.Now().UTC().Format(EXPORT_DATE_FORMAT)
+	return b, nil
+}
+
+func writeBackup(w io.Writer, b *Backup) error {
+	raw, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(raw, '\n'))
+	return err
+}
+
+func readBackup(r io.Reader) (*Backup, error) {
+	b := &Backup{}
+	if err := json.NewDecoder(r).Decode(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Converts the backups of the previous versions
+func upgradeBackup(b *Backup) {
+	if b.Version == 1 {
+		upgradeBackupHoldings(b)
+	}
+	if b.Version == 2 {
+		upgradeBackupPortfolios(b)
+	}
+}
+
+// Version 1 had holdings instead of transactions
+func upgradeBackupHoldings(b *Backup) {
+	currencies := make(map[int64]string)
+	for _, s := range b.Stocks {
+		currencies[s.Id] = s.Currency
+	}
+	for _, h := range b.Holdings {
+		if h.Nb > 0 {
+			b.Transactions = append(b.Transactions, Transaction{
+				Id: h.Id, Contact: h.Contact, Stock: h.Stock, Type: TRANSACTION_BUY, Nb: DecimalFromInt(h.Nb), Price: h.Value, Currency: currencies[h.Stock],
+			})
+		}
+	}
+	b.Holdings = nil
+	b.Version = 2
+}
+
+// Version 2 didn't have portfolios, the transactions go in the default one
+func upgradeBackupPortfolios(b *Backup) {
+	portfolios := make(map[int64]int64)
+	for i := range b.Transactions {
+		t := &b.Transactions[i]
+		if _, ok := portfolios[t.Contact]; !ok {
+			p := Portfolio{Id: int64(len(b.Portfolios) + 1), Contact: t.Contact, Name: DEFAULT_PORTFOLIO, Default: true}
+			b.Portfolios = append(b.Portfolios, p)
+			portfolios[t.Contact] = p.Id
+		}
+		t.Portfolio = portfolios[t.Contact]
+	}
+	b.Version = 3
+}
+
+// Restores a backup, the current data is only replaced if force is set
+func restoreBackup(store *Storage, b *Backup, force bool) error {
+	upgradeBackup(b)
+	if b.Version != BACKUP_VERSION {
+		return errors.New(fmt.Sprintf("Unsupported backup version %d (expected %d)", b.Version, BACKUP_VERSION))
+	}
+	if current := dbVersion(store); b.DbVersion > current {
+		return errors.New(fmt.Sprintf("The backup comes from a newer database (version %d > %d)", b.DbVersion, current))
+	}
+	if !force && !store.Backups.IsEmpty() {
+		return errors.New("The database isn't empty, use -force to replace its content")
+	}
+	return store.Backups.Restore(b)
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"time"
+)
+
+// Commands can be run from the command line ("followthestock export values -stock FR:RNO") or from the console
+type cliContext struct {
+	store   *Storage
+	out     io.Writer
+	console bool // Files are written in the export directory instead of the output
+}
+
+type cliCommand func(ctx *cliContext, args []string) error
+
+var cliCommands map[string]cliCommand
+
+func init() {
+	cliCommands = map[string]cliCommand{
+		"export":    cliExport,
+		"fsck":      cliFsck,
+		"import":    cliImport,
+		"backup":    cliBackup,
+		"restore":   cliRestore,
+		"taxreport": cliTaxReport,
+	}
+}
+
+func runCliCommand(ctx *cliContext, args []string) error {
+	cmd, ok := cliCommands[args[0]]
+	if !ok {
+		return errors.New(fmt.Sprintf("Unknown command \"%s\"", args[0]))
+	}
+	return cmd(ctx, args[1:])
+}
+
+// Writes the result of a command in the given file, in the export directory on the console, and on the standard
+// output otherwise
+func (ctx *cliContext) output(fileName, name, ext string, write func(w io.Writer) error) error {
+	var file *os.File
+	var err error
+	if fileName != "" {
+		file, err = os.Create(fileName)
+	} else if ctx.console {
+		file, err = createExportFile(name, ext)
+	} else {
+		return write(ctx.out)
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err = write(file); err == nil && fileName == "" {
+		fmt.Fprintf(ctx.out, "Written to %s\n", file.Name())
+	}
+	return err
+}
+
+// Runs a command given on the command line and returns the exit code
+func cli(args []string) int {
+	db := NewFtsDB(config.Db.File)
+	defer db.Close()
+
+	if err := runCliCommand(&cliContext{store: db.Storage(), out: os.Stdout}, args); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	return 0
+}
+
+func cliFsck(ctx *cliContext, args []string) error {
+	report, err := ctx.store.Integrity.CheckIntegrity(len(args) == 1 && args[0] == "repair")
+	if err == nil {
+		fmt.Fprintln(ctx.out, report)
+	}
+	return err
+}
+
+func cliExport(ctx *cliContext, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: export values|alerts|holdings [options]")
+	}
+	what := args[0]
+
+	fs := flag.NewFlagSet("export "+what, flag.ContinueOnError)
+	fs.SetOutput(ctx.out)
+	stockName := fs.String("stock", "", "Stock (values)")
+	email := fs.String("contact", "", "Contact (alerts and holdings)")
+	from := fs.String("from", "", "Start date (values)")
+	to := fs.String("to", "", "End date, excluded (values)")
+	format := fs.String("format", EXPORT_FORMAT_CSV, "Format: csv or json")
+	output := fs.String("output", "", "Output file")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	var records []exportRecord
+	var name string
+	switch what {
+	case "values":
+		if *stockName == "" {
+			return errors.New("-stock is required")
+		}
+		stock, err := findStoredStock(ctx.store, *stockName)
+		if err != nil {
+			return err
+		}
+		start, end := int64(0), int64(math.MaxInt64)
+		if *from != "" {
+			if start, err = parseExportDate(*from); err != nil {
+				return err
+			}
+		}
+		if *to != "" {
+			if end, err = parseExportDate(*to); err != nil {
+				return err
+			}
+		}
+		name = "values_" + stock.Symbol()
+		records = exportValues(ctx.store, stock, start, end)
+	case "alerts", "holdings":
+		if *email == "" {
+			return errors.New("-contact is required")
+		}
+		contact := ctx.store.Contacts.GetContactFromEmail(*email)
+		if contact == nil {
+			return errors.New("Could not get contact !")
+		}
+		name = what + "_" + contact.Email
+		if what == "alerts" {
+			records = exportAlerts(ctx.store, contact)
+		} else {
+			records = exportHoldings(ctx.store, contact)
+		}
+	default:
+		return errors.New(fmt.Sprintf("Cannot export \"%s\" (values, alerts or holdings)", what))
+	}
+
+	return ctx.output(*output, name, *format, func(w io.Writer) error {
+		return writeExport(w, *format, records)
+	})
+}
+
+func cliImport(ctx *cliContext, args []string) error {
+	if len(args) > 0 && args[0] == "statement" {
+		return cliImportStatement(ctx, args[1:])
+	}
+	if len(args) == 0 || args[0] != "values" {
+		return errors.New("usage: import values|statement [options]")
+	}
+
+	fs := flag.NewFlagSet("import values", flag.ContinueOnError)
+	fs.SetOutput(ctx.out)
+	stockName := fs.String("stock", "", "Stock")
+	fileName := fs.String("file", "", "CSV file")
+	currency := fs.String("currency", "", "Currency of the prices (if not in the file)")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *stockName == "" || *fileName == "" {
+		return errors.New("-stock and -file are required")
+	}
+
+	stock, err := findStoredStock(ctx.store, *stockName)
+	if err != nil {
+		return err
+	}
+
+	result, err := importValuesFile(ctx.store, stock, *fileName, *currency)
+	if err == nil {
+		fmt.Fprintln(ctx.out, result)
+	}
+	return err
+}
+
+func cliImportStatement(ctx *cliContext, args []string) error {
+	fs := flag.NewFlagSet("import statement", flag.ContinueOnError)
+	fs.SetOutput(ctx.out)
+	email := fs.String("contact", "", "Contact")
+	fileName := fs.String("file", "", "CSV file")
+	profile := fs.String("profile", DEFAULT_STATEMENT_PROFILE, "Columns of the file (statement profile of the config)")
+	portfolioName := fs.String("portfolio", "", "Portfolio (default one of the contact if not set)")
+	dryRun := fs.Bool("dry-run", false, "Only show what would change")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *email == "" || *fileName == "" {
+		return errors.New("-contact and -file are required")
+	}
+
+	contact := ctx.store.Contacts.GetContactFromEmail(*email)
+	if contact == nil {
+		return errors.New("Could not get contact !")
+	}
+	var portfolio *Portfolio
+	var err error
+	if *portfolioName != "" {
+		portfolio, err = findPortfolio(ctx.store, contact, *portfolioName)
+	} else {
+		portfolio, err = defaultPortfolio(ctx.store, contact)
+	}
+	if err != nil {
+		return err
+	}
+
+	resolve := func(symbol string) (*Stock, error) { return previewStock(ctx.store, contact, symbol) }
+	if !*dryRun {
+		stocks := NewStocksMgmt(ctx.store, nil)
+		resolve = func(symbol string) (*Stock, error) { return stocks.GetStock(contact, symbol) }
+	}
+	result, err := importStatementFile(ctx.store, contact, portfolio, *fileName, *profile, resolve, *dryRun)
+	if err != nil {
+		return err
+	}
+	for _, line := range result.Lines {
+		fmt.Fprintln(ctx.out, line)
+	}
+	fmt.Fprintln(ctx.out, result)
+	return nil
+}
+
+func cliTaxReport(ctx *cliContext, args []string) error {
+	fs := flag.NewFlagSet("taxreport", flag.ContinueOnError)
+	fs.SetOutput(ctx.out)
+	email := fs.String("contact", "", "Contact")
+	format := fs.String("format", "", "Export format: csv or json (text if not set)")
+	output := fs.String("output", "", "Output file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *email == "" || fs.NArg() != 1 {
+		return errors.New("usage: taxreport -contact <email> [options] <year>")
+	}
+
+	year, err := parseTaxYear(fs.Arg(0), time.Now())
+	if err != nil {
+		return err
+	}
+	contact := ctx.store.Contacts.GetContactFromEmail(*email)
+	if contact == nil {
+		return errors.New("Could not get contact !")
+	}
+
+	report := computeTaxReport(ctx.store, contact, year)
+	if *format == "" {
+		for _, line := range report.Lines() {
+			fmt.Fprintln(ctx.out, line)
+		}
+		return nil
+	}
+	return ctx.output(*output, fmt.Sprintf("taxreport_%d_%s", year, contact.Email), *format, func(w io.Writer) error {
+		return writeExport(w, *format, exportTaxReport(report))
+	})
+}
+
+func cliBackup(ctx *cliContext, args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	fs.SetOutput(ctx.out)
+	withValues := fs.Bool("values", false, "Include the stocks values")
+	output := fs.String("output", "", "Output file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	b, err := makeBackup(ctx.store, *withValues)
+	if err != nil {
+		return err
+	}
+
+	return ctx.output(*output, "backup", "json", func(w io.Writer) error {
+		return writeBackup(w, b)
+	})
+}
+
+func cliRestore(ctx *cliContext, args []string) error {
+	if ctx.console {
+		return errors.New("The bot has to be stopped to restore a backup")
+	}
+
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	fs.SetOutput(ctx.out)
+	fileName := fs.String("file", "", "Backup file")
+	force := fs.Bool("force", false, "Replace the current data")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *fileName == "" {
+		return errors.New("-file is required")
+	}
+
+	file, err := os.Open(*fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	b, err := readBackup(file)
+	if err != nil {
+		return err
+	}
+
+	if err := restoreBackup(ctx.store, b, *force); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(ctx.out, "Restored %d contacts, %d stocks, %d alerts, %d transactions and %d values from %s\n",
+		len(b.Contacts), len(b.Stocks), len(b.Alerts), len(b.Transactions), len(b.Values), b.Date)
+	return nil
+}
@@ -16,6 +16,7 @@ type Config struct {
 		Debug                   bool
 		LinesPerMessage         int
 		ActivityWatchdogMinutes int
+		Admin                   []string // Contacts allowed to use the admin commands
 	}
 
 	General struct {
@@ -25,6 +26,21 @@ type Config struct {
 	Db struct {
 		File string
 	}
+
+	Export struct {
+		Dir string // Where exported files are written
+		Url string // URL where the export directory is served, exports are sent inline in the chat otherwise
+	}
+
+	Currency struct {
+		Provider string // Where the exchange rates come from: "ecb" (default) or "boursorama"
+		Source   string // URL or local file of the ECB rates
+		History  string // URL or local file of the history of the ECB rates
+	}
+
+	Statement map[string]*StatementProfile // Column mapping of the statements of the brokers
+
+	Market map[string]*Market // Markets added to the default ones or replacing them
 }
 
 var Console bool
@@ -33,11 +49,15 @@ var config Config
 
 func init() {
 	config.Db.File = "followthestock.db"
+	config.Export.Dir = "export"
 	config.Xmpp.Username = ""
 	config.Xmpp.Server = "talk.google.com:443"
 	config.Xmpp.LinesPerMessage = 15
 	config.Xmpp.ActivityWatchdogMinutes = 30
+}
 
+// Parses the command line and loads the config file
+func loadConfig() {
 	var fileName string
 	var showConfig bool
 	flag.StringVar(&fileName, "config", "/etc/followthestock/followthestock.conf", "Config file")
@@ -45,7 +65,7 @@ func init() {
 	flag.BoolVar(&Console, "console", false, "Use console")
 
 	flag.Usage = func() {
-		fmt.Fprintln(os.Stderr, "usage: followthestock -config <file>")
+		fmt.Fprintln(os.Stderr, "usage: followthestock -config <file> [<command> <args>]")
 		flag.PrintDefaults()
 		os.Exit(2)
 	}
@@ -54,6 +74,17 @@ func init() {
 		fmt.Fprintln(os.Stderr, "Could not read config: ", fileName)
 	}
 
+	if provider, err := newRateProvider(config.Currency.Provider, config.Currency.Source, config.Currency.History); err == nil {
+		rateProvider = provider
+	} else {
+		fmt.Fprintln(os.Stderr, "Could not set the rate provider: ", err)
+	}
+
+	var err error
+	if markets, err = newMarkets(config.Market); err != nil {
+		fmt.Fprintln(os.Stderr, "Could not load the markets: ", err)
+	}
+
 	if showConfig {
 		fmt.Printf("Config: %#v\n", config)
 	}
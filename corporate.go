@@ -0,0 +1,244 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Largest ratio (and inverse ratio) of the splits we look for in the jumps of the values
+const SPLIT_MAX_RATIO = 20
+
+// Relative gap between a jump and the ratio of a split for the jump to look like that split
+const SPLIT_TOLERANCE = 0.05
+
+// How often the admins are asked again to confirm or ignore a split
+const SPLIT_REMINDER_DELAY = time.Hour
+
+// Price after the action of a price before it
+func (a *CorporateAction) price(p Decimal) Decimal {
+	return p.MulInt(a.OldShares).Div(DecimalFromInt(a.NewShares))
+}
+
+// Number of shares after the action of a number of shares before it
+func (a *CorporateAction) shares(nb Decimal) Decimal {
+	return nb.MulInt(a.NewShares).Div(DecimalFromInt(a.OldShares))
+}
+
+// Adjusts the baseline of an alert if it's older than the action, tells if it did
+func (a *CorporateAction) adjustsAlert(al *Alert) bool {
+	if al.LastValue == 0 || al.LastDate >= a.Date || al.LastTriggered >= a.Date {
+		return false
+	}
+	al.LastValue = a.price(al.LastValue)
+	return true
+}
+
+func (a *CorporateAction) adjustTransaction(t *Transaction) {
+	t.Nb = a.shares(t.Nb)
+	t.Price = a.price(t.Price)
+}
+
+func (a *CorporateAction) String() string {
+	return fmt.Sprintf("%d:%d %s on %s", a.NewShares, a.OldShares, a.Type, time.Unix(0, a.Date).UTC().Format("2006-01-02"))
+}
+
+// Parses the ratio of a split, "2:1" gives 2 new shares for 1 old share
+func parseSplitRatio(ratio string) (newShares, oldShares int64, err error) {
+	parts := strings.Split(ratio, ":")
+	if len(parts) == 2 {
+		newShares, err = strconv.ParseInt(parts[0], 10, 64)
+		if err == nil {
+			oldShares, err = strconv.ParseInt(parts[1], 10, 64)
+		}
+		if err == nil && newShares > 0 && oldShares > 0 && newShares != oldShares {
+			return
+		}
+	}
+	return 0, 0, errors.New(fmt.Sprintf("Invalid split ratio \"%s\" (Ex: \"2:1\", \"1:10\")", ratio))
+}
+
+// Split that would explain a jump from a value to another, 0:0 if the jump doesn't look like one. Only the
+// splits of a share into n shares and their reverse are considered.
+func guessSplit(before, after Decimal) (newShares, oldShares int64) {
+	if before <= 0 || after <= 0 {
+		return 0, 0
+	}
+	ratio := before.Float() / after.Float()
+	if ratio < 1 {
+		ratio = 1 / ratio
+	}
+	n := math.Floor(ratio + 0.5)
+	if n < 2 || n > SPLIT_MAX_RATIO || math.Abs(ratio-n)/n > SPLIT_TOLERANCE {
+		return 0, 0
+	}
+	if before > after {
+		return int64(n), 1
+	}
+	return 1, int64(n)
+}
+
+// Parses the day of a corporate action in the timezone of the market of the stock
+func (s *Stock) parseDay(day string) (int64, error) {
+	location := time.UTC
+	if m, err := getMarket(s.Market); err == nil && m.location != nil {
+		location = m.location
+	}
+	t, err := time.ParseInLocation("2006-01-02", day, location)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("Invalid date \"%s\" (Ex: \"2024-06-10\")", day))
+	}
+	return t.UnixNano(), nil
+}
+
+// Registers a split of the stock and adjusts its values, alerts and holdings before the date, then its position alerts
+func applySplit(store *Storage, s *Stock, newShares, oldShares, date int64) (*CorporateAction, error) {
+	for _, a := range *store.Actions.GetCorporateActions(s) {
+		if a.Date == date {
+			return nil, errors.New(fmt.Sprintf("%s already has a %s", s, a.String()))
+		}
+	}
+	a := &CorporateAction{Stock: s.Id, Date: date, Type: CORPORATE_ACTION_SPLIT, NewShares: newShares, OldShares: oldShares}
+	if err := store.Actions.ApplyCorporateAction(a); err != nil {
+		return nil, err
+	}
+	log.Info("Stock %s: %s applied", s, a.String())
+	refreshPositionAlerts(store, s)
+	return a, nil
+}
+
+// Computes again the cost and the high of the position alerts of a stock from its adjusted transactions and values.
+// Whether they were computed before or after the date of the action, they're then in the prices after it.
+func refreshPositionAlerts(store *Storage, s *Stock) {
+	if stored := store.Stocks.GetStockFromId(s.Id); stored != nil {
+		s = stored
+	}
+	now := time.Now().UTC().UnixNano()
+	for _, pa := range *store.PositionAlerts.GetPositionAlertsForStock(s) {
+		c := store.Contacts.GetContactFromId(pa.Contact)
+		if c == nil {
+			continue
+		}
+		transactions := *store.Transactions.GetTransactions(c, nil, s)
+		position := computePositions(transactions, c.costMethod())
+		if len(position) == 0 || position[0].Nb <= 0 {
+			continue
+		}
+		pa.Cost = position[0].Price()
+		pa.High = positionHigh(store, s, transactions, now)
+		if err := store.PositionAlerts.SavePositionAlert(&pa); err != nil {
+			log.Warning("Position alert %d: %v", pa.Id, err)
+		}
+	}
+}
+
+// Tells if the alerts of the stock have to wait because its value jumped like after a split. The admins are asked
+// to confirm or ignore the split and the subscribers are told that their alerts are delayed. The alerts wait until an
+// admin answers, as they would compare the new values with the ones before the split, and the admins are asked again
+// every SPLIT_REMINDER_DELAY. Without admins, the alerts run as usual. It's called with the lock of the follower held.
+func (sf *StockFollower) waitsForSplit(value Decimal, now int64) bool {
+	symbol := strings.ToLower(sf.Stock.Symbol())
+	if sf.Stock.SplitHold != 0 {
+		if sf.splitAsked < sf.Stock.SplitHold {
+			sf.splitAsked = sf.Stock.SplitHold
+		}
+		if now-sf.splitAsked >= int64(SPLIT_REMINDER_DELAY) {
+			sf.splitAsked = now
+			log.Warning("Stock %s: nobody confirmed the split yet", sf.Stock)
+			for _, admin := range config.Xmpp.Admin {
+				sf.send <- &SendChat{Remote: admin, Text: fmt.Sprintf("The alerts of %s still wait since %s for \"split %s <new>:<old>\" or \"split %s ignore\".",
+					sf.Stock, formatExportDate(sf.Stock.SplitHold), symbol, symbol)}
+			}
+		}
+		return true
+	}
+	if len(config.Xmpp.Admin) == 0 {
+		return false
+	}
+
+	previous, err := sf.store.Values.GetStockValueAt(sf.Stock, now)
+	if err != nil {
+		return false
+	}
+	newShares, oldShares := guessSplit(previous.Value, value)
+	if newShares == 0 {
+		return false
+	}
+	sf.Stock.SplitHold, sf.splitAsked = now, now
+	if err := sf.store.Stocks.SaveStock(sf.Stock); err != nil {
+		log.Warning("Stock %s: %v", sf.Stock, err)
+	}
+
+	jump := fmt.Sprintf("%s went from %.3f to %.3f %s, it looks like a %d:%d split.", sf.Stock, previous.Value, value, sf.Stock.Currency, newShares, oldShares)
+	log.Warning("Stock %s: %s", sf.Stock, jump)
+	for _, admin := range config.Xmpp.Admin {
+		sf.send <- &SendChat{Remote: admin, Text: fmt.Sprintf("%s Its alerts wait for \"split %s %d:%d\" or \"split %s ignore\".",
+			jump, symbol, newShares, oldShares, symbol)}
+	}
+	for _, c := range sf.subscribers(now) {
+		sf.send <- &SendChat{Remote: c.Email, Text: fmt.Sprintf("%s Your alerts on it are delayed until an admin checks it.", jump)}
+	}
+	return true
+}
+
+// Contacts that aren't in pause and have alerts on the stock, on a position or on a portfolio that holds it
+func (sf *StockFollower) subscribers(now int64) []*Contact {
+	ids := []int64{}
+	for _, al := range *sf.store.Alerts.GetAlertsForStock(sf.Stock) {
+		ids = append(ids, al.Contact)
+	}
+	for _, al := range *sf.store.PositionAlerts.GetPositionAlertsForStock(sf.Stock) {
+		ids = append(ids, al.Contact)
+	}
+	for _, al := range *sf.store.PortfolioAlerts.GetPortfolioAlertsForStock(sf.Stock) {
+		ids = append(ids, al.Contact)
+	}
+
+	contacts := []*Contact{}
+	seen := make(map[int64]bool)
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		if c := sf.store.Contacts.GetContactFromId(id); c != nil && now >= c.PauseUntil {
+			contacts = append(contacts, c)
+		}
+	}
+	return contacts
+}
+
+// Date of the jump that put the alerts of the stock on hold, 0 if they aren't
+func (sm *StocksMgmt) splitHold(s *Stock) int64 {
+	sm.RLock()
+	sf, ok := sm.stocks[s.String()]
+	sm.RUnlock()
+	if !ok {
+		return s.SplitHold
+	}
+	sf.Lock()
+	defer sf.Unlock()
+	return sf.Stock.SplitHold
+}
+
+// Lets the alerts of the stock run again. The stock is read again as a split changes its value.
+func (sm *StocksMgmt) releaseSplitHold(s *Stock) error {
+	sm.RLock()
+	sf, ok := sm.stocks[s.String()]
+	sm.RUnlock()
+	if !ok {
+		s.SplitHold = 0
+		return sm.store.Stocks.SaveStock(s)
+	}
+
+	sf.Lock()
+	defer sf.Unlock()
+	if stored := sm.store.Stocks.GetStockFromId(sf.Stock.Id); stored != nil {
+		*sf.Stock = *stored
+	}
+	sf.Stock.SplitHold = 0
+	return sm.store.Stocks.SaveStock(sf.Stock)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGuessSplit(t *testing.T) {
+	for _, c := range []struct {
+		before, after        Decimal
+		newShares, oldShares int64
+	}{
+		{DecimalFromInt(100), DecimalFromInt(50), 2, 1},
+		{DecimalFromInt(100), DecimalFromFloat(51.5), 2, 1},
+		{DecimalFromInt(90), DecimalFromFloat(29.9), 3, 1},
+		{DecimalFromInt(2), DecimalFromFloat(19.5), 1, 10},
+		{DecimalFromInt(100), DecimalFromInt(60), 0, 0},
+		{DecimalFromInt(100), DecimalFromInt(95), 0, 0},
+		{DecimalFromInt(100), DecimalFromInt(2), 0, 0},
+		{0, DecimalFromInt(50), 0, 0},
+	} {
+		if newShares, oldShares := guessSplit(c.before, c.after); newShares != c.newShares || oldShares != c.oldShares {
+			t.Errorf("%v -> %v: %d:%d instead of %d:%d", c.before, c.after, newShares, oldShares, c.newShares, c.oldShares)
+		}
+	}
+
+	if _, _, err := parseSplitRatio("1:1"); err == nil {
+		t.Error("A 1:1 split shouldn't be accepted")
+	}
+	if newShares, oldShares, err := parseSplitRatio("1:10"); err != nil || newShares != 1 || oldShares != 10 {
+		t.Errorf("Wrong ratio: %d:%d, %v", newShares, oldShares, err)
+	}
+}
+
+// Applies a 2:1 split, what happened before it is adjusted
+func checkSplit(t *testing.T, store *Storage) {
+	c := store.Contacts.GetContactFromEmail("florent@clairambault.fr")
+	s := &Stock{Market: "FR", Short: "RNO", Name: "RENAULT", Currency: "EUR"}
+	store.Stocks.SaveStock(s)
+	p := &Portfolio{Contact: c.Id, Name: DEFAULT_PORTFOLIO, Default: true}
+	store.Portfolios.SavePortfolio(p)
+
+	date := time.Date(2024, 6, 10, 0, 0, 0, 0, time.UTC).UnixNano()
+	before, after := date-int64(time.Hour), date+int64(time.Hour)
+	store.Values.AddStockValues([]Value{
+		{Stock: s.Id, Date: before - 1, Value: Decimal(4000000005)},
+		{Stock: s.Id, Date: before, Value: DecimalFromInt(40)},
+		{Stock: s.Id, Date: after, Value: DecimalFromInt(21)},
+	})
+	store.Transactions.SaveTransaction(&Transaction{Contact: c.Id, Portfolio: p.Id, Stock: s.Id, Date: before, Type: TRANSACTION_BUY, Nb: DecimalFromInt(3), Price: DecimalFromInt(41)})
+	store.Transactions.SaveTransaction(&Transaction{Contact: c.Id, Portfolio: p.Id, Stock: s.Id, Date: after, Type: TRANSACTION_BUY, Nb: DecimalFromInt(4), Price: DecimalFromInt(21)})
+	store.Alerts.SaveAlert(&Alert{Contact: c.Id, Stock: s.Id, LastValue: DecimalFromInt(40), LastTriggered: before, Percent: DecimalFromInt(5)})
+	store.PositionAlerts.SavePositionAlert(&PositionAlert{Contact: c.Id, Stock: s.Id, Type: POSITION_ALERT_STOP_LOSS, Cost: DecimalFromInt(41), High: DecimalFromInt(44)})
+	// Created after the split date, before the split was known
+	store.PositionAlerts.SavePositionAlert(&PositionAlert{Contact: c.Id, Stock: s.Id, Type: POSITION_ALERT_TAKE_PROFIT, Cost: DecimalFromFloat(28.9), High: DecimalFromInt(41)})
+
+	if _, err := applySplit(store, s, 2, 1, date); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := applySplit(store, s, 2, 1, date); err == nil {
+		t.Fatal("The same split shouldn't be applied twice")
+	}
+
+	values := *store.Values.GetStockValues(s, 0, after+1)
+	// Rounded the same way by all the backends
+	if len(values) != 3 || values[0].Value != Decimal(2000000003) || values[1].Value != DecimalFromInt(20) || values[2].Value != DecimalFromInt(21) {
+		t.Fatalf("Wrong values: %#v", values)
+	}
+	transactions := *store.Transactions.GetTransactions(c, nil, s)
+	if len(transactions) != 2 || transactions[0].Nb != DecimalFromInt(6) || transactions[0].Price != DecimalFromFloat(20.5) || transactions[1].Nb != DecimalFromInt(4) {
+		t.Fatalf("Wrong transactions: %#v", transactions)
+	}
+	if alerts := *store.Alerts.GetAlertsForStock(s); len(alerts) != 1 || alerts[0].LastValue != DecimalFromInt(20) {
+		t.Fatalf("Wrong alerts: %#v", alerts)
+	}
+	// The costs and highs come from the adjusted transactions and values
+	alerts := *store.PositionAlerts.GetPositionAlertsForStock(s)
+	if len(alerts) != 2 {
+		t.Fatalf("Wrong position alerts: %#v", alerts)
+	}
+	for _, al := range alerts {
+		if al.Cost != DecimalFromFloat(20.7) || al.High != DecimalFromInt(21) {
+			t.Fatalf("Wrong position alert: %#v", al)
+		}
+	}
+	if actions := *store.Actions.GetCorporateActions(s); len(actions) != 1 || actions[0].String() != "2:1 split on 2024-06-10" {
+		t.Fatalf("Wrong actions: %#v", actions)
+	}
+}
+
+func TestSplit(t *testing.T) {
+	checkSplit(t, NewMemDB().Storage())
+}
+
+func TestSplitHold(t *testing.T) {
+	admins := config.Xmpp.Admin
+	defer func() { config.Xmpp.Admin = admins }()
+	config.Xmpp.Admin = nil
+
+	store := NewMemDB().Storage()
+	s := &Stock{Market: "FR", Short: "RNO", Name: "RENAULT", Currency: "EUR"}
+	store.Stocks.SaveStock(s)
+	c := store.Contacts.GetContactFromEmail("florent@clairambault.fr")
+	store.Alerts.SubscribeAlert(s, c, DecimalFromInt(5), ALERT_DIRECTION_BOTH, 0)
+	send := make(chan interface{}, 10)
+	sm := NewStocksMgmt(store, send)
+	sf := NewStockFollower(s, store, send)
+	sm.stocks[s.String()] = sf
+
+	now := time.Now().UTC().UnixNano()
+	store.Values.SaveStockValue(s, DecimalFromInt(40), now-int64(time.Minute))
+	// Nobody could confirm the split
+	if sf.waitsForSplit(DecimalFromInt(20), now) {
+		t.Fatal("The alerts shouldn't wait without admins")
+	}
+
+	config.Xmpp.Admin = []string{"admin@example.com"}
+	if sf.waitsForSplit(DecimalFromInt(39), now) {
+		t.Fatal("A small change isn't a split")
+	}
+	if !sf.waitsForSplit(DecimalFromInt(20), now) || sm.splitHold(s) != now {
+		t.Fatal("The alerts should wait")
+	}
+	if msg := (<-send).(*SendChat); msg.Remote != "admin@example.com" {
+		t.Fatalf("Wrong message: %#v", msg)
+	}
+	if msg := (<-send).(*SendChat); msg.Remote != c.Email || !strings.Contains(msg.Text, "delayed") {
+		t.Fatalf("Wrong message: %#v", msg)
+	}
+	// The hold survives a restart
+	if stored := store.Stocks.GetStockFromId(s.Id); stored.SplitHold != now {
+		t.Fatalf("Wrong hold: %d", stored.SplitHold)
+	}
+
+	// Until an admin tells what it is, the admins are asked again after a while
+	if !sf.waitsForSplit(DecimalFromInt(21), now+int64(time.Minute)) || len(send) != 0 {
+		t.Fatal("The alerts should still wait")
+	}
+	later := now + int64(SPLIT_REMINDER_DELAY)
+	if !sf.waitsForSplit(DecimalFromInt(21), later) || sm.splitHold(s) != now {
+		t.Fatal("The alerts should still wait")
+	}
+	if msg := (<-send).(*SendChat); msg.Remote != "admin@example.com" || !strings.Contains(msg.Text, "split fr:rno ignore") {
+		t.Fatalf("Wrong message: %#v", msg)
+	}
+	if !sf.waitsForSplit(DecimalFromInt(21), later+int64(time.Minute)) || len(send) != 0 {
+		t.Fatal("The admins were just asked")
+	}
+
+	s.SplitHold = now
+	if err := sm.releaseSplitHold(s); err != nil {
+		t.Fatal(err)
+	}
+	if sm.splitHold(s) != 0 || store.Stocks.GetStockFromId(s.Id).SplitHold != 0 || len(send) != 0 {
+		t.Fatal("The alerts shouldn't wait anymore")
+	}
+}
@@ -1,25 +1,80 @@
 package main
 
 import (
+	"encoding/xml"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"os"
 	"regexp"
-	"strconv"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
 const CURRENCY_EXPIRATION = int64(time.Minute) * 15
 
+// Source of the exchange rates
+type RateProvider interface {
+	// Rate to convert an amount from a currency to another one
+	Rate(from, to string) (Decimal, error)
+}
+
+// Providers that also know the rates of the past days
+type HistoricalRateProvider interface {
+	RateProvider
+	// Rate published on the day starting at date, or on the last day before it
+	RateAt(from, to string, date int64) (Decimal, error)
+}
+
+// The rates of the pairs a provider doesn't have go through this currency
+const CURRENCY_PIVOT = "EUR"
+
+// How long the history of the rates is kept in memory
+const CURRENCY_HISTORY_EXPIRATION = int64(time.Hour) * 12
+
+const (
+	RATE_PROVIDER_ECB        = "ecb"
+	RATE_PROVIDER_BOURSORAMA = "boursorama"
+)
+
+// Reference rates of the European Central Bank, published every working day since 1999
+const (
+	ECB_DAILY_URL   = "https://www.ecb.europa.eu/stats/eurofxref/eurofxref-daily.xml"
+	ECB_HISTORY_URL = "https://www.ecb.europa.eu/stats/eurofxref/eurofxref-hist.xml"
+)
+
+var rateProvider RateProvider = newEcbRateProvider(ECB_DAILY_URL, ECB_HISTORY_URL)
+
+// Creates the provider chosen in the config, the sources of the ECB rates can be URLs or local files
+func newRateProvider(name, source, history string) (RateProvider, error) {
+	switch strings.ToLower(name) {
+	case "", RATE_PROVIDER_ECB:
+		if source == "" {
+			source = ECB_DAILY_URL
+		}
+		if history == "" {
+			history = ECB_HISTORY_URL
+		}
+		return newEcbRateProvider(source, history), nil
+	case RATE_PROVIDER_BOURSORAMA:
+		return &boursoramaRateProvider{}, nil
+	}
+	return nil, errors.New(fmt.Sprintf("Unknown rate provider \"%s\" (%s or %s)", name, RATE_PROVIDER_ECB, RATE_PROVIDER_BOURSORAMA))
+}
+
+type boursoramaRateProvider struct{}
+
 var reRate = regexp.MustCompile("<span class=\"cotation\">([0-9\\ \\.]+)[^<>]*[A-Z]{2,3}</span>")
 
-func fetchCurrencyRate(from, to string) (float32, error) {
+func (p *boursoramaRateProvider) Rate(from, to string) (Decimal, error) {
 	resp, err := httpGet(fmt.Sprintf("http://www.boursorama.com/taux-de-change-x-%s-%s", from, to))
-	defer resp.Body.Close()
 	if err != nil {
 		return 0, err
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
 		return 0, errors.New(fmt.Sprintf("Wrong status code %d", resp.StatusCode))
 	}
@@ -42,35 +97,324 @@ func fetchCurrencyRate(from, to string) (float32, error) {
 	{ // And the value
 		result := reRate.FindStringSubmatch(body)
 		if len(result) >= 2 {
-			v, err := strconv.ParseFloat(strings.Replace(result[1], " ", "", -1), 32)
-			if err != nil {
-				return 0, err
-			}
-			return float32(v), nil
+			return ParseDecimal(strings.Replace(result[1], " ", "", -1))
 		} else {
 			return 0, errors.New(fmt.Sprintf("Could not fetch rate for %s/%s", from, to))
 		}
 	}
 }
 
-func CurrencyRate(from, to string) float32 {
-	cur := db.GetCurrencyConversion(from, to)
+// Rates of the euro on a day
+type ecbDay struct {
+	Date  int64
+	Rates map[string]Decimal
+}
 
-	if cur == nil {
-		return 0
+// Parses a feed of the ECB: "eurofxref-daily.xml" or "eurofxref-hist.xml", which has a cube per day (last day first)
+func parseEcbRates(r io.Reader) ([]ecbDay, error) {
+	var envelope struct {
+		Days []struct {
+			Time  string `xml:"time,attr"`
+			Rates []struct {
+				Currency string `xml:"currency,attr"`
+				Rate     string `xml:"rate,attr"`
+			} `xml:"Cube"`
+		} `xml:"Cube>Cube"`
+	}
+	if err := xml.NewDecoder(r).Decode(&envelope); err != nil {
+		return nil, err
+	}
+
+	days := []ecbDay{}
+	for _, d := range envelope.Days {
+		date, err := time.Parse("2006-01-02", d.Time)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid date \"%s\"", d.Time))
+		}
+		day := ecbDay{Date: date.UnixNano(), Rates: map[string]Decimal{"EUR": DECIMAL_UNIT}}
+		for _, rate := range d.Rates {
+			if day.Rates[rate.Currency], err = ParseDecimal(rate.Rate); err != nil {
+				return nil, err
+			}
+		}
+		days = append(days, day)
+	}
+	if len(days) == 0 {
+		return nil, errors.New("No rates in the feed")
+	}
+	return days, nil
+}
+
+// Reads a feed of the ECB from a URL or a local file
+func readEcbFeed(source string) ([]ecbDay, error) {
+	var r io.ReadCloser
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		resp, err := httpGet(source)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != 200 {
+			resp.Body.Close()
+			return nil, errors.New(fmt.Sprintf("Wrong status code %d", resp.StatusCode))
+		}
+		r = resp.Body
+	} else {
+		file, err := os.Open(source)
+		if err != nil {
+			return nil, err
+		}
+		r = file
+	}
+	defer r.Close()
+
+	return parseEcbRates(r)
+}
+
+// Rates are given for one euro, the other pairs go through the euro
+func ecbRate(rates map[string]Decimal, from, to string) (Decimal, error) {
+	for _, currency := range []string{from, to} {
+		if rates[currency] == 0 {
+			return 0, errors.New(fmt.Sprintf("No ECB rate for %s", currency))
+		}
+	}
+	return rates[to].Div(rates[from]), nil
+}
+
+// The rates of all the currencies come in the same feed: the daily one is kept as long as a rate of the database,
+// the history for a few hours
+type ecbRateProvider struct {
+	sync.Mutex
+	source         string // URL or local file
+	historySource  string
+	rates          map[string]Decimal
+	fetched        int64
+	history        []ecbDay // Last day first
+	historyFetched int64
+}
+
+func newEcbRateProvider(source, historySource string) *ecbRateProvider {
+	return &ecbRateProvider{source: source, historySource: historySource}
+}
+
+func (p *ecbRateProvider) Rate(from, to string) (Decimal, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	if now := time.Now().UTC().UnixNano(); p.rates == nil || now-p.fetched > CURRENCY_EXPIRATION {
+		days, err := readEcbFeed(p.source)
+		if err != nil {
+			return 0, err
+		}
+		p.rates, p.fetched = days[0].Rates, now
+	}
+	return ecbRate(p.rates, from, to)
+}
+
+func (p *ecbRateProvider) RateAt(from, to string, date int64) (Decimal, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.historySource == "" {
+		return 0, errors.New("No history of the ECB rates")
+	}
+	if now := time.Now().UTC().UnixNano(); p.history == nil || now-p.historyFetched > CURRENCY_HISTORY_EXPIRATION {
+		days, err := readEcbFeed(p.historySource)
+		if err != nil {
+			return 0, err
+		}
+		p.history, p.historyFetched = days, now
+	}
+
+	// There are no rates on week-ends and holidays
+	for _, day := range p.history {
+		if day.Date <= date {
+			return ecbRate(day.Rates, from, to)
+		}
+	}
+	return 0, errors.New(fmt.Sprintf("No ECB rate before %s", time.Unix(0, date).UTC().Format("2006-01-02")))
+}
+
+// Rate given by the provider, through the pivot currency when it doesn't have the pair
+func providerRate(from, to string) (Decimal, error) {
+	rate, err := rateProvider.Rate(from, to)
+	if (err != nil || rate == 0) && from != CURRENCY_PIVOT && to != CURRENCY_PIVOT {
+		var toPivot, fromPivot Decimal
+		if toPivot, err = rateProvider.Rate(from, CURRENCY_PIVOT); err == nil {
+			if fromPivot, err = rateProvider.Rate(CURRENCY_PIVOT, to); err == nil {
+				rate = toPivot.Mul(fromPivot)
+			}
+		}
+	}
+	if err == nil && rate == 0 {
+		err = errors.New(fmt.Sprintf("No rate for %s/%s", from, to))
+	}
+	return rate, err
+}
+
+// Rate to convert an amount from a currency to another one, 0 if we can't get it. Rates are kept in the database,
+// the ones we don't have are fetched when they're needed and the expired ones are fetched again. An expired rate
+// is still used when the provider fails.
+func CurrencyRate(currencies CurrencyRepository, from, to string) Decimal {
+	if from == to {
+		return DECIMAL_UNIT
 	}
 
+	cur := currencies.GetCurrencyConversion(from, to)
 	now := time.Now().UTC().UnixNano()
+	if cur != nil && now-cur.LastUpdate <= CURRENCY_EXPIRATION {
+		return cur.Rate
+	}
+
+	rate, err := rateProvider.Rate(from, to)
+	if (err != nil || rate == 0) && from != CURRENCY_PIVOT && to != CURRENCY_PIVOT {
+		rate, err = CurrencyRate(currencies, from, CURRENCY_PIVOT).Mul(CurrencyRate(currencies, CURRENCY_PIVOT, to)), nil
+	}
+	if err != nil || rate == 0 {
+		log.Warning("Could not get the %s/%s rate: %v", from, to, err)
+		if cur != nil {
+			return cur.Rate
+		}
+		return 0
+	}
+
+	if cur == nil {
+		cur = &CurrencyConversion{From: from, To: to}
+	}
+	cur.Rate, cur.LastUpdate = rate, now
+	if err := currencies.SaveCurrencyConversion(cur); err != nil {
+		log.Warning("Could not save the %s/%s rate: %s", from, to, err)
+	}
+	return rate
+}
+
+// Start of the day (UTC) of a date, the past rates are kept by day
+func rateDay(date int64) int64 {
+	t := time.Unix(0, date).UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC).UnixNano()
+}
 
-	if now-cur.LastUpdate > CURRENCY_EXPIRATION {
+// Rate of a past day, from the database or from the provider. It's 0 if we can't get it.
+func dailyRate(currencies CurrencyRepository, from, to string, day int64) Decimal {
+	if r := currencies.GetDailyRate(from, to, day); r != nil {
+		return r.Rate
+	}
+
+	rate := Decimal(0)
+	if provider, ok := rateProvider.(HistoricalRateProvider); ok {
 		var err error
-		if cur.Rate, err = fetchCurrencyRate(from, to); err == nil {
-			cur.LastUpdate = now
-			db.SaveCurrencyConversion(cur)
-		} else {
-			return 0
+		if rate, err = provider.RateAt(from, to, day); err != nil {
+			log.Warning("Could not get the %s/%s rate of %s: %s", from, to, time.Unix(0, day).UTC().Format("2006-01-02"), err)
+		}
+	}
+	if rate == 0 && from != CURRENCY_PIVOT && to != CURRENCY_PIVOT {
+		rate = dailyRate(currencies, from, CURRENCY_PIVOT, day).Mul(dailyRate(currencies, CURRENCY_PIVOT, to, day))
+	}
+	if rate == 0 {
+		return 0
+	}
+
+	if err := currencies.SaveDailyRate(&DailyRate{From: from, To: to, Date: day, Rate: rate}); err != nil {
+		log.Warning("Could not save the %s/%s rate: %s", from, to, err)
+	}
+	return rate
+}
+
+// Rate to convert an amount from a currency to another one at a date, 0 if we can't get it. The current rate is
+// used for today, and for the past days the provider doesn't know.
+func RateAt(currencies CurrencyRepository, from, to string, date int64) Decimal {
+	if from == to {
+		return DECIMAL_UNIT
+	}
+	if day := rateDay(date); day < rateDay(time.Now().UTC().UnixNano()) {
+		if rate := dailyRate(currencies, from, to, day); rate != 0 {
+			return rate
+		}
+	}
+	return CurrencyRate(currencies, from, to)
+}
+
+// Currency of the totals of the contacts that didn't choose one
+const DEFAULT_CURRENCY = "EUR"
+
+func (c *Contact) referenceCurrency() string {
+	if c.Currency == "" {
+		return DEFAULT_CURRENCY
+	}
+	return c.Currency
+}
+
+// Converts amounts to a currency, each rate is only looked up once
+type currencyConverter struct {
+	currencies CurrencyRepository
+	to         string
+	rates      map[string]Decimal
+	dailyRates map[string]Decimal // By currency and day
+}
+
+func newCurrencyConverter(currencies CurrencyRepository, to string) *currencyConverter {
+	return &currencyConverter{currencies: currencies, to: to, rates: make(map[string]Decimal), dailyRates: make(map[string]Decimal)}
+}
+
+// Rate from a currency, 0 if we don't know it. Amounts of an unknown currency aren't converted.
+func (cc *currencyConverter) rate(from string) Decimal {
+	if from == "" || from == cc.to {
+		return DECIMAL_UNIT
+	}
+	rate, ok := cc.rates[from]
+	if !ok {
+		rate = CurrencyRate(cc.currencies, from, cc.to)
+		cc.rates[from] = rate
+	}
+	return rate
+}
+
+// Converts an amount, the second result is false if we don't have the rate
+func (cc *currencyConverter) convert(amount Decimal, from string) (Decimal, bool) {
+	rate := cc.rate(from)
+	if rate == 0 {
+		return 0, false
+	}
+	return amount.Mul(rate), true
+}
+
+// Rate from a currency at a date, 0 if we don't know it
+func (cc *currencyConverter) rateAt(from string, date int64) Decimal {
+	if from == "" || from == cc.to {
+		return DECIMAL_UNIT
+	}
+	day := rateDay(date)
+	if day >= rateDay(time.Now().UTC().UnixNano()) {
+		return cc.rate(from)
+	}
+	key := fmt.Sprintf("%s/%d", from, day)
+	rate, ok := cc.dailyRates[key]
+	if !ok {
+		rate = RateAt(cc.currencies, from, cc.to, date)
+		cc.dailyRates[key] = rate
+		if _, known := cc.rates[from]; rate == 0 && !known {
+			cc.rates[from] = 0
 		}
 	}
+	return rate
+}
+
+// Converts an amount at the rate of a date, the second result is false if we don't have the rate
+func (cc *currencyConverter) convertAt(amount Decimal, from string, date int64) (Decimal, bool) {
+	rate := cc.rateAt(from, date)
+	if rate == 0 {
+		return 0, false
+	}
+	return amount.Mul(rate), true
+}
 
-	return cur.Rate
+// Currencies whose rate is missing, sorted
+func (cc *currencyConverter) missing() []string {
+	missing := []string{}
+	for currency, rate := range cc.rates {
+		if rate == 0 {
+			missing = append(missing, currency)
+		}
+	}
+	sort.Strings(missing)
+	return missing
 }
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+// The tests don't fetch the rates
+func init() {
+	rateProvider = newEcbRateProvider("testdata/eurofxref-daily.xml", "testdata/eurofxref-hist.xml")
+}
+
+func TestCurrencyConverter(t *testing.T) {
+	store := NewMemDB().Storage()
+	store.Currencies.SaveCurrencyConversion(&CurrencyConversion{From: "USD", To: "EUR", Rate: DecimalFromFloat(0.9), LastUpdate: time.Now().UTC().UnixNano()})
+
+	cc := newCurrencyConverter(store.Currencies, "EUR")
+	if amount, ok := cc.convert(DecimalFromInt(100), "USD"); !ok || amount != DecimalFromInt(90) {
+		t.Fatalf("Wrong conversion: %v", amount)
+	}
+	if amount, ok := cc.convert(DecimalFromInt(100), "EUR"); !ok || amount != DecimalFromInt(100) {
+		t.Fatalf("Wrong conversion: %v", amount)
+	}
+	if _, ok := cc.convert(DecimalFromInt(100), "XOF"); ok {
+		t.Fatal("We don't have the XOF rate")
+	}
+	if missing := cc.missing(); len(missing) != 1 || missing[0] != "XOF" {
+		t.Fatalf("Wrong missing rates: %v", missing)
+	}
+}
+
+func TestEcbRates(t *testing.T) {
+	file, err := os.Open("testdata/eurofxref-daily.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	days, err := parseEcbRates(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(days) != 1 || days[0].Date != time.Date(2024, 5, 10, 0, 0, 0, 0, time.UTC).UnixNano() || days[0].Rates["USD"] != DecimalFromFloat(1.0772) || len(days[0].Rates) != 31 {
+		t.Fatalf("Wrong rates: %#v", days)
+	}
+
+	p := newEcbRateProvider("testdata/eurofxref-daily.xml", "testdata/eurofxref-hist.xml")
+	if rate, err := p.Rate("EUR", "GBP"); err != nil || rate != DecimalFromFloat(0.86075) {
+		t.Fatalf("Wrong rate: %v / %v", rate, err)
+	}
+	// Through the euro
+	if rate, err := p.Rate("USD", "CHF"); err != nil || rate != DecimalFromFloat(0.9767).Div(DecimalFromFloat(1.0772)) {
+		t.Fatalf("Wrong rate: %v / %v", rate, err)
+	}
+	if _, err := p.Rate("EUR", "XOF"); err == nil {
+		t.Fatal("There's no XOF rate")
+	}
+
+	// The rate of the last day before the week-end
+	if rate, err := p.RateAt("EUR", "USD", time.Date(2024, 5, 12, 0, 0, 0, 0, time.UTC).UnixNano()); err != nil || rate != DecimalFromFloat(1.0772) {
+		t.Fatalf("Wrong rate: %v / %v", rate, err)
+	}
+	if rate, err := p.RateAt("EUR", "USD", time.Date(2024, 5, 8, 0, 0, 0, 0, time.UTC).UnixNano()); err != nil || rate != DecimalFromFloat(1.0746) {
+		t.Fatalf("Wrong rate: %v / %v", rate, err)
+	}
+	if _, err := p.RateAt("EUR", "USD", time.Date(2024, 5, 6, 0, 0, 0, 0, time.UTC).UnixNano()); err == nil {
+		t.Fatal("There's no rate before the history")
+	}
+}
+
+// Only knows the rates of the euro
+type pivotRateProvider map[string]Decimal
+
+func (p pivotRateProvider) Rate(from, to string) (Decimal, error) {
+	if from == "EUR" && p[to] != 0 {
+		return p[to], nil
+	} else if to == "EUR" && p[from] != 0 {
+		return DECIMAL_UNIT.Div(p[from]), nil
+	}
+	return 0, errors.New("Unknown pair")
+}
+
+func TestRateAt(t *testing.T) {
+	store := NewMemDB().Storage()
+
+	// The past rates are kept in the database
+	date := time.Date(2024, 5, 9, 15, 30, 0, 0, time.UTC).UnixNano()
+	if rate := RateAt(store.Currencies, "USD", "CHF", date); rate != DecimalFromFloat(0.9765).Div(DecimalFromFloat(1.0745)) {
+		t.Fatalf("Wrong rate: %v", rate)
+	}
+	if r := store.Currencies.GetDailyRate("USD", "CHF", rateDay(date)); r == nil || r.Date != time.Date(2024, 5, 9, 0, 0, 0, 0, time.UTC).UnixNano() {
+		t.Fatalf("The rate should have been saved: %#v", r)
+	}
+
+	// The current rate is used for today and when the provider doesn't have the day
+	if rate := RateAt(store.Currencies, "EUR", "GBP", time.Now().UnixNano()); rate != DecimalFromFloat(0.86075) {
+		t.Fatalf("Wrong rate: %v", rate)
+	}
+	if rate := RateAt(store.Currencies, "EUR", "GBP", time.Date(2000, 1, 3, 0, 0, 0, 0, time.UTC).UnixNano()); rate != DecimalFromFloat(0.86075) {
+		t.Fatalf("Wrong rate: %v", rate)
+	}
+
+	// The pairs the provider doesn't have go through the pivot currency
+	defer func(previous RateProvider) { rateProvider = previous }(rateProvider)
+	rateProvider = pivotRateProvider{"USD": DecimalFromInt(2), "CHF": DecimalFromInt(3)}
+	if rate := CurrencyRate(store.Currencies, "USD", "CHF"); rate != DecimalFromFloat(1.5) {
+		t.Fatalf("Wrong rate: %v", rate)
+	}
+}
+
+func TestCurrencyRate(t *testing.T) {
+	store := NewMemDB().Storage()
+
+	// New pairs are fetched and saved
+	if rate := CurrencyRate(store.Currencies, "USD", "EUR"); rate != DECIMAL_UNIT.Div(DecimalFromFloat(1.0772)) {
+		t.Fatalf("Wrong rate: %v", rate)
+	}
+	if cur := store.Currencies.GetCurrencyConversion("USD", "EUR"); cur == nil || cur.LastUpdate == 0 {
+		t.Fatalf("The rate should have been saved: %#v", cur)
+	}
+
+	// Rates are fetched again when they expire, an expired rate is used if we can't
+	store.Currencies.SaveCurrencyConversion(&CurrencyConversion{From: "EUR", To: "GBP", Rate: DecimalFromFloat(0.8), LastUpdate: 1})
+	if rate := CurrencyRate(store.Currencies, "EUR", "GBP"); rate != DecimalFromFloat(0.86075) {
+		t.Fatalf("Wrong rate: %v", rate)
+	}
+	store.Currencies.SaveCurrencyConversion(&CurrencyConversion{From: "EUR", To: "XOF", Rate: DecimalFromInt(655), LastUpdate: 1})
+	if rate := CurrencyRate(store.Currencies, "EUR", "XOF"); rate != DecimalFromInt(655) {
+		t.Fatalf("Wrong rate: %v", rate)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
@@ -22,38 +23,108 @@ type Stock struct {
 	Market        string  `db:"market"` // "FR","US","US2",W","AM"
 	Short         string  `db:"short"`
 	Name          string  `db:"name"`
-	Value         float32 `db:"value"` // Last value
+	Value         Decimal `db:"value"` // Last value
 	Currency      string  `db:"currency"`
 	FailedFetches int64   `db:"failed_fetches"`
+	Isin          string  `db:"isin"`       // Same for all the listings of a company, empty if we don't know it
+	SplitHold     int64   `db:"split_hold"` // Date of a jump that looks like a split while its alerts wait for an admin, 0 otherwise
 }
 
 type CurrencyConversion struct {
 	From       string  `db:"from"`
 	To         string  `db:"to"`
-	Rate       float32 `db:"rate"`
+	Rate       Decimal `db:"rate"`
 	LastUpdate int64   `db:"last_update"`
 }
 
-type ContactStockValue struct {
-	Id      int64   `db:"stock_value_id"`
-	Contact int64   `db:"contact_id"`
-	Stock   int64   `db:"stock_id"`
-	Nb      int32   `db:"nb"`
-	Value   float32 `db:"value"`
+// Stocks a contact follows as a group. The alert rule is subscribed for all of them when its percent isn't 0.
+type Watchlist struct {
+	Id               int64   `db:"watchlist_id"`
+	Contact          int64   `db:"contact_id"`
+	Name             string  `db:"name"`
+	Percent          Decimal `db:"percent"`
+	PercentDirection int     `db:"percent_direction"`
+	Duration         int64   `db:"duration"`
+}
+
+type WatchlistStock struct {
+	Watchlist int64 `db:"watchlist_id"`
+	Stock     int64 `db:"stock_id"`
+}
+
+// Market chosen by a contact for a ticker that is on several markets
+type MarketPreference struct {
+	Contact int64  `db:"contact_id"`
+	Short   string `db:"short"`
+	Market  string `db:"market"`
+}
+
+// Rate of a pair on a day, kept to value the shares at past dates
+type DailyRate struct {
+	From string  `db:"from"`
+	To   string  `db:"to"`
+	Date int64   `db:"date"` // Start of the day (UTC)
+	Rate Decimal `db:"rate"`
+}
+
+// A set of transactions of a contact (a PEA, a CTO, etc.)
+type Portfolio struct {
+	Id      int64  `db:"portfolio_id"`
+	Contact int64  `db:"contact_id"`
+	Name    string `db:"name"`
+	Default bool   `db:"is_default"` // Where the transactions go when no portfolio is given
+}
+
+// Name of the portfolio created for the contacts that don't have any
+const DEFAULT_PORTFOLIO = "main"
+
+// A purchase or a sale of shares
+type Transaction struct {
+	Id        int64   `db:"transaction_id"`
+	Contact   int64   `db:"contact_id"`
+	Portfolio int64   `db:"portfolio_id"`
+	Stock     int64   `db:"stock_id"`
+	Date      int64   `db:"date"` // 0 for the holdings registered before we had transactions
+	Type      string  `db:"type"` // TRANSACTION_BUY or TRANSACTION_SELL
+	Nb        Decimal `db:"nb"`   // Some brokers and savings plans deal with fractions of shares
+	Price     Decimal `db:"price"`
+	Fees      Decimal `db:"fees"`
+	Taxes     Decimal `db:"taxes"` // Stamp duty, financial transactions tax, etc.
+	Currency  string  `db:"currency"`
 }
 
+const (
+	TRANSACTION_BUY  = "buy"
+	TRANSACTION_SELL = "sell"
+)
+
+// Event of a stock that changes its price without changing the holdings' worth, the values, alert baselines and
+// holdings before its date are adjusted when it's registered
+type CorporateAction struct {
+	Id        int64  `db:"corporate_action_id"`
+	Stock     int64  `db:"stock_id"`
+	Date      int64  `db:"date"`
+	Type      string `db:"type"`       // CORPORATE_ACTION_SPLIT
+	NewShares int64  `db:"new_shares"` // Shares after the split for OldShares shares before it (2 for 1, 1 for 10)
+	OldShares int64  `db:"old_shares"`
+}
+
+const CORPORATE_ACTION_SPLIT = "split"
+
 type Contact struct {
 	Id         int64  `db:"contact_id"`
 	Email      string `db:"email"`
 	PauseUntil int64  `db:"pause_until"`
 	ShowUrl    bool   `db:"show_url"`
+	CostMethod string `db:"cost_method"` // COST_METHOD_AVERAGE or COST_METHOD_FIFO
+	Currency   string `db:"currency"`    // Reference currency of the totals, DEFAULT_CURRENCY if not set
 }
 
 type Value struct {
 	Id    int64   `db:"value_id"`
 	Stock int64   `db:"stock_id"`
 	Date  int64   `db:"date"`
-	Value float32 `db:"value"`
+	Value Decimal `db:"value"`
 }
 
 type Alert struct {
@@ -61,13 +132,75 @@ type Alert struct {
 	Contact          int64   `db:"contact_id"`
 	Stock            int64   `db:"stock_id"`
 	LastTriggered    int64   `db:"last_triggered"`
-	LastValue        float32 `db:"last_value"`
+	LastValue        Decimal `db:"last_value"`
 	LastDate         int64   `db:"last_date"`
 	Duration         int64   `db:"duration"`
-	Percent          float32 `db:"percent"`
+	Percent          Decimal `db:"percent"`
 	PercentDirection int     `db:"percent_direction"`
 }
 
+// Every time an alert is triggered
+type AlertTrigger struct {
+	Id        int64   `db:"trigger_id"`
+	Alert     int64   `db:"alert_id"` // The alert might have been deleted since then
+	Contact   int64   `db:"contact_id"`
+	Stock     int64   `db:"stock_id"`
+	Date      int64   `db:"date"`
+	Value     Decimal `db:"value"`
+	Percent   Decimal `db:"percent"`
+	Window    int64   `db:"time_window"` // Time since the previous trigger
+	Transport string  `db:"transport"`
+	Status    string  `db:"status"`
+}
+
+// Alert on the total value of the shares held in a portfolio
+type PortfolioAlert struct {
+	Id               int64   `db:"portfolio_alert_id"`
+	Contact          int64   `db:"contact_id"`
+	Portfolio        int64   `db:"portfolio_id"`
+	Type             string  `db:"type"` // PORTFOLIO_ALERT_CHANGE or PORTFOLIO_ALERT_DRAWDOWN
+	LastTriggered    int64   `db:"last_triggered"`
+	LastValue        Decimal `db:"last_value"` // Value at LastDate, in the currency of the contact
+	LastDate         int64   `db:"last_date"`  // Date of the reference prices (the peak for a drawdown)
+	Duration         int64   `db:"duration"`
+	Percent          Decimal `db:"percent"`
+	PercentDirection int     `db:"percent_direction"`
+}
+
+const (
+	PORTFOLIO_ALERT_CHANGE   = "change"   // Like the stock alerts
+	PORTFOLIO_ALERT_DRAWDOWN = "drawdown" // Loss since the highest value
+)
+
+// Alert on the price of a stock relative to what the shares held cost
+type PositionAlert struct {
+	Id            int64   `db:"position_alert_id"`
+	Contact       int64   `db:"contact_id"`
+	Stock         int64   `db:"stock_id"`
+	Type          string  `db:"type"` // POSITION_ALERT_STOP_LOSS, POSITION_ALERT_TAKE_PROFIT or POSITION_ALERT_TRAILING_STOP
+	Percent       Decimal `db:"percent"`
+	Cost          Decimal `db:"cost"`      // Price of the shares at the last check, fees and taxes included
+	High          Decimal `db:"high"`      // Highest price since the shares were bought
+	Triggered     bool    `db:"triggered"` // Set until the price goes back or the cost changes
+	LastTriggered int64   `db:"last_triggered"`
+}
+
+const (
+	POSITION_ALERT_STOP_LOSS     = "stop_loss"     // The price went down by a percentage of the cost
+	POSITION_ALERT_TAKE_PROFIT   = "take_profit"   // The price went up by a percentage of the cost
+	POSITION_ALERT_TRAILING_STOP = "trailing_stop" // The price went down by a percentage of its high
+)
+
+const (
+	TRANSPORT_XMPP = "xmpp"
+)
+
+const (
+	TRIGGER_STATUS_QUEUED = "queued"
+	TRIGGER_STATUS_SENT   = "sent"
+	TRIGGER_STATUS_FAILED = "failed"
+)
+
 const (
 	ALERT_DIRECTION_BOTH = iota
 	ALERT_DIRECTION_UP   = iota
@@ -77,44 +210,53 @@ const (
 type DatabaseUpgrade struct {
 	Version int
 	Sql     []string
+	Atomic  bool                             // All the queries are applied in one transaction, the upgrade stops if one of them fails
+	Code    func(tx *gorp.Transaction) error // Executed after the queries, only for atomic upgrades
+	// The queries of an atomic upgrade run without the foreign keys, the rows that reference deleted contacts or
+	// stocks are kept for fsck to report them. Code isn't supported.
+	ForeignKeysOff bool
 }
 
 type FtsDB struct {
 	connection *sql.DB
 	mapping    *gorp.DbMap
+	restoring  *gorp.DbMap // Same tables but the ids are inserted as they are
 }
 
+const PARAMETER_DB_VERSION = "db_version"
+
 const (
 	TABLE_PARAMETER           = "parameter"
 	TABLE_STOCK               = "stock"
 	TABLE_CONTACT             = "contact"
 	TABLE_VALUE               = "value"
 	TABLE_ALERT               = "alert"
-	TABLE_CONTACT_STOCK_VALUE = "contactstockvalue"
+	TABLE_CONTACT_STOCK_VALUE = "contactstockvalue" // Replaced by the transactions
 	TABLE_CURRENCY_CONVERSION = "currency_conversion"
+	TABLE_ALERT_TRIGGER       = "alert_trigger"
+	TABLE_TRANSACTION         = "stock_transaction"
+	TABLE_PORTFOLIO           = "portfolio"
+	TABLE_PORTFOLIO_ALERT     = "portfolio_alert"
+	TABLE_POSITION_ALERT      = "position_alert"
+	TABLE_DAILY_RATE          = "currency_daily_rate"
+	TABLE_MARKET_PREFERENCE   = "market_preference"
+	TABLE_WATCHLIST           = "watchlist"
+	TABLE_WATCHLIST_STOCK     = "watchlist_stock"
+	TABLE_CORPORATE_ACTION    = "corporate_action"
 )
 
-func NewFtsDB() *FtsDB {
-	// We connect to the database
-	conn, err := sql.Open("sqlite3", config.Db.File)
+func NewFtsDB(file string) *FtsDB {
+	// We connect to the database, foreign keys have to be enabled on each connection
+	conn, err := sql.Open("sqlite3", file+"?_foreign_keys=1")
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	// We create the DbMap instance
-	dbmap := &gorp.DbMap{Db: conn, Dialect: gorp.SqliteDialect{}}
+	dbmap := newDbMap(conn, true)
 
-	// We register the tables
-	dbmap.AddTableWithName(Parameter{}, TABLE_PARAMETER).SetKeys(false, "Name")
-	dbmap.AddTableWithName(Stock{}, TABLE_STOCK).SetKeys(true, "Id")
-	dbmap.AddTableWithName(Contact{}, TABLE_CONTACT).SetKeys(true, "Id")
-	dbmap.AddTableWithName(Value{}, TABLE_VALUE).SetKeys(true, "Id")
-	dbmap.AddTableWithName(Alert{}, TABLE_ALERT).SetKeys(true, "Id")
-	dbmap.AddTableWithName(CurrencyConversion{}, TABLE_CURRENCY_CONVERSION).SetUniqueTogether("from", "to")
-	dbmap.AddTableWithName(ContactStockValue{}, TABLE_CONTACT_STOCK_VALUE).SetKeys(true, "Id")
-
-	// We create the tables
-	err = dbmap.CreateTablesIfNotExists()
+	// We create the tables, the ones with foreign keys are created by the upgrades
+	err = newBaseDbMap(conn, true).CreateTablesIfNotExists()
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -126,13 +268,46 @@ func NewFtsDB() *FtsDB {
 		}
 	}
 
-	db := &FtsDB{connection: conn, mapping: dbmap}
+	db := &FtsDB{connection: conn, mapping: dbmap, restoring: newDbMap(conn, false)}
 
 	db.Upgrade()
 
 	return db
 }
 
+// Creates a mapping with all the tables, the ids are generated by the database if autoIncrement is set
+func newDbMap(conn *sql.DB, autoIncrement bool) *gorp.DbMap {
+	dbmap := newBaseDbMap(conn, autoIncrement)
+
+	dbmap.AddTableWithName(AlertTrigger{}, TABLE_ALERT_TRIGGER).SetKeys(autoIncrement, "Id")
+	dbmap.AddTableWithName(Transaction{}, TABLE_TRANSACTION).SetKeys(autoIncrement, "Id")
+	dbmap.AddTableWithName(Portfolio{}, TABLE_PORTFOLIO).SetKeys(autoIncrement, "Id")
+	dbmap.AddTableWithName(PortfolioAlert{}, TABLE_PORTFOLIO_ALERT).SetKeys(autoIncrement, "Id")
+	dbmap.AddTableWithName(PositionAlert{}, TABLE_POSITION_ALERT).SetKeys(autoIncrement, "Id")
+	dbmap.AddTableWithName(MarketPreference{}, TABLE_MARKET_PREFERENCE).SetUniqueTogether("contact_id", "short")
+	dbmap.AddTableWithName(Watchlist{}, TABLE_WATCHLIST).SetKeys(autoIncrement, "Id")
+	dbmap.AddTableWithName(WatchlistStock{}, TABLE_WATCHLIST_STOCK).SetUniqueTogether("watchlist_id", "stock_id")
+	dbmap.AddTableWithName(CorporateAction{}, TABLE_CORPORATE_ACTION).SetKeys(autoIncrement, "Id")
+
+	return dbmap
+}
+
+// Creates a mapping with the tables that the mapping can create, the tables with foreign keys are created by
+// the upgrades as gorp can't declare them
+func newBaseDbMap(conn *sql.DB, autoIncrement bool) *gorp.DbMap {
+	dbmap := &gorp.DbMap{Db: conn, Dialect: gorp.SqliteDialect{}}
+
+	dbmap.AddTableWithName(Parameter{}, TABLE_PARAMETER).SetKeys(false, "Name")
+	dbmap.AddTableWithName(Stock{}, TABLE_STOCK).SetKeys(autoIncrement, "Id")
+	dbmap.AddTableWithName(Contact{}, TABLE_CONTACT).SetKeys(autoIncrement, "Id")
+	dbmap.AddTableWithName(Value{}, TABLE_VALUE).SetKeys(autoIncrement, "Id")
+	dbmap.AddTableWithName(Alert{}, TABLE_ALERT).SetKeys(autoIncrement, "Id")
+	dbmap.AddTableWithName(CurrencyConversion{}, TABLE_CURRENCY_CONVERSION).SetUniqueTogether("from", "to")
+	dbmap.AddTableWithName(DailyRate{}, TABLE_DAILY_RATE).SetUniqueTogether("from", "to", "date")
+
+	return dbmap
+}
+
 // Performs an automatic database upgrade
 func (db *FtsDB) Upgrade() {
 	upgrades := []*DatabaseUpgrade{
@@ -158,17 +333,242 @@ func (db *FtsDB) Upgrade() {
 				`create index alert_stock on ` + TABLE_ALERT + `(stock_id);`,
 			},
 		},
+		&DatabaseUpgrade{
+			// SQLite can't add constraints to existing tables, we have to rebuild them
+			Version:        4,
+			Atomic:         true,
+			ForeignKeysOff: true,
+			Sql: []string{
+				// The holdings table isn't created by the mapping anymore
+				`create table if not exists ` + TABLE_CONTACT_STOCK_VALUE + ` (
+					"stock_value_id" integer not null primary key autoincrement,
+					"contact_id" integer, "stock_id" integer, "nb" integer, "value" real)`,
+				`create table alert_new (
+					"alert_id" integer not null primary key autoincrement,
+					"contact_id" integer not null references ` + TABLE_CONTACT + `(contact_id) on delete cascade,
+					"stock_id" integer not null references ` + TABLE_STOCK + `(stock_id) on delete cascade,
+					"last_triggered" integer, "last_value" real, "last_date" integer default 0,
+					"duration" integer default 0, "percent" real, "percent_direction" integer default 0)`,
+				`insert into alert_new select alert_id, contact_id, stock_id, last_triggered, last_value, last_date, duration, percent, percent_direction from ` + TABLE_ALERT,
+				`drop table ` + TABLE_ALERT,
+				`alter table alert_new rename to ` + TABLE_ALERT,
+				`create index alert_stock on ` + TABLE_ALERT + `(stock_id)`,
+				`create index alert_contact on ` + TABLE_ALERT + `(contact_id)`,
+
+				`create table contactstockvalue_new (
+					"stock_value_id" integer not null primary key autoincrement,
+					"contact_id" integer not null references ` + TABLE_CONTACT + `(contact_id) on delete cascade,
+					"stock_id" integer not null references ` + TABLE_STOCK + `(stock_id) on delete cascade,
+					"nb" integer, "value" real)`,
+				`insert into contactstockvalue_new select stock_value_id, contact_id, stock_id, nb, value from ` + TABLE_CONTACT_STOCK_VALUE,
+				`drop table ` + TABLE_CONTACT_STOCK_VALUE,
+				`alter table contactstockvalue_new rename to ` + TABLE_CONTACT_STOCK_VALUE,
+				`create index contactstockvalue_contact on ` + TABLE_CONTACT_STOCK_VALUE + `(contact_id)`,
+
+				`create table value_new (
+					"value_id" integer not null primary key autoincrement,
+					"stock_id" integer not null references ` + TABLE_STOCK + `(stock_id) on delete cascade,
+					"date" integer, "value" real)`,
+				`insert into value_new select value_id, stock_id, date, value from ` + TABLE_VALUE,
+				`drop table ` + TABLE_VALUE,
+				`alter table value_new rename to ` + TABLE_VALUE,
+				`create index value_stock_date on ` + TABLE_VALUE + `(stock_id, date)`,
+			},
+		},
+		&DatabaseUpgrade{
+			// The triggers reference the alerts, their table is created here with its foreign keys
+			Version: 5,
+			Atomic:  true,
+			Sql: []string{
+				`create table ` + TABLE_ALERT_TRIGGER + ` (
+					"trigger_id" integer not null primary key autoincrement,
+					"alert_id" integer,
+					"contact_id" integer not null references ` + TABLE_CONTACT + `(contact_id) on delete cascade,
+					"stock_id" integer not null references ` + TABLE_STOCK + `(stock_id) on delete cascade,
+					"date" integer, "value" real, "percent" real, "time_window" integer,
+					"transport" varchar(255), "status" varchar(255))`,
+				`create index alert_trigger_contact_date on ` + TABLE_ALERT_TRIGGER + `(contact_id, date)`,
+			},
+		},
+		&DatabaseUpgrade{
+			// Prices, rates and percentages were stored as floats
+			Version: 6,
+			Atomic:  true,
+			Code:    convertFloatColumns,
+		},
+		&DatabaseUpgrade{
+			// The holdings become purchases of an unknown date
+			Version:        7,
+			Atomic:         true,
+			ForeignKeysOff: true,
+			Sql: []string{
+				`create table ` + TABLE_TRANSACTION + ` (
+					"transaction_id" integer not null primary key autoincrement,
+					"contact_id" integer not null references ` + TABLE_CONTACT + `(contact_id) on delete cascade,
+					"stock_id" integer not null references ` + TABLE_STOCK + `(stock_id) on delete cascade,
+					"date" integer, "type" varchar(255), "nb" integer, "price" integer, "fees" integer,
+					"currency" varchar(255))`,
+				`create index stock_transaction_contact_stock on ` + TABLE_TRANSACTION + `(contact_id, stock_id)`,
+				`insert into ` + TABLE_TRANSACTION + ` (contact_id, stock_id, date, type, nb, price, fees, currency)
+					select h.contact_id, h.stock_id, 0, '` + TRANSACTION_BUY + `', h.nb, h.value, 0, coalesce(s.currency, '')
+					from ` + TABLE_CONTACT_STOCK_VALUE + ` h left join ` + TABLE_STOCK + ` s on s.stock_id = h.stock_id
+					where h.nb > 0 order by h.stock_value_id`,
+				`drop table ` + TABLE_CONTACT_STOCK_VALUE,
+			},
+		},
+		&DatabaseUpgrade{
+			Version: 8,
+			Sql: []string{
+				`alter table ` + TABLE_CONTACT + ` add column "cost_method" varchar(255) default ''`,
+			},
+		},
+		&DatabaseUpgrade{
+			Version: 9,
+			Sql: []string{
+				`alter table ` + TABLE_CONTACT + ` add column "currency" varchar(255) default ''`,
+			},
+		},
+		&DatabaseUpgrade{
+			// The transactions go in a default portfolio
+			Version:        10,
+			Atomic:         true,
+			ForeignKeysOff: true,
+			Sql: []string{
+				`create table ` + TABLE_PORTFOLIO + ` (
+					"portfolio_id" integer not null primary key autoincrement,
+					"contact_id" integer not null references ` + TABLE_CONTACT + `(contact_id) on delete cascade,
+					"name" varchar(255), "is_default" integer)`,
+				`create unique index portfolio_contact_name on ` + TABLE_PORTFOLIO + `(contact_id, name)`,
+				`insert into ` + TABLE_PORTFOLIO + ` (contact_id, name, is_default)
+					select distinct contact_id, '` + DEFAULT_PORTFOLIO + `', 1 from ` + TABLE_TRANSACTION,
+				`create table stock_transaction_new (
+					"transaction_id" integer not null primary key autoincrement,
+					"contact_id" integer not null references ` + TABLE_CONTACT + `(contact_id) on delete cascade,
+					"portfolio_id" integer not null references ` + TABLE_PORTFOLIO + `(portfolio_id) on delete cascade,
+					"stock_id" integer not null references ` + TABLE_STOCK + `(stock_id) on delete cascade,
+					"date" integer, "type" varchar(255), "nb" integer, "price" integer, "fees" integer,
+					"currency" varchar(255))`,
+				`insert into stock_transaction_new select t.transaction_id, t.contact_id,
+					(select p.portfolio_id from ` + TABLE_PORTFOLIO + ` p where p.contact_id = t.contact_id),
+					t.stock_id, t.date, t.type, t.nb, t.price, t.fees, t.currency from ` + TABLE_TRANSACTION + ` t`,
+				`drop table ` + TABLE_TRANSACTION,
+				`alter table stock_transaction_new rename to ` + TABLE_TRANSACTION,
+				`create index stock_transaction_contact_stock on ` + TABLE_TRANSACTION + `(contact_id, stock_id)`,
+				`create index stock_transaction_portfolio on ` + TABLE_TRANSACTION + `(portfolio_id)`,
+			},
+		},
+		&DatabaseUpgrade{
+			Version: 11,
+			Atomic:  true,
+			Sql: []string{
+				`create table ` + TABLE_PORTFOLIO_ALERT + ` (
+					"portfolio_alert_id" integer not null primary key autoincrement,
+					"contact_id" integer not null references ` + TABLE_CONTACT + `(contact_id) on delete cascade,
+					"portfolio_id" integer not null references ` + TABLE_PORTFOLIO + `(portfolio_id) on delete cascade,
+					"type" varchar(255), "last_triggered" integer, "last_value" integer, "last_date" integer,
+					"duration" integer, "percent" integer, "percent_direction" integer)`,
+				`create index portfolio_alert_contact on ` + TABLE_PORTFOLIO_ALERT + `(contact_id)`,
+				`create index portfolio_alert_portfolio on ` + TABLE_PORTFOLIO_ALERT + `(portfolio_id)`,
+			},
+		},
+		&DatabaseUpgrade{
+			Version: 12,
+			Sql: []string{
+				`alter table ` + TABLE_TRANSACTION + ` add column "taxes" integer default 0`,
+			},
+		},
+		&DatabaseUpgrade{
+			// The numbers of shares become decimals
+			Version: 13,
+			Atomic:  true,
+			Sql: []string{
+				`update ` + TABLE_TRANSACTION + ` set nb = nb * ` + fmt.Sprint(int64(DECIMAL_UNIT)),
+			},
+		},
+		&DatabaseUpgrade{
+			Version: 14,
+			Atomic:  true,
+			Sql: []string{
+				`create table ` + TABLE_POSITION_ALERT + ` (
+					"position_alert_id" integer not null primary key autoincrement,
+					"contact_id" integer not null references ` + TABLE_CONTACT + `(contact_id) on delete cascade,
+					"stock_id" integer not null references ` + TABLE_STOCK + `(stock_id) on delete cascade,
+					"type" varchar(255), "percent" integer, "cost" integer, "high" integer, "triggered" integer,
+					"last_triggered" integer)`,
+				`create index position_alert_contact on ` + TABLE_POSITION_ALERT + `(contact_id)`,
+				`create index position_alert_stock on ` + TABLE_POSITION_ALERT + `(stock_id)`,
+			},
+		},
+		&DatabaseUpgrade{
+			Version: 15,
+			Sql: []string{
+				`alter table ` + TABLE_STOCK + ` add column "isin" varchar(255) default ''`,
+				`create index stock_isin on ` + TABLE_STOCK + `(isin)`,
+			},
+		},
+		&DatabaseUpgrade{
+			Version: 16,
+			Atomic:  true,
+			Sql: []string{
+				`create table ` + TABLE_MARKET_PREFERENCE + ` (
+					"contact_id" integer not null references ` + TABLE_CONTACT + `(contact_id) on delete cascade,
+					"short" varchar(255), "market" varchar(255))`,
+				`create unique index market_preference_contact_short on ` + TABLE_MARKET_PREFERENCE + `(contact_id, short)`,
+			},
+		},
+		&DatabaseUpgrade{
+			Version: 17,
+			Atomic:  true,
+			Sql: []string{
+				`create table ` + TABLE_WATCHLIST + ` (
+					"watchlist_id" integer not null primary key autoincrement,
+					"contact_id" integer not null references ` + TABLE_CONTACT + `(contact_id) on delete cascade,
+					"name" varchar(255), "percent" integer, "percent_direction" integer, "duration" integer)`,
+				`create unique index watchlist_contact_name on ` + TABLE_WATCHLIST + `(contact_id, name)`,
+				`create table ` + TABLE_WATCHLIST_STOCK + ` (
+					"watchlist_id" integer not null references ` + TABLE_WATCHLIST + `(watchlist_id) on delete cascade,
+					"stock_id" integer not null references ` + TABLE_STOCK + `(stock_id) on delete cascade)`,
+				`create unique index watchlist_stock_watchlist_stock on ` + TABLE_WATCHLIST_STOCK + `(watchlist_id, stock_id)`,
+				`create index watchlist_stock_stock on ` + TABLE_WATCHLIST_STOCK + `(stock_id)`,
+			},
+		},
+		&DatabaseUpgrade{
+			Version: 18,
+			Atomic:  true,
+			Sql: []string{
+				`create table ` + TABLE_CORPORATE_ACTION + ` (
+					"corporate_action_id" integer not null primary key autoincrement,
+					"stock_id" integer not null references ` + TABLE_STOCK + `(stock_id) on delete cascade,
+					"date" integer, "type" varchar(255), "new_shares" integer, "old_shares" integer)`,
+				`create unique index corporate_action_stock_date on ` + TABLE_CORPORATE_ACTION + `(stock_id, date)`,
+			},
+		},
+		&DatabaseUpgrade{
+			Version: 19,
+			Sql: []string{
+				`alter table ` + TABLE_STOCK + ` add column "split_hold" integer default 0`,
+			},
+		},
 	}
 
 	// We get the current version
 	version := 0
-	if sVersion := db.GetParameter("db_version"); sVersion != nil {
+	if sVersion := db.GetParameter(PARAMETER_DB_VERSION); sVersion != nil {
 		version, _ = strconv.Atoi(*sVersion)
 	}
 
 	// We perform automatic upgrades
 	for _, up := range upgrades {
 		if version < up.Version {
+			if up.Atomic {
+				if err := db.atomicUpgrade(up); err != nil {
+					log.Error("Upgrade %d failed, stopping there: %s", up.Version, err)
+					return
+				}
+				version = up.Version
+				db.SetParameter(PARAMETER_DB_VERSION, fmt.Sprintf("%d", version))
+				continue
+			}
 			version = up.Version
 			for _, sql := range up.Sql {
 				log.Warning(`Performing SQL upgrade... "%s"`, sql)
@@ -179,9 +579,119 @@ func (db *FtsDB) Upgrade() {
 				}
 			}
 			// We want to save the version as soon as possible.
-			db.SetParameter("db_version", fmt.Sprintf("%d", version))
+			db.SetParameter(PARAMETER_DB_VERSION, fmt.Sprintf("%d", version))
+		}
+	}
+}
+
+func (db *FtsDB) atomicUpgrade(up *DatabaseUpgrade) error {
+	if up.ForeignKeysOff {
+		return db.upgradeWithoutForeignKeys(up)
+	}
+	return db.inTransaction(func(tx *gorp.Transaction) error {
+		for _, sql := range up.Sql {
+			log.Warning(`Performing SQL upgrade... "%s"`, sql)
+			if _, err := tx.Exec(sql); err != nil {
+				return errors.New(fmt.Sprintf(`query "%s": %s`, sql, err))
+			}
+		}
+		if up.Code != nil {
+			return up.Code(tx)
+		}
+		return nil
+	})
+}
+
+// The foreign keys can only be disabled outside of a transaction and for one connection, so the queries of the
+// upgrade run in a transaction of a connection we keep until they're enabled again
+func (db *FtsDB) upgradeWithoutForeignKeys(up *DatabaseUpgrade) error {
+	ctx := context.Background()
+	conn, err := db.connection.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "pragma foreign_keys = off"); err != nil {
+		return err
+	}
+	defer func() {
+		if _, err := conn.ExecContext(ctx, "pragma foreign_keys = on"); err != nil {
+			log.Error("Could not enable the foreign keys again: %s", err)
+		}
+	}()
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for _, sql := range up.Sql {
+		log.Warning(`Performing SQL upgrade... "%s"`, sql)
+		if _, err := tx.Exec(sql); err != nil {
+			tx.Rollback()
+			return errors.New(fmt.Sprintf(`query "%s": %s`, sql, err))
+		}
+	}
+	return tx.Commit()
+}
+
+// Columns that contained float32 values before we used decimals
+var decimalColumns = [][2]string{
+	{TABLE_STOCK, "value"},
+	{TABLE_VALUE, "value"},
+	{TABLE_ALERT, "last_value"},
+	{TABLE_ALERT, "percent"},
+	{TABLE_CONTACT_STOCK_VALUE, "value"},
+	{TABLE_CURRENCY_CONVERSION, "rate"},
+	{TABLE_ALERT_TRIGGER, "value"},
+	{TABLE_ALERT_TRIGGER, "percent"},
+}
+
+type floatColumnRow struct {
+	RowId int64           `db:"row_id"`
+	Value sql.NullFloat64 `db:"value"`
+}
+
+// Converts the floats to decimals. The floats were float32 values, so we keep their shortest representation
+// (70.9 and not 70.90000153). Columns declared as "real" keep their type but the integers we store in them stay
+// exact up to 2^53 (90 millions for a price).
+func convertFloatColumns(tx *gorp.Transaction) error {
+	for _, c := range decimalColumns {
+		table, column := c[0], c[1]
+		log.Warning("Converting %s.%s to decimals...", table, column)
+
+		var rows []*floatColumnRow
+		if _, err := tx.Select(&rows, `select rowid row_id, "`+column+`" value from `+table+` where typeof("`+column+`") = 'real'`); err != nil {
+			return err
+		}
+		for _, r := range rows {
+			if !r.Value.Valid {
+				continue
+			}
+			d := DecimalFromFloat32(float32(r.Value.Float64))
+			if _, err := tx.Exec(`update `+table+` set "`+column+`"=? where rowid=?`, d, r.RowId); err != nil {
+				return err
+			}
 		}
 	}
+	return nil
+}
+
+// Executes some code in a transaction, the transaction is rolled back if it returns an error
+func (db *FtsDB) inTransaction(f func(tx *gorp.Transaction) error) error {
+	tx, err := db.mapping.Begin()
+	if err != nil {
+		return err
+	}
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (db *FtsDB) Storage() *Storage {
+	return NewStorage(db)
 }
 
 func (db FtsDB) Close() {
@@ -217,17 +727,33 @@ func (db *FtsDB) GetContactFromId(id int64) *Contact {
 	return c
 }
 
-func (db *FtsDB) DeleteContact(c *Contact) (err error) {
-	_, err = db.mapping.Delete(c)
-	return err
+// Deletes a contact with its alerts and holdings. Foreign keys should do it but we don't want to rely on them.
+func (db *FtsDB) DeleteContact(c *Contact) error {
+	return db.inTransaction(func(tx *gorp.Transaction) error {
+		if _, err := tx.Exec("delete from "+TABLE_WATCHLIST_STOCK+" where watchlist_id in (select watchlist_id from "+TABLE_WATCHLIST+" where contact_id=?)", c.Id); err != nil {
+			return err
+		}
+		for _, table := range []string{TABLE_ALERT, TABLE_POSITION_ALERT, TABLE_TRANSACTION, TABLE_PORTFOLIO_ALERT, TABLE_PORTFOLIO, TABLE_ALERT_TRIGGER, TABLE_MARKET_PREFERENCE, TABLE_WATCHLIST} {
+			if _, err := tx.Exec("delete from "+table+" where contact_id=?", c.Id); err != nil {
+				return err
+			}
+		}
+		_, err := tx.Delete(c)
+		return err
+	})
 }
 
+// Deletes a stock with its alerts, values and holdings
 func (db *FtsDB) DeleteStock(s *Stock) error {
-	for _, a := range *db.GetAlertsForStock(s) {
-		db.DeleteAlert(&a)
-	}
-	_, err := db.mapping.Delete(s)
-	return err
+	return db.inTransaction(func(tx *gorp.Transaction) error {
+		for _, table := range []string{TABLE_ALERT, TABLE_POSITION_ALERT, TABLE_VALUE, TABLE_TRANSACTION, TABLE_ALERT_TRIGGER, TABLE_WATCHLIST_STOCK, TABLE_CORPORATE_ACTION} {
+			if _, err := tx.Exec("delete from "+table+" where stock_id=?", s.Id); err != nil {
+				return err
+			}
+		}
+		_, err := tx.Delete(s)
+		return err
+	})
 }
 
 func (db *FtsDB) GetStock(market, short string) *Stock {
@@ -242,6 +768,12 @@ func (db *FtsDB) GetStock(market, short string) *Stock {
 	}
 }
 
+func (db *FtsDB) GetStocksFromIsin(isin string) *[]Stock {
+	var stocks []Stock
+	db.mapping.Select(&stocks, "select * from "+TABLE_STOCK+" where isin=? order by stock_id", isin)
+	return &stocks
+}
+
 func (db *FtsDB) GetStockFromId(id int64) *Stock {
 	s := &Stock{}
 	err := db.mapping.SelectOne(s, "select * from "+TABLE_STOCK+" where stock_id=?", id)
@@ -264,7 +796,7 @@ func (db *FtsDB) GetAllStocks() *[]Stock {
 	return &stocks
 }
 
-func (db *FtsDB) SaveStockValue(stock *Stock, value float32, date int64) (err error) {
+func (db *FtsDB) SaveStockValue(stock *Stock, value Decimal, date int64) (err error) {
 	if stock.Value != value {
 		stock.Value = value
 		err = db.SaveStock(stock)
@@ -279,7 +811,7 @@ func (db *FtsDB) SaveStockValue(stock *Stock, value float32, date int64) (err er
 	return err
 }
 
-func (this *FtsDB) GetStockValue(stock *Stock, date int64) (*Value, error) {
+func (db *FtsDB) GetStockValue(stock *Stock, date int64) (*Value, error) {
 	value := &Value{}
 	err := db.mapping.SelectOne(value, "select * from "+TABLE_VALUE+" where stock_id=? and date>? order by date desc limit 1;", stock.Id, date)
 
@@ -290,7 +822,34 @@ func (this *FtsDB) GetStockValue(stock *Stock, date int64) (*Value, error) {
 	}
 }
 
-func (db *FtsDB) SubscribeAlert(s *Stock, c *Contact, per float32, direction int, duration int64) (alert *Alert, err error) {
+func (db *FtsDB) GetStockValueAt(stock *Stock, date int64) (*Value, error) {
+	value := &Value{}
+	if err := db.mapping.SelectOne(value, "select * from "+TABLE_VALUE+" where stock_id=? and date<=? order by date desc limit 1", stock.Id, date); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// Adds past values without changing the last value of their stock
+func (db *FtsDB) AddStockValues(values []Value) error {
+	return db.inTransaction(func(tx *gorp.Transaction) error {
+		for i := range values {
+			if err := tx.Insert(&values[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Values of a stock between two dates (to is excluded), oldest first
+func (db *FtsDB) GetStockValues(stock *Stock, from, to int64) *[]Value {
+	var values []Value
+	db.mapping.Select(&values, "select * from "+TABLE_VALUE+" where stock_id=? and date>=? and date<? order by date", stock.Id, from, to)
+	return &values
+}
+
+func (db *FtsDB) SubscribeAlert(s *Stock, c *Contact, per Decimal, direction int, duration int64) (alert *Alert, err error) {
 	_, err = db.UnsubscribeAlert(s, c)
 
 	if err != nil {
@@ -309,6 +868,30 @@ func (db *FtsDB) UnsubscribeAlert(s *Stock, c *Contact) (ok bool, err error) {
 	return
 }
 
+func (db *FtsDB) SaveAlertTrigger(t *AlertTrigger) (err error) {
+	if t.Id != 0 {
+		_, err = db.mapping.Update(t)
+	} else {
+		err = db.mapping.Insert(t)
+	}
+	return
+}
+
+func (db *FtsDB) SetAlertTriggerStatus(id int64, status string) (err error) {
+	_, err = db.mapping.Exec("update "+TABLE_ALERT_TRIGGER+" set status=? where trigger_id=?", status, id)
+	return
+}
+
+func (db *FtsDB) GetAlertTriggers(c *Contact, s *Stock, since int64) *[]AlertTrigger {
+	var triggers []AlertTrigger
+	if s != nil {
+		db.mapping.Select(&triggers, "select * from "+TABLE_ALERT_TRIGGER+" where contact_id=? and stock_id=? and date>=? order by date", c.Id, s.Id, since)
+	} else {
+		db.mapping.Select(&triggers, "select * from "+TABLE_ALERT_TRIGGER+" where contact_id=? and date>=? order by date", c.Id, since)
+	}
+	return &triggers
+}
+
 func (db *FtsDB) SaveContact(c *Contact) (err error) {
 	if c.Id != 0 {
 		_, err = db.mapping.Update(c)
@@ -347,36 +930,124 @@ func (db *FtsDB) SaveStock(s *Stock) error {
 	}
 }
 
-func (db *FtsDB) GetContactStockValue(contactId, stockId int64) *ContactStockValue {
-	csv := &ContactStockValue{Contact: contactId, Stock: stockId}
-	db.mapping.SelectOne(csv, "select * from "+TABLE_CONTACT_STOCK_VALUE+" where contact_id=? and stock_id=?", csv.Contact, csv.Stock)
-	return csv
+func (db *FtsDB) GetTransaction(id int64) *Transaction {
+	t := &Transaction{}
+	if err := db.mapping.SelectOne(t, "select * from "+TABLE_TRANSACTION+" where transaction_id=?", id); err != nil {
+		return nil
+	}
+	return t
 }
 
-func (db *FtsDB) GetContactStockValuesFromContact(c *Contact) *[]ContactStockValue {
-	var values []ContactStockValue
-	db.mapping.Select(&values, "select * from "+TABLE_CONTACT_STOCK_VALUE+" where contact_id=?", c.Id)
-	return &values
+func (db *FtsDB) GetTransactions(c *Contact, p *Portfolio, s *Stock) *[]Transaction {
+	query, args := "select * from "+TABLE_TRANSACTION+" where contact_id=?", []interface{}{c.Id}
+	if p != nil {
+		query, args = query+" and portfolio_id=?", append(args, p.Id)
+	}
+	if s != nil {
+		query, args = query+" and stock_id=?", append(args, s.Id)
+	}
+	var transactions []Transaction
+	db.mapping.Select(&transactions, query+" order by date, transaction_id", args...)
+	return &transactions
 }
 
-func (db *FtsDB) SaveContactStockValue(csv *ContactStockValue) error {
-	if csv.Id != 0 {
-		_, err := db.mapping.Update(csv)
+func (db *FtsDB) GetPortfolios(c *Contact) *[]Portfolio {
+	var portfolios []Portfolio
+	db.mapping.Select(&portfolios, "select * from "+TABLE_PORTFOLIO+" where contact_id=? order by portfolio_id", c.Id)
+	return &portfolios
+}
+
+func (db *FtsDB) SavePortfolio(p *Portfolio) error {
+	if p.Id != 0 {
+		_, err := db.mapping.Update(p)
 		return err
 	} else {
-		return db.mapping.Insert(csv)
+		return db.mapping.Insert(p)
 	}
+}
+
+// Deletes a portfolio with its transactions and alerts
+func (db *FtsDB) DeletePortfolio(p *Portfolio) error {
+	return db.inTransaction(func(tx *gorp.Transaction) error {
+		for _, table := range []string{TABLE_TRANSACTION, TABLE_PORTFOLIO_ALERT} {
+			if _, err := tx.Exec("delete from "+table+" where portfolio_id=?", p.Id); err != nil {
+				return err
+			}
+		}
+		_, err := tx.Delete(p)
+		return err
+	})
+}
+
+func (db *FtsDB) GetPortfolioAlertsForContact(c *Contact) *[]PortfolioAlert {
+	var alerts []PortfolioAlert
+	db.mapping.Select(&alerts, "select * from "+TABLE_PORTFOLIO_ALERT+" where contact_id=? order by portfolio_alert_id", c.Id)
+	return &alerts
+}
 
+func (db *FtsDB) GetPortfolioAlertsForStock(s *Stock) *[]PortfolioAlert {
+	var alerts []PortfolioAlert
+	db.mapping.Select(&alerts, "select * from "+TABLE_PORTFOLIO_ALERT+" where portfolio_id in (select portfolio_id from "+TABLE_TRANSACTION+" where stock_id=?) order by portfolio_alert_id", s.Id)
+	return &alerts
 }
 
-func (db *FtsDB) DeleteContactStockValue(s *ContactStockValue) (err error) {
-	_, err = db.mapping.Delete(s)
+func (db *FtsDB) SavePortfolioAlert(a *PortfolioAlert) error {
+	if a.Id != 0 {
+		_, err := db.mapping.Update(a)
+		return err
+	} else {
+		return db.mapping.Insert(a)
+	}
+}
+
+func (db *FtsDB) DeletePortfolioAlert(a *PortfolioAlert) (err error) {
+	_, err = db.mapping.Delete(a)
+	return
+}
+
+func (db *FtsDB) GetPositionAlertsForContact(c *Contact) *[]PositionAlert {
+	var alerts []PositionAlert
+	db.mapping.Select(&alerts, "select * from "+TABLE_POSITION_ALERT+" where contact_id=? order by position_alert_id", c.Id)
+	return &alerts
+}
+
+func (db *FtsDB) GetPositionAlertsForStock(s *Stock) *[]PositionAlert {
+	var alerts []PositionAlert
+	db.mapping.Select(&alerts, "select * from "+TABLE_POSITION_ALERT+" where stock_id=? order by position_alert_id", s.Id)
+	return &alerts
+}
+
+func (db *FtsDB) SavePositionAlert(a *PositionAlert) error {
+	if a.Id != 0 {
+		_, err := db.mapping.Update(a)
+		return err
+	} else {
+		return db.mapping.Insert(a)
+	}
+}
+
+func (db *FtsDB) DeletePositionAlert(a *PositionAlert) (err error) {
+	_, err = db.mapping.Delete(a)
+	return
+}
+
+func (db *FtsDB) SaveTransaction(t *Transaction) error {
+	if t.Id != 0 {
+		_, err := db.mapping.Update(t)
+		return err
+	} else {
+		return db.mapping.Insert(t)
+	}
+}
+
+func (db *FtsDB) DeleteTransaction(t *Transaction) (err error) {
+	_, err = db.mapping.Delete(t)
 	return
 }
 
 func (db *FtsDB) GetCurrencyConversion(from, to string) *CurrencyConversion {
 	c := &CurrencyConversion{}
-	err := db.mapping.SelectOne(c, "select * from "+TABLE_CURRENCY_CONVERSION+" where from=? and to=?", from, to)
+	err := db.mapping.SelectOne(c, "select * from "+TABLE_CURRENCY_CONVERSION+` where "from" = ? and "to" = ?`, from, to)
 	if err == nil {
 		return c
 	} else {
@@ -405,28 +1076,296 @@ func (db *FtsDB) SetParameter(name, value string) error {
 	}
 }
 
+// There's a row per pair: it's updated if we already have it
 func (db *FtsDB) SaveCurrencyConversion(c *CurrencyConversion) error {
+	result, err := db.mapping.Exec(`update `+TABLE_CURRENCY_CONVERSION+` set rate = ?, last_update = ? where "from" = ? and "to" = ?`, c.Rate, c.LastUpdate, c.From, c.To)
+	if err != nil {
+		return err
+	}
+	if nb, err := result.RowsAffected(); err != nil || nb != 0 {
+		return err
+	}
 	return db.mapping.Insert(c)
 }
 
 func (db *FtsDB) DeleteCurrencyConversion(c *CurrencyConversion) (err error) {
-	_, err = db.mapping.Delete(c)
+	_, err = db.mapping.Exec(`delete from `+TABLE_CURRENCY_CONVERSION+` where "from" = ? and "to" = ?`, c.From, c.To)
+	return
+}
+
+func (db *FtsDB) GetDailyRate(from, to string, date int64) *DailyRate {
+	r := &DailyRate{}
+	if err := db.mapping.SelectOne(r, `select * from `+TABLE_DAILY_RATE+` where "from" = ? and "to" = ? and "date" = ?`, from, to, date); err == nil {
+		return r
+	} else {
+		return nil
+	}
+}
+
+// There's a row per pair and day: it's updated if we already have it
+func (db *FtsDB) SaveDailyRate(r *DailyRate) error {
+	result, err := db.mapping.Exec(`update `+TABLE_DAILY_RATE+` set rate = ? where "from" = ? and "to" = ? and "date" = ?`, r.Rate, r.From, r.To, r.Date)
+	if err != nil {
+		return err
+	}
+	if nb, err := result.RowsAffected(); err != nil || nb != 0 {
+		return err
+	}
+	return db.mapping.Insert(r)
+}
+
+func (db *FtsDB) GetWatchlists(c *Contact) *[]Watchlist {
+	var watchlists []Watchlist
+	db.mapping.Select(&watchlists, "select * from "+TABLE_WATCHLIST+" where contact_id=? order by name", c.Id)
+	return &watchlists
+}
+
+func (db *FtsDB) SaveWatchlist(w *Watchlist) error {
+	if w.Id != 0 {
+		_, err := db.mapping.Update(w)
+		return err
+	} else {
+		return db.mapping.Insert(w)
+	}
+}
+
+// Deletes a watchlist with its stocks, their alerts are kept
+func (db *FtsDB) DeleteWatchlist(w *Watchlist) error {
+	return db.inTransaction(func(tx *gorp.Transaction) error {
+		if _, err := tx.Exec("delete from "+TABLE_WATCHLIST_STOCK+" where watchlist_id=?", w.Id); err != nil {
+			return err
+		}
+		_, err := tx.Delete(w)
+		return err
+	})
+}
+
+func (db *FtsDB) GetWatchlistStocks(w *Watchlist) *[]Stock {
+	var stocks []Stock
+	db.mapping.Select(&stocks, "select s.* from "+TABLE_STOCK+" s join "+TABLE_WATCHLIST_STOCK+" ws on ws.stock_id = s.stock_id where ws.watchlist_id=? order by s.market, s.short", w.Id)
+	return &stocks
+}
+
+func (db *FtsDB) AddWatchlistStock(w *Watchlist, s *Stock) (err error) {
+	_, err = db.mapping.Exec("insert or ignore into "+TABLE_WATCHLIST_STOCK+" (watchlist_id, stock_id) values (?, ?)", w.Id, s.Id)
+	return
+}
+
+func (db *FtsDB) RemoveWatchlistStock(w *Watchlist, s *Stock) (err error) {
+	_, err = db.mapping.Exec("delete from "+TABLE_WATCHLIST_STOCK+" where watchlist_id=? and stock_id=?", w.Id, s.Id)
 	return
 }
 
-func (csv *ContactStockValue) Exists() bool {
-	return csv.Id != 0
+func (db *FtsDB) GetCorporateActions(s *Stock) *[]CorporateAction {
+	var actions []CorporateAction
+	db.mapping.Select(&actions, "select * from "+TABLE_CORPORATE_ACTION+" where stock_id=? order by date", s.Id)
+	return &actions
+}
+
+// Saves the action and adjusts everything of the stock that is older than it, all at once
+func (db *FtsDB) ApplyCorporateAction(a *CorporateAction) error {
+	return db.inTransaction(func(tx *gorp.Transaction) error {
+		if err := tx.Insert(a); err != nil {
+			return err
+		}
+
+		// Rounded like a.price(), the prices are positive. The column is declared as real, the division has to be
+		// done on integers.
+		if _, err := tx.Exec("update "+TABLE_VALUE+" set value = (cast(value as integer) * ? * 2 + ?) / (? * 2) where stock_id=? and date<?",
+			a.OldShares, a.NewShares, a.NewShares, a.Stock, a.Date); err != nil {
+			return err
+		}
+		last, err := tx.SelectInt("select coalesce(max(date), 0) from "+TABLE_VALUE+" where stock_id=?", a.Stock)
+		if err != nil {
+			return err
+		}
+		if last < a.Date {
+			// The last value of the stock is older than the action too
+			var s Stock
+			if err := tx.SelectOne(&s, "select * from "+TABLE_STOCK+" where stock_id=?", a.Stock); err != nil {
+				return err
+			}
+			if _, err := tx.Exec("update "+TABLE_STOCK+" set value=? where stock_id=?", a.price(s.Value), s.Id); err != nil {
+				return err
+			}
+		}
+
+		var alerts []Alert
+		if _, err := tx.Select(&alerts, "select * from "+TABLE_ALERT+" where stock_id=?", a.Stock); err != nil {
+			return err
+		}
+		for _, al := range alerts {
+			if a.adjustsAlert(&al) {
+				if _, err := tx.Update(&al); err != nil {
+					return err
+				}
+			}
+		}
+
+		var transactions []Transaction
+		if _, err := tx.Select(&transactions, "select * from "+TABLE_TRANSACTION+" where stock_id=? and date<?", a.Stock, a.Date); err != nil {
+			return err
+		}
+		for _, t := range transactions {
+			a.adjustTransaction(&t)
+			if _, err := tx.Update(&t); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (db *FtsDB) GetMarketPreference(c *Contact, short string) *MarketPreference {
+	p := &MarketPreference{}
+	if err := db.mapping.SelectOne(p, "select * from "+TABLE_MARKET_PREFERENCE+" where contact_id=? and short=?", c.Id, short); err == nil {
+		return p
+	} else {
+		return nil
+	}
+}
+
+// There's a row per contact and ticker: it's updated if we already have it
+func (db *FtsDB) SaveMarketPreference(p *MarketPreference) error {
+	result, err := db.mapping.Exec("update "+TABLE_MARKET_PREFERENCE+" set market=? where contact_id=? and short=?", p.Market, p.Contact, p.Short)
+	if err != nil {
+		return err
+	}
+	if nb, err := result.RowsAffected(); err != nil || nb != 0 {
+		return err
+	}
+	return db.mapping.Insert(p)
+}
+
+func (db *FtsDB) CheckIntegrity(repair bool) (report *IntegrityReport, err error) {
+	report = NewIntegrityReport(repair)
+	err = db.inTransaction(func(tx *gorp.Transaction) error {
+		for _, check := range orphanChecks {
+			where := " where " + check.Column + " not in (select " + check.Column + " from " + check.Parent + ")"
+			nb, err := tx.SelectInt("select count(*) from " + check.Table + where)
+			if err != nil {
+				return err
+			}
+			report.Orphans[check] = nb
+			if repair && nb != 0 {
+				if _, err := tx.Exec("delete from " + check.Table + where); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	return
+}
+
+func (db *FtsDB) Dump(withValues bool) (*Backup, error) {
+	b := &Backup{}
+
+	type query struct {
+		holder interface{}
+		table  string
+		order  string
+	}
+	queries := []query{
+		{&b.Parameters, TABLE_PARAMETER, "name"},
+		{&b.Contacts, TABLE_CONTACT, "contact_id"},
+		{&b.Stocks, TABLE_STOCK, "stock_id"},
+		{&b.Conversions, TABLE_CURRENCY_CONVERSION, `"from", "to"`},
+		{&b.Alerts, TABLE_ALERT, "alert_id"},
+		{&b.PositionAlerts, TABLE_POSITION_ALERT, "position_alert_id"},
+		{&b.Portfolios, TABLE_PORTFOLIO, "portfolio_id"},
+		{&b.PortfolioAlerts, TABLE_PORTFOLIO_ALERT, "portfolio_alert_id"},
+		{&b.Transactions, TABLE_TRANSACTION, "transaction_id"},
+		{&b.Triggers, TABLE_ALERT_TRIGGER, "trigger_id"},
+		{&b.MarketPreferences, TABLE_MARKET_PREFERENCE, "contact_id, short"},
+		{&b.Watchlists, TABLE_WATCHLIST, "watchlist_id"},
+		{&b.WatchlistStocks, TABLE_WATCHLIST_STOCK, "watchlist_id, stock_id"},
+		{&b.CorporateActions, TABLE_CORPORATE_ACTION, "corporate_action_id"},
+	}
+	if withValues {
+		queries = append(queries, query{&b.Values, TABLE_VALUE, "value_id"}, query{&b.DailyRates, TABLE_DAILY_RATE, `"from", "to", "date"`})
+	}
+
+	// A transaction gives us a consistent view of the data
+	err := db.inTransaction(func(tx *gorp.Transaction) error {
+		for _, q := range queries {
+			if _, err := tx.Select(q.holder, "select * from "+q.table+" order by "+q.order); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	return b, err
+}
+
+func (db *FtsDB) IsEmpty() bool {
+	nb, err := db.mapping.SelectInt("select (select count(*) from " + TABLE_CONTACT + ") + (select count(*) from " + TABLE_STOCK + ")")
+	return err == nil && nb == 0
+}
+
+// Replaces all the data (but the database version) with the content of the backup
+func (db *FtsDB) Restore(b *Backup) error {
+	tx, err := db.restoring.Begin()
+	if err != nil {
+		return err
+	}
+
+	err = func() error {
+		// Children first
+		for _, table := range []string{TABLE_CORPORATE_ACTION, TABLE_WATCHLIST_STOCK, TABLE_WATCHLIST, TABLE_ALERT_TRIGGER, TABLE_ALERT, TABLE_POSITION_ALERT, TABLE_TRANSACTION, TABLE_PORTFOLIO_ALERT, TABLE_PORTFOLIO, TABLE_MARKET_PREFERENCE, TABLE_VALUE, TABLE_STOCK, TABLE_CONTACT, TABLE_CURRENCY_CONVERSION, TABLE_DAILY_RATE} {
+			if _, err := tx.Exec("delete from " + table); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.Exec("delete from "+TABLE_PARAMETER+" where name != ?", PARAMETER_DB_VERSION); err != nil {
+			return err
+		}
+
+		for _, row := range b.rows() {
+			if err := tx.Insert(row); err != nil {
+				return err
+			}
+		}
+		return nil
+	}()
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
 }
 
 func (s *Stock) String() string {
 	return fmt.Sprintf("\"%s\" (%s:%s)", s.Name, s.Market, s.Short)
 }
 
+// Market and short name, as the users type it
+func (s *Stock) Symbol() string {
+	return s.Market + ":" + s.Short
+}
+
 func (this *Alert) String() string {
-	// NOTE: This performs a request on each String call
-	stock := db.GetStockFromId(this.Stock)
+	return this.Format(nil)
+}
+
+// Describes the alert, the stock is only used for its name
+func (this *Alert) Format(stock *Stock) string {
+	var stockName string
+	if stock != nil {
+		stockName = stock.String()
+	} else {
+		stockName = fmt.Sprintf("stock #%d", this.Stock)
+	}
+
+	return fmt.Sprintf("%s %s [%d]", stockName, formatAlertRule(this.Percent, this.PercentDirection, this.Duration), this.Id)
+}
+
+// Percent of an alert with its direction and its duration ("+5.00% on 24h0m0s")
+func formatAlertRule(percent Decimal, percentDirection int, duration int64) string {
 	var direction string
-	switch this.PercentDirection {
+	switch percentDirection {
 	case ALERT_DIRECTION_UP:
 		direction = "+"
 	case ALERT_DIRECTION_DOWN:
@@ -435,10 +1374,73 @@ func (this *Alert) String() string {
 		direction = "~"
 	}
 
-	str := fmt.Sprintf("%s %s%.2f%%", stock.String(), direction, this.Percent)
-	if this.Duration != 0 {
-		str += fmt.Sprintf(" on %s", time.Duration(this.Duration))
+	str := fmt.Sprintf("%s%.2f%%", direction, percent)
+	if duration != 0 {
+		str += fmt.Sprintf(" on %s", time.Duration(duration))
+	}
+	return str
+}
+
+// Describes the alert, the portfolio is only used for its name
+func (a *PortfolioAlert) Format(p *Portfolio) string {
+	name := fmt.Sprintf("portfolio #%d", a.Portfolio)
+	if p != nil {
+		name = "@" + p.Name
+	}
+
+	var str string
+	if a.Type == PORTFOLIO_ALERT_DRAWDOWN {
+		str = fmt.Sprintf("%s drawdown %.2f%%", name, a.Percent)
+	} else {
+		direction := "~"
+		switch a.PercentDirection {
+		case ALERT_DIRECTION_UP:
+			direction = "+"
+		case ALERT_DIRECTION_DOWN:
+			direction = "-"
+		}
+		str = fmt.Sprintf("%s %s%.2f%%", name, direction, a.Percent)
+		if a.Duration != 0 {
+			str += fmt.Sprintf(" on %s", time.Duration(a.Duration))
+		}
+	}
+	str += fmt.Sprintf(" [%d]", a.Id)
+	return str
+}
+
+// Describes the alert, the stock is only used for its name
+func (a *PositionAlert) Format(stock *Stock) string {
+	stockName := fmt.Sprintf("stock #%d", a.Stock)
+	if stock != nil {
+		stockName = stock.String()
+	}
+
+	var str string
+	switch a.Type {
+	case POSITION_ALERT_TAKE_PROFIT:
+		str = fmt.Sprintf("%s take profit +%.2f%%", stockName, a.Percent)
+	case POSITION_ALERT_TRAILING_STOP:
+		str = fmt.Sprintf("%s trailing stop -%.2f%%", stockName, a.Percent)
+	default:
+		str = fmt.Sprintf("%s stop loss -%.2f%%", stockName, a.Percent)
+	}
+	str += fmt.Sprintf(" [%d]", a.Id)
+	return str
+}
+
+// Describes the transaction ("2024-01-15: buy 10 "RENAULT" (FR:RNO) at 45.200 EUR")
+func (t *Transaction) Format(stock *Stock) string {
+	date := "unknown date"
+	if t.Date != 0 {
+		date = time.Unix(0, t.Date).UTC().Format("2006-01-02")
+	}
+	str := fmt.Sprintf("%s: %s %v %s at %.03f %s", date, t.Type, t.Nb, stock, t.Price, t.Currency)
+	if t.Fees != 0 && t.Taxes != 0 {
+		str += fmt.Sprintf(" (fees: %.02f, taxes: %.02f)", t.Fees, t.Taxes)
+	} else if t.Fees != 0 {
+		str += fmt.Sprintf(" (fees: %.02f)", t.Fees)
+	} else if t.Taxes != 0 {
+		str += fmt.Sprintf(" (taxes: %.02f)", t.Taxes)
 	}
-	str += fmt.Sprintf(" [%d]", this.Id)
 	return str
 }
@@ -1,31 +1,88 @@
 package main
 
 import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
 	"testing"
 )
 
+// Opens a database in a temporary directory, the returned function closes and removes it
+func newTestDB(t *testing.T) (*FtsDB, func()) {
+	dir, err := ioutil.TempDir("", "followthestock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := NewFtsDB(path.Join(dir, "test.db"))
+	return db, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
 // It's never too late to add unit tests
 func TestParameters(t *testing.T) {
-	db := NewFtsDB()
-	defer db.Close()
+	db, done := newTestDB(t)
+	defer done()
 
 	if err := db.SetParameter("test1", "value1"); err != nil {
 		t.Fatal(err)
 	}
 
 	if value := db.GetParameter("test2"); value != nil {
-		t.Fatalf(`value should be nil, it's "%s"`, value)
+		t.Fatalf(`value should be nil, it's "%s"`, *value)
 	}
 
 	if value := db.GetParameter("test1"); value == nil || *value != "value1" {
-		t.Fatalf(`value should be "test1", it's "%s"`, value)
+		t.Fatalf(`value should be "test1", it's "%v"`, value)
 	}
 
 }
 
+func TestCurrencyConversions(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+
+	if cur := db.GetCurrencyConversion("USD", "EUR"); cur != nil {
+		t.Fatalf("There's no conversion yet: %#v", cur)
+	}
+	for _, rate := range []float64{0.9, 0.95} {
+		if err := db.SaveCurrencyConversion(&CurrencyConversion{From: "USD", To: "EUR", Rate: DecimalFromFloat(rate), LastUpdate: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cur := db.GetCurrencyConversion("USD", "EUR"); cur == nil || cur.Rate != DecimalFromFloat(0.95) {
+		t.Fatalf("The conversion should have been updated: %#v", cur)
+	}
+	if nb, _ := db.mapping.SelectInt("select count(*) from " + TABLE_CURRENCY_CONVERSION); nb != 1 {
+		t.Fatalf("%d conversions instead of 1", nb)
+	}
+
+	if err := db.DeleteCurrencyConversion(&CurrencyConversion{From: "USD", To: "EUR"}); err != nil {
+		t.Fatal(err)
+	}
+	if cur := db.GetCurrencyConversion("USD", "EUR"); cur != nil {
+		t.Fatalf("The conversion should have been deleted: %#v", cur)
+	}
+
+	for _, rate := range []float64{0.9, 0.95} {
+		if err := db.SaveDailyRate(&DailyRate{From: "USD", To: "EUR", Date: 10, Rate: DecimalFromFloat(rate)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if r := db.GetDailyRate("USD", "EUR", 10); r == nil || r.Rate != DecimalFromFloat(0.95) {
+		t.Fatalf("The rate should have been updated: %#v", r)
+	}
+	if r := db.GetDailyRate("USD", "EUR", 11); r != nil {
+		t.Fatalf("There's no rate on that day: %#v", r)
+	}
+}
+
 func TestStockDeletion(t *testing.T) {
-	db := NewFtsDB()
-	defer db.Close()
+	db, done := newTestDB(t)
+	defer done()
 
 	{ // Data insertion
 		s := &Stock{
@@ -37,18 +94,20 @@ func TestStockDeletion(t *testing.T) {
 			t.Fatal("Problem", err)
 		}
 
-		c := &Contact{
-			Email: "florent@clairambault.fr",
-		}
-
-		db.SaveContact(c)
+		c := db.GetContactFromEmail("florent@clairambault.fr")
 
 		a := &Alert{
 			Stock:   s.Id,
 			Contact: c.Id,
 		}
 
-		db.SaveAlert(a)
+		if err := db.SaveAlert(a); err != nil {
+			t.Fatal("Problem", err)
+		}
+
+		if err := db.SaveStockValue(s, DecimalFromFloat(3.5), 1); err != nil {
+			t.Fatal("Problem", err)
+		}
 	}
 
 	{ // Data check and deletion
@@ -65,5 +124,276 @@ func TestStockDeletion(t *testing.T) {
 		if s != nil {
 			t.Fatalf("We should not have a stock anymore: %#v", s)
 		}
+
+		c := db.GetContactFromEmail("florent@clairambault.fr")
+		if alerts := db.GetAlertsForContact(c); len(*alerts) != 0 {
+			t.Fatalf("We should not have alerts anymore: %#v", alerts)
+		}
+	}
+
+	if report, err := db.CheckIntegrity(false); err != nil {
+		t.Fatal(err)
+	} else if report.String() != "No orphan found." {
+		t.Fatal(report)
+	}
+}
+
+func TestContactDeletion(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+
+	s := &Stock{Market: "FR", Short: "RNO"}
+	if err := db.SaveStock(s); err != nil {
+		t.Fatal(err)
+	}
+
+	c := db.GetContactFromEmail("florent@clairambault.fr")
+	if _, err := db.SubscribeAlert(s, c, DecimalFromInt(2), ALERT_DIRECTION_BOTH, 0); err != nil {
+		t.Fatal(err)
+	}
+	p := &Portfolio{Contact: c.Id, Name: DEFAULT_PORTFOLIO, Default: true}
+	if err := db.SavePortfolio(p); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SaveTransaction(&Transaction{Contact: c.Id, Portfolio: p.Id, Stock: s.Id, Type: TRANSACTION_BUY, Nb: DecimalFromInt(10), Price: DecimalFromInt(30)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SavePortfolioAlert(&PortfolioAlert{Contact: c.Id, Portfolio: p.Id, Type: PORTFOLIO_ALERT_DRAWDOWN, Percent: DecimalFromInt(10)}); err != nil {
+		t.Fatal(err)
+	}
+	if alerts := db.GetPortfolioAlertsForStock(s); len(*alerts) != 1 {
+		t.Fatalf("Wrong portfolio alerts: %#v", alerts)
+	}
+
+	if err := db.DeleteContact(c); err != nil {
+		t.Fatal(err)
+	}
+
+	if alerts := db.GetAlertsForContact(c); len(*alerts) != 0 {
+		t.Fatalf("Alerts should have been deleted: %#v", alerts)
+	}
+	if transactions := db.GetTransactions(c, nil, nil); len(*transactions) != 0 {
+		t.Fatalf("Transactions should have been deleted: %#v", transactions)
+	}
+	if portfolios := db.GetPortfolios(c); len(*portfolios) != 0 {
+		t.Fatalf("Portfolios should have been deleted: %#v", portfolios)
+	}
+	if alerts := db.GetPortfolioAlertsForContact(c); len(*alerts) != 0 {
+		t.Fatalf("Portfolio alerts should have been deleted: %#v", alerts)
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	db1, done1 := newTestDB(t)
+	defer done1()
+	db2, done2 := newTestDB(t)
+	defer done2()
+
+	s := &Stock{Market: "FR", Short: "RNO", Currency: "EUR"}
+	db1.SaveStock(s)
+	c := db1.GetContactFromEmail("florent@clairambault.fr")
+	alert, err := db1.SubscribeAlert(s, c, DecimalFromInt(2), ALERT_DIRECTION_UP, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db1.SaveStockValue(s, DecimalFromFloat(70.5), 1)
+	p := &Portfolio{Contact: c.Id, Name: "pea"}
+	db1.SavePortfolio(p)
+	db1.SaveTransaction(&Transaction{Contact: c.Id, Portfolio: p.Id, Stock: s.Id, Date: 1, Type: TRANSACTION_BUY, Nb: DecimalFromInt(10), Price: DecimalFromInt(30), Currency: "EUR"})
+
+	b, err := makeBackup(db1.Storage(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buffer := &bytes.Buffer{}
+	if err := writeBackup(buffer, b); err != nil {
+		t.Fatal(err)
+	}
+	if b, err = readBackup(buffer); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := restoreBackup(db2.Storage(), b, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if alerts := db2.GetAlertsForStock(s); len(*alerts) != 1 || (*alerts)[0].Id != alert.Id || (*alerts)[0].Contact != c.Id {
+		t.Fatalf("Wrong alerts: %#v", alerts)
+	}
+	if values := db2.GetStockValues(s, 0, 2); len(*values) != 1 || (*values)[0].Value != DecimalFromFloat(70.5) {
+		t.Fatalf("Wrong values: %#v", values)
+	}
+
+	if transactions := db2.GetTransactions(c, p, s); len(*transactions) != 1 || (*transactions)[0].Price != DecimalFromInt(30) {
+		t.Fatalf("Wrong transactions: %#v", transactions)
+	}
+
+	if err := restoreBackup(db2.Storage(), b, false); err == nil {
+		t.Fatal("We shouldn't restore over existing data without force")
+	}
+	if err := restoreBackup(db2.Storage(), b, true); err != nil {
+		t.Fatal(err)
+	}
+
+	b.Version += 1
+	if err := restoreBackup(db2.Storage(), b, true); err == nil {
+		t.Fatal("We shouldn't restore a backup of a future version")
+	}
+}
+
+func TestFloatColumnsConversion(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+
+	s := &Stock{Market: "FR", Short: "RNO"}
+	if err := db.SaveStock(s); err != nil {
+		t.Fatal(err)
+	}
+	// The holdings table only exists in the databases we upgrade
+	if _, err := db.connection.Exec(`create table ` + TABLE_CONTACT_STOCK_VALUE + ` ("value" real)`); err != nil {
+		t.Fatal(err)
+	}
+	// What a float32 70.9 looked like once stored
+	if _, err := db.connection.Exec(`insert into `+TABLE_VALUE+` (stock_id, date, value) values (?, 1, ?)`, s.Id, float64(float32(70.9))); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.inTransaction(convertFloatColumns); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := db.GetStockValue(s, 0); err != nil || v.Value.String() != "70.9" {
+		t.Fatalf("Wrong value: %v (%v)", v, err)
+	}
+}
+
+// The rebuilt tables keep their orphans, so that fsck can report them
+func TestUpgradeWithoutForeignKeys(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+
+	insert := `insert into ` + TABLE_VALUE + ` (stock_id, date, value) values (12345, 1, 1)`
+	if err := db.atomicUpgrade(&DatabaseUpgrade{Atomic: true, ForeignKeysOff: true, Sql: []string{insert}}); err != nil {
+		t.Fatal(err)
+	}
+	report, err := db.CheckIntegrity(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nb := report.Orphans[OrphanCheck{Table: TABLE_VALUE, Column: "stock_id", Parent: TABLE_STOCK}]; nb != 1 {
+		t.Fatalf("Wrong number of orphans: %d", nb)
+	}
+
+	// The foreign keys are enabled again
+	if _, err := db.connection.Exec(insert); err == nil {
+		t.Fatal("An orphan shouldn't be inserted")
+	}
+}
+
+func TestBackupVersion1(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+
+	b, err := readBackup(strings.NewReader(`{"version": 1, "db_version": 5,
+		"contacts": [{"Id": 1, "Email": "florent@clairambault.fr"}],
+		"stocks": [{"Id": 2, "Market": "FR", "Short": "RNO", "Currency": "EUR"}],
+		"holdings": [{"Id": 3, "Contact": 1, "Stock": 2, "Nb": 10, "Value": 30.5}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restoreBackup(db.Storage(), b, false); err != nil {
+		t.Fatal(err)
+	}
+
+	c := db.GetContactFromId(1)
+	if transactions := db.GetTransactions(c, nil, nil); len(*transactions) != 1 || (*transactions)[0].Nb != DecimalFromInt(10) || (*transactions)[0].Price != DecimalFromFloat(30.5) {
+		t.Fatalf("The holdings should have become transactions: %#v", transactions)
+	}
+	if portfolios := db.GetPortfolios(c); len(*portfolios) != 1 || !(*portfolios)[0].Default || (*portfolios)[0].Id != (*db.GetTransactions(c, nil, nil))[0].Portfolio {
+		t.Fatalf("The transactions should be in the default portfolio: %#v", portfolios)
+	}
+}
+
+func TestStocksFromIsin(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+
+	for _, s := range []*Stock{
+		{Market: "FR", Short: "RNO", Isin: "FR0000131906"},
+		{Market: "US2", Short: "RNL", Isin: "FR0000131906"},
+		{Market: "FR", Short: "PSA"},
+	} {
+		if err := db.SaveStock(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stocks := *db.GetStocksFromIsin("FR0000131906"); len(stocks) != 2 || stocks[1].Short != "RNL" {
+		t.Fatalf("Wrong stocks: %#v", stocks)
+	}
+	if s := db.GetStock("FR", "PSA"); s == nil || s.Isin != "" {
+		t.Fatalf("Wrong stock: %#v", s)
+	}
+}
+
+func TestMarketPreferences(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+
+	c := db.GetContactFromEmail("florent@clairambault.fr")
+	for _, market := range []string{"FR", "US"} {
+		if err := db.SaveMarketPreference(&MarketPreference{Contact: c.Id, Short: "RNO", Market: market}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if p := db.GetMarketPreference(c, "RNO"); p == nil || p.Market != "US" {
+		t.Fatalf("Wrong preference: %#v", p)
+	}
+
+	// They go with the contact
+	if err := db.DeleteContact(c); err != nil {
+		t.Fatal(err)
+	}
+	if p := db.GetMarketPreference(c, "RNO"); p != nil {
+		t.Fatalf("The preference should be deleted: %#v", p)
+	}
+}
+
+func TestWatchlists(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+
+	c := db.GetContactFromEmail("florent@clairambault.fr")
+	s := &Stock{Market: "FR", Short: "RNO"}
+	db.SaveStock(s)
+	w := &Watchlist{Contact: c.Id, Name: "autos"}
+	if err := db.SaveWatchlist(w); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := db.AddWatchlistStock(w, s); err != nil {
+			t.Fatal(err)
+		}
 	}
+	if stocks := *db.GetWatchlistStocks(w); len(stocks) != 1 || stocks[0].Id != s.Id {
+		t.Fatalf("Wrong stocks: %#v", stocks)
+	}
+
+	// Deleted stocks leave the watchlists
+	if err := db.DeleteStock(s); err != nil {
+		t.Fatal(err)
+	}
+	if stocks := *db.GetWatchlistStocks(w); len(stocks) != 0 {
+		t.Fatalf("Wrong stocks: %#v", stocks)
+	}
+	if watchlists := *db.GetWatchlists(c); len(watchlists) != 1 || watchlists[0].Name != "autos" {
+		t.Fatalf("Wrong watchlists: %#v", watchlists)
+	}
+}
+
+func TestCorporateActions(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+
+	checkSplit(t, db.Storage())
 }
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Fixed-point number used for prices, amounts, rates and percentages. Additions, subtractions and comparisons
+// can be done with the usual operators, multiplications and divisions have to be done with Mul and Div.
+// It is stored in the database as an integer (the number of 1/DECIMAL_UNIT).
+type Decimal int64
+
+const DECIMAL_DIGITS = 8
+
+const DECIMAL_UNIT Decimal = 100000000
+
+func DecimalFromInt(i int64) Decimal {
+	return Decimal(i) * DECIMAL_UNIT
+}
+
+// Only meant for constants, use ParseDecimal for user input
+func DecimalFromFloat(f float64) Decimal {
+	return Decimal(math.Floor(f*float64(DECIMAL_UNIT) + 0.5))
+}
+
+// Converts a float32 using the shortest decimal representation that gives it back (70.9 and not 70.90000153)
+func DecimalFromFloat32(f float32) Decimal {
+	d, _ := ParseDecimal(strconv.FormatFloat(float64(f), 'f', -1, 32))
+	return d
+}
+
+func isDigits(s string) bool {
+	return strings.Trim(s, "0123456789") == ""
+}
+
+// Parses "12", "-0.5", "+3.25", etc. Extra decimals are rounded.
+func ParseDecimal(s string) (Decimal, error) {
+	invalid := errors.New(fmt.Sprintf("Invalid number \"%s\"", s))
+
+	s = strings.TrimSpace(s)
+	negative := false
+	if len(s) > 0 && (s[0] == '-' || s[0] == '+') {
+		negative = s[0] == '-'
+		s = s[1:]
+	}
+
+	digits, decimals := s, ""
+	if i := strings.Index(s, "."); i != -1 {
+		digits, decimals = s[:i], s[i+1:]
+	}
+	if digits+decimals == "" || !isDigits(digits) || !isDigits(decimals) {
+		return 0, invalid
+	}
+
+	round := len(decimals) > DECIMAL_DIGITS && decimals[DECIMAL_DIGITS] >= '5'
+	if len(decimals) > DECIMAL_DIGITS {
+		decimals = decimals[:DECIMAL_DIGITS]
+	}
+	decimals += strings.Repeat("0", DECIMAL_DIGITS-len(decimals))
+
+	v, _ := new(big.Int).SetString(digits+decimals, 10)
+	if round {
+		v.Add(v, big.NewInt(1))
+	}
+	if !v.IsInt64() {
+		return 0, invalid
+	}
+
+	d := Decimal(v.Int64())
+	if negative {
+		d = -d
+	}
+	return d, nil
+}
+
+// Divides with rounding half away from zero
+func divRound(a, b *big.Int) *big.Int {
+	q, r := new(big.Int).QuoRem(a, b, new(big.Int))
+	if new(big.Int).Abs(new(big.Int).Mul(r, big.NewInt(2))).Cmp(new(big.Int).Abs(b)) >= 0 {
+		if (a.Sign() < 0) != (b.Sign() < 0) {
+			q.Sub(q, big.NewInt(1))
+		} else {
+			q.Add(q, big.NewInt(1))
+		}
+	}
+	return q
+}
+
+func (d Decimal) Mul(o Decimal) Decimal {
+	p := new(big.Int).Mul(big.NewInt(int64(d)), big.NewInt(int64(o)))
+	return Decimal(divRound(p, big.NewInt(int64(DECIMAL_UNIT))).Int64())
+}
+
+func (d Decimal) MulInt(i int64) Decimal {
+	return d * Decimal(i)
+}
+
+// Dividing by zero gives zero
+func (d Decimal) Div(o Decimal) Decimal {
+	if o == 0 {
+		return 0
+	}
+	n := new(big.Int).Mul(big.NewInt(int64(d)), big.NewInt(int64(DECIMAL_UNIT)))
+	return Decimal(divRound(n, big.NewInt(int64(o))).Int64())
+}
+
+func (d Decimal) Abs() Decimal {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// Rounds to a number of decimals
+func (d Decimal) Round(decimals int) Decimal {
+	if decimals >= DECIMAL_DIGITS {
+		return d
+	}
+	unit := big.NewInt(int64(math.Pow10(DECIMAL_DIGITS - decimals)))
+	q := divRound(big.NewInt(int64(d)), unit)
+	return Decimal(q.Mul(q, unit).Int64())
+}
+
+func (d Decimal) Float() float64 {
+	return float64(d) / float64(DECIMAL_UNIT)
+}
+
+// Shortest representation ("70.9")
+func (d Decimal) String() string {
+	s := d.Fixed(DECIMAL_DIGITS)
+	s = strings.TrimRight(s, "0")
+	return strings.TrimSuffix(s, ".")
+}
+
+// Representation with a fixed number of decimals ("70.900")
+func (d Decimal) Fixed(decimals int) string {
+	if decimals > DECIMAL_DIGITS {
+		decimals = DECIMAL_DIGITS
+	}
+	r := d.Round(decimals)
+	sign := ""
+	if r < 0 {
+		sign = "-"
+		r = -r
+	}
+	s := fmt.Sprintf("%d.%0*d", int64(r/DECIMAL_UNIT), DECIMAL_DIGITS, int64(r%DECIMAL_UNIT))
+	if decimals == 0 {
+		return sign + s[:strings.Index(s, ".")]
+	}
+	return sign + s[:len(s)-DECIMAL_DIGITS+decimals]
+}
+
+// Decimals can be used with "%f" ("%.3f", "%+.2f", etc.), "%s" and "%v"
+func (d Decimal) Format(f fmt.State, verb rune) {
+	var s string
+	switch verb {
+	case 'f', 'F':
+		precision, ok := f.Precision()
+		if !ok {
+			precision = 6
+		}
+		s = d.Fixed(precision)
+	case 'e', 'E', 'g', 'G':
+		s = strconv.FormatFloat(d.Float(), byte(verb), -1, 64)
+	default:
+		s = d.String()
+	}
+	if f.Flag('+') && d >= 0 {
+		s = "+" + s
+	}
+	if width, ok := f.Width(); ok && len(s) < width {
+		if f.Flag('-') {
+			s += strings.Repeat(" ", width-len(s))
+		} else {
+			s = strings.Repeat(" ", width-len(s)) + s
+		}
+	}
+	f.Write([]byte(s))
+}
+
+func (d Decimal) Value() (driver.Value, error) {
+	return int64(d), nil
+}
+
+func (d *Decimal) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*d = 0
+	case int64:
+		*d = Decimal(v)
+	case float64: // Columns created with a "real" type
+		*d = Decimal(math.Floor(v + 0.5))
+	case []byte:
+		return d.Scan(string(v))
+	case string:
+		i, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return err
+		}
+		*d = Decimal(i)
+	default:
+		return errors.New(fmt.Sprintf("Cannot scan %T into a decimal", src))
+	}
+	return nil
+}
+
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Decimal) UnmarshalJSON(data []byte) (err error) {
+	*d, err = ParseDecimal(strings.Trim(string(data), `"`))
+	return
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestDecimalParsing(t *testing.T) {
+	for s, expected := range map[string]string{
+		"12":           "12",
+		"-0.5":         "-0.5",
+		"+3.25":        "3.25",
+		".75":          "0.75",
+		"0.000000015":  "0.00000002",
+		"-0.000000015": "-0.00000002",
+		"1234567.891":  "1234567.891",
+	} {
+		d, err := ParseDecimal(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.String() != expected {
+			t.Fatalf("%s gave %s instead of %s", s, d, expected)
+		}
+	}
+
+	for _, s := range []string{"", "-", ".", "1.2.3", "abc", "1e5", "99999999999999999999"} {
+		if _, err := ParseDecimal(s); err == nil {
+			t.Fatalf("\"%s\" should be invalid", s)
+		}
+	}
+}
+
+func TestDecimalArithmetic(t *testing.T) {
+	price, _ := ParseDecimal("0.0035") // Penny warrant
+	total := price.MulInt(1000000)
+	if total.String() != "3500" {
+		t.Fatalf("Wrong total: %s", total)
+	}
+
+	// 0.1 + 0.2 is really 0.3
+	a, _ := ParseDecimal("0.1")
+	b, _ := ParseDecimal("0.2")
+	if c, _ := ParseDecimal("0.3"); a+b != c {
+		t.Fatalf("0.1 + 0.2 = %s", a+b)
+	}
+
+	third := DecimalFromInt(1).Div(DecimalFromInt(3))
+	if third.String() != "0.33333333" {
+		t.Fatalf("Wrong third: %s", third)
+	}
+	if DecimalFromInt(2).Div(DecimalFromInt(3)).String() != "0.66666667" {
+		t.Fatal("2/3 should be rounded up")
+	}
+	if DecimalFromInt(1).Div(0) != 0 {
+		t.Fatal("Dividing by zero should give zero")
+	}
+
+	if s := fmt.Sprintf("%.3f / %+.2f%% / %v", DecimalFromFloat(70.9), DecimalFromFloat(-5.125), DecimalFromFloat(1.5)); s != "70.900 / -5.13% / 1.5" {
+		t.Fatalf("Wrong format: %s", s)
+	}
+
+	if d := DecimalFromFloat32(float32(71.9)); d.String() != "71.9" {
+		t.Fatalf("Wrong conversion: %s", d)
+	}
+}
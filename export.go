@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	EXPORT_FORMAT_CSV  = "csv"
+	EXPORT_FORMAT_JSON = "json"
+)
+
+const EXPORT_DATE_FORMAT = "2006-01-02T15:04:05Z"
+
+// Exported data can be written as CSV rows or as JSON objects
+type exportRecord interface {
+	csvHeader() []string
+	csvRow() []string
+}
+
+type valueRecord struct {
+	Date     string  `json:"date"`
+	Stock    string  `json:"stock"`
+	Value    Decimal `json:"value"`
+	Currency string  `json:"currency"`
+}
+
+func (r *valueRecord) csvHeader() []string {
+	return []string{"date", "stock", "value", "currency"}
+}
+
+func (r *valueRecord) csvRow() []string {
+	return []string{r.Date, r.Stock, fmt.Sprint(r.Value), r.Currency}
+}
+
+type alertRecord struct {
+	Id            int64   `json:"id"`
+	Stock         string  `json:"stock"`
+	Name          string  `json:"name"`
+	Percent       Decimal `json:"percent"`
+	Direction     string  `json:"direction"`
+	Duration      string  `json:"duration"`
+	LastValue     Decimal `json:"last_value"`
+	LastTriggered string  `json:"last_triggered"`
+}
+
+func (r *alertRecord) csvHeader() []string {
+	return []string{"id", "stock", "name", "percent", "direction", "duration", "last_value", "last_triggered"}
+}
+
+func (r *alertRecord) csvRow() []string {
+	return []string{fmt.Sprint(r.Id), r.Stock, r.Name, fmt.Sprint(r.Percent), r.Direction, r.Duration, fmt.Sprint(r.LastValue), r.LastTriggered}
+}
+
+type holdingRecord struct {
+	Stock    string  `json:"stock"`
+	Name     string  `json:"name"`
+	Nb       Decimal `json:"nb"`
+	Cost     Decimal `json:"cost"`
+	Value    Decimal `json:"value"`
+	Currency string  `json:"currency"`
+}
+
+func (r *holdingRecord) csvHeader() []string {
+	return []string{"stock", "name", "nb", "cost", "value", "currency"}
+}
+
+func (r *holdingRecord) csvRow() []string {
+	return []string{r.Stock, r.Name, fmt.Sprint(r.Nb), fmt.Sprint(r.Cost), fmt.Sprint(r.Value), r.Currency}
+}
+
+func formatExportDate(date int64) string {
+	if date == 0 {
+		return ""
+	}
+	return time.Unix(0, date).UTC().Format(EXPORT_DATE_FORMAT)
+}
+
+// Parses the "from" and "to" dates of the exports, they can be given as "2006-01-02" or with the time
+func parseExportDate(s string) (int64, error) {
+	for _, layout := range []string{"2006-01-02", EXPORT_DATE_FORMAT, "2006-01-02 15:04"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UnixNano(), nil
+		}
+	}
+	return 0, errors.New(fmt.Sprintf("Invalid date \"%s\"", s))
+}
+
+func exportValues(store *Storage, stock *Stock, from, to int64) []exportRecord {
+	records := []exportRecord{}
+	for _, v := range *store.Values.GetStockValues(stock, from, to) {
+		records = append(records, &valueRecord{Date: formatExportDate(v.Date), Stock: stock.Symbol(), Value: v.Value, Currency: stock.Currency})
+	}
+	return records
+}
+
+func exportAlerts(store *Storage, c *Contact) []exportRecord {
+	records := []exportRecord{}
+	for _, a := range *store.Alerts.GetAlertsForContact(c) {
+		s := store.Stocks.GetStockFromId(a.Stock)
+		if s == nil {
+			continue
+		}
+		direction := "~"
+		switch a.PercentDirection {
+		case ALERT_DIRECTION_UP:
+			direction = "+"
+		case ALERT_DIRECTION_DOWN:
+			direction = "-"
+		}
+		duration := ""
+		if a.Duration != 0 {
+			duration = time.Duration(a.Duration).String()
+		}
+		records = append(records, &alertRecord{
+			Id:            a.Id,
+			Stock:         s.Symbol(),
+			Name:          s.Name,
+			Percent:       a.Percent,
+			Direction:     direction,
+			Duration:      duration,
+			LastValue:     a.LastValue,
+			LastTriggered: formatExportDate(a.LastTriggered),
+		})
+	}
+	return records
+}
+
+func exportHoldings(store *Storage, c *Contact) []exportRecord {
+	records := []exportRecord{}
+	for _, p := range getPositions(store, c, nil, nil) {
+		s := store.Stocks.GetStockFromId(p.Stock)
+		if s == nil || p.Nb == 0 {
+			continue
+		}
+		records = append(records, &holdingRecord{Stock: s.Symbol(), Name: s.Name, Nb: p.Nb, Cost: p.Price(), Value: s.Value, Currency: s.Currency})
+	}
+	return records
+}
+
+func writeExport(w io.Writer, format string, records []exportRecord) error {
+	switch format {
+	case EXPORT_FORMAT_CSV:
+		cw := csv.NewWriter(w)
+		if len(records) > 0 {
+			cw.Write(records[0].csvHeader())
+		}
+		for _, r := range records {
+			cw.Write(r.csvRow())
+		}
+		cw.Flush()
+		return cw.Error()
+	case EXPORT_FORMAT_JSON:
+		raw, err := json.MarshalIndent(records, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(raw, '\n'))
+		return err
+	default:
+		return errors.New(fmt.Sprintf("Unknown format \"%s\" (csv or json)", format))
+	}
+}
+
+// Creates a file in the export directory
+func createExportFile(name, ext string) (*os.File, error) {
+	if err := os.MkdirAll(config.Export.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	name = strings.Replace(name, ":", "-", -1)
+	return os.Create(path.Join(config.Export.Dir, fmt.Sprintf("%s_%s.%s", name, time.Now().UTC().Format("20060102-150405"), ext)))
+}
+
+// Writes an export in the export directory and returns the path of the file
+func writeExportFile(name, format string, records []exportRecord) (string, error) {
+	file, err := createExportFile(name, format)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	return file.Name(), writeExport(file, format, records)
+}
+
+// Stocks are only looked up in the database, we don't want to create them for an export
+func findStoredStock(store *Storage, name string) (*Stock, error) {
+	name = strings.ToUpper(name)
+	if from, to, ok := parseCurrencyPair(name); ok {
+		name = MARKET_FX + ":" + from + to
+	}
+	if tokens := strings.SplitN(name, ":", 2); len(tokens) == 2 {
+		if s := store.Stocks.GetStock(tokens[0], tokens[1]); s != nil {
+			return s, nil
+		}
+	} else {
+		if isIsin(name) {
+			if listings := stockListings(store.Stocks, name); len(listings) > 0 {
+				return &listings[0], nil
+			}
+		}
+		for _, market := range marketsToTest() {
+			if s := store.Stocks.GetStock(market, name); s != nil {
+				return s, nil
+			}
+		}
+	}
+	return nil, errors.New(fmt.Sprintf("Unknown stock \"%s\"", name))
+}
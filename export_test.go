@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestExportValues(t *testing.T) {
+	store := NewMemDB().Storage()
+
+	s := &Stock{Market: "FR", Short: "RNO", Currency: "EUR"}
+	store.Stocks.SaveStock(s)
+
+	start := time.Date(2014, 6, 2, 9, 0, 0, 0, time.UTC)
+	for i, v := range []Decimal{DecimalFromFloat(70.5), DecimalFromInt(71), DecimalFromFloat(69.25)} {
+		store.Values.SaveStockValue(s, v, start.Add(time.Duration(i)*time.Hour).UnixNano())
+	}
+
+	buffer := &bytes.Buffer{}
+	if err := writeExport(buffer, EXPORT_FORMAT_CSV, exportValues(store, s, start.UnixNano(), start.Add(2*time.Hour).UnixNano())); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "date,stock,value,currency\n" +
+		"2014-06-02T09:00:00Z,FR:RNO,70.5,EUR\n" +
+		"2014-06-02T10:00:00Z,FR:RNO,71,EUR\n"
+	if buffer.String() != expected {
+		t.Fatalf("Wrong export:\n%s", buffer.String())
+	}
+
+	if err := writeExport(buffer, "xls", nil); err == nil {
+		t.Fatal("xls shouldn't be supported")
+	}
+}
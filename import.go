@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// A price read from a CSV file
+type importedPrice struct {
+	Date     int64
+	Value    Decimal
+	Currency string
+}
+
+type importResult struct {
+	Read       int
+	Imported   int
+	Duplicates int
+}
+
+func (r *importResult) String() string {
+	return fmt.Sprintf("%d prices read, %d imported, %d duplicates ignored", r.Read, r.Imported, r.Duplicates)
+}
+
+// Columns that can contain the price, in order of preference
+var importValueColumns = []string{"value", "price", "close", "last"}
+
+// Parses a price, "1 234,5" is accepted as well
+func parsePrice(s string) (Decimal, error) {
+	s = strings.Replace(strings.TrimSpace(s), " ", "", -1)
+	if !strings.Contains(s, ".") {
+		s = strings.Replace(s, ",", ".", 1)
+	}
+	return ParseDecimal(s)
+}
+
+// Parses a date, the second result tells if the time was specified
+func parseImportDate(s string) (int64, bool, error) {
+	s = strings.TrimSpace(s)
+	for _, layout := range []string{EXPORT_DATE_FORMAT, time.RFC3339, "2006-01-02 15:04:05", "2006-01-02 15:04"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UnixNano(), true, nil
+		}
+	}
+	for _, layout := range []string{"2006-01-02", "02/01/2006"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UnixNano(), false, nil
+		}
+	}
+	return 0, false, errors.New(fmt.Sprintf("Invalid date \"%s\"", s))
+}
+
+// Reads prices from a CSV file with a header. It can either contain timestamped prices ("date,value") like the
+// ones we export, or daily OHLC data ("date,open,high,low,close"). For daily data, the close price is stored at
+// the end of the day.
+func readPricesCsv(r io.Reader) ([]importedPrice, error) {
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := csv.NewReader(strings.NewReader(string(raw)))
+	if header := strings.SplitN(string(raw), "\n", 2)[0]; strings.Contains(header, ";") && !strings.Contains(header, ",") {
+		reader.Comma = ';'
+	}
+	reader.FieldsPerRecord = -1
+
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, errors.New("Empty file")
+	}
+
+	columns := make(map[string]int)
+	for i, name := range rows[0] {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+
+	dateColumn, ok := columns["date"]
+	if !ok {
+		return nil, errors.New("No \"date\" column")
+	}
+	valueColumn, valueName := -1, ""
+	for _, name := range importValueColumns {
+		if i, ok := columns[name]; ok {
+			valueColumn, valueName = i, name
+			break
+		}
+	}
+	if valueColumn == -1 {
+		return nil, errors.New(fmt.Sprintf("No price column (%s)", strings.Join(importValueColumns, ", ")))
+	}
+	currencyColumn, hasCurrency := columns["currency"]
+
+	prices := []importedPrice{}
+	for line, row := range rows[1:] {
+		if len(row) <= dateColumn || len(row) <= valueColumn {
+			return nil, errors.New(fmt.Sprintf("Line %d: missing columns", line+2))
+		}
+		date, hasTime, err := parseImportDate(row[dateColumn])
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Line %d: %s", line+2, err))
+		}
+		if !hasTime && valueName == "close" {
+			date += int64(time.Hour*24 - time.Second)
+		}
+		value, err := parsePrice(row[valueColumn])
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Line %d: %s", line+2, err))
+		}
+		if value <= 0 {
+			return nil, errors.New(fmt.Sprintf("Line %d: invalid price %v", line+2, value))
+		}
+		price := importedPrice{Date: date, Value: value}
+		if hasCurrency && len(row) > currencyColumn {
+			price.Currency = strings.ToUpper(strings.TrimSpace(row[currencyColumn]))
+		}
+		prices = append(prices, price)
+	}
+
+	return prices, nil
+}
+
+// Adds prices to the values of a stock. Prices whose date is already known are ignored and the currency of the
+// prices (or the one specified) has to be the one of the stock.
+func importValues(store *Storage, stock *Stock, prices []importedPrice, currency string) (*importResult, error) {
+	result := &importResult{Read: len(prices)}
+	if len(prices) == 0 {
+		return result, nil
+	}
+
+	currency = strings.ToUpper(currency)
+	from, to := prices[0].Date, prices[0].Date
+	for _, p := range prices {
+		c := p.Currency
+		if c == "" {
+			c = currency
+		}
+		if c != "" && stock.Currency != "" && c != stock.Currency {
+			return nil, errors.New(fmt.Sprintf("Price of %s is in %s but %s is in %s", time.Unix(0, p.Date).UTC(), c, stock, stock.Currency))
+		}
+		if p.Date < from {
+			from = p.Date
+		}
+		if p.Date > to {
+			to = p.Date
+		}
+	}
+
+	known := make(map[int64]bool)
+	for _, v := range *store.Values.GetStockValues(stock, from, to+1) {
+		known[v.Date] = true
+	}
+
+	values := []Value{}
+	for _, p := range prices {
+		if known[p.Date] {
+			result.Duplicates += 1
+			continue
+		}
+		known[p.Date] = true
+		values = append(values, Value{Stock: stock.Id, Date: p.Date, Value: p.Value})
+	}
+
+	if err := store.Values.AddStockValues(values); err != nil {
+		return nil, err
+	}
+	result.Imported = len(values)
+
+	return result, nil
+}
+
+func importValuesFile(store *Storage, stock *Stock, fileName, currency string) (*importResult, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	prices, err := readPricesCsv(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return importValues(store, stock, prices, currency)
+}
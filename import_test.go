@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestImportValues(t *testing.T) {
+	store := NewMemDB().Storage()
+
+	s := &Stock{Market: "FR", Short: "RNO", Currency: "EUR"}
+	store.Stocks.SaveStock(s)
+
+	ohlc := "Date;Open;High;Low;Close;Volume\n" +
+		"02/06/2014;70,10;71,20;69,80;70,50;1000\n" +
+		"03/06/2014;70,50;72;70,40;71,90;1200\n"
+
+	prices, err := readPricesCsv(strings.NewReader(ohlc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prices) != 2 || prices[1].Value.String() != "71.9" {
+		t.Fatalf("Wrong prices: %#v", prices)
+	}
+	if date := time.Unix(0, prices[0].Date).UTC(); date != time.Date(2014, 6, 2, 23, 59, 59, 0, time.UTC) {
+		t.Fatalf("Wrong date: %v", date)
+	}
+
+	if result, err := importValues(store, s, prices, ""); err != nil {
+		t.Fatal(err)
+	} else if result.Imported != 2 {
+		t.Fatalf("Wrong result: %s", result)
+	}
+
+	// The second import should only add the new price
+	prices = append(prices, importedPrice{Date: prices[1].Date + int64(time.Hour*24), Value: DecimalFromInt(72)})
+	if result, err := importValues(store, s, prices, "EUR"); err != nil {
+		t.Fatal(err)
+	} else if result.Imported != 1 || result.Duplicates != 2 {
+		t.Fatalf("Wrong result: %s", result)
+	}
+
+	if _, err := importValues(store, s, prices, "USD"); err == nil {
+		t.Fatal("Prices in USD should have been refused")
+	}
+
+	if s := store.Stocks.GetStockFromId(s.Id); s.Value != 0 {
+		t.Fatalf("The current value shouldn't have changed: %f", s.Value)
+	}
+}
@@ -2,15 +2,12 @@ package main
 
 import (
 	"bufio"
+	"flag"
 	"fmt"
 	"os"
 	"strings"
 )
 
-var xm *FtsXmpp
-var db *FtsDB
-var stocks *StocksMgmt
-
 var waitForRc chan int
 
 const FTS_VERSION = "0.4"
@@ -19,7 +16,7 @@ func init() {
 	waitForRc = make(chan int)
 }
 
-func console_handling() {
+func console_handling(store *Storage) {
 	in := bufio.NewReader(os.Stdin)
 	for {
 		fmt.Printf("> ")
@@ -35,6 +32,10 @@ func console_handling() {
 			continue
 		} else if tokens[0] == "quit" {
 			waitForRc <- 0
+		} else if _, ok := cliCommands[tokens[0]]; ok {
+			if err := runCliCommand(&cliContext{store: store, out: os.Stdout, console: true}, strings.Fields(line)); err != nil {
+				fmt.Println("Error:", err)
+			}
 		} else {
 			fmt.Printf("\"%s\" not understood !\n", tokens[0])
 		}
@@ -43,22 +44,26 @@ func console_handling() {
 
 func core() (rc int) {
 	// We open the database
-	db = NewFtsDB()
+	db := NewFtsDB(config.Db.File)
 	defer db.Close()
 
+	store := db.Storage()
+
+	xm := NewFtsXmpp(store)
+	stocks := NewStocksMgmt(store, xm.Send)
+	xm.stocks = stocks
+
 	// We start the XMPP handling code
-	xm = NewFtsXmpp()
 	xm.Start()
 	defer xm.Stop()
 
 	// We load the stocks
-	stocks = NewStocksMgmt()
 	stocks.Start()
 	defer stocks.Stop()
 
 	if Console {
 		// We block on the console handling code
-		go console_handling()
+		go console_handling(store)
 	}
 
 	// We wait for someone to trigger the result code
@@ -72,6 +77,12 @@ func core() (rc int) {
 }
 
 func main() {
+	loadConfig()
+
+	// Commands are run without starting the bot
+	if flag.NArg() > 0 {
+		os.Exit(cli(flag.Args()))
+	}
 
 	log.Info("Starting !")
 
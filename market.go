@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A market on which stocks are listed, the default ones can be replaced and others added in the config
+type Market struct {
+	Label    string
+	Timezone string // Name in the tz database ("Europe/Paris")
+	Open     string // Trading hours in the time of the market ("09:00"), we follow the stocks all day without them
+	Close    string
+	Currency string // Currency of its stocks when their page doesn't give it
+	Symbol   string // Symbol of the stocks on boursorama, "%s" is the ticker ("1rP%s")
+	Probe    int    // Order in which the markets are tested for a ticker without market, 0 to never test it
+
+	code     string
+	location *time.Location
+}
+
+var defaultMarkets = map[string]Market{
+	"FR":  {Label: "Euronext Paris", Timezone: "Europe/Paris", Open: "09:00", Close: "17:30", Currency: "EUR", Symbol: "1rP%s", Probe: 1},
+	"AM":  {Label: "Euronext Amsterdam", Timezone: "Europe/Amsterdam", Open: "09:00", Close: "17:30", Currency: "EUR", Symbol: "1rA%s", Probe: 2},
+	"US":  {Label: "NASDAQ & NYSE", Timezone: "America/New_York", Open: "09:30", Close: "16:00", Currency: "USD", Symbol: "%s", Probe: 3},
+	"US2": {Label: "Xetra", Timezone: "Europe/Berlin", Open: "09:00", Close: "17:30", Currency: "EUR", Symbol: "1z%s", Probe: 4},
+	"W":   {Label: "Warrants", Timezone: "Europe/Paris", Open: "08:00", Close: "22:00", Currency: "EUR", Symbol: "2rP%s", Probe: 5},
+	"W2":  {Label: "Warrants (2)", Timezone: "Europe/Paris", Open: "08:00", Close: "22:00", Currency: "EUR", Symbol: "3rP%s"},
+	"BE":  {Label: "Euronext Bruxelles", Timezone: "Europe/Brussels", Open: "09:00", Close: "17:30", Currency: "EUR", Symbol: "FF11-%s", Probe: 6},
+}
+
+var markets map[string]*Market
+
+func init() {
+	markets, _ = newMarkets(nil)
+}
+
+// Builds the registry from the default markets and the ones of the config. A market of the config that isn't valid
+// is ignored, the error tells about the first one.
+func newMarkets(configured map[string]*Market) (map[string]*Market, error) {
+	registry := make(map[string]*Market)
+	for code, m := range defaultMarkets {
+		market := m
+		market.code = code
+		market.location, _ = time.LoadLocation(market.Timezone)
+		registry[code] = &market
+	}
+
+	var err error
+	for code, m := range configured {
+		market := *m
+		market.code = strings.ToUpper(code)
+		if e := market.check(); e != nil {
+			if err == nil {
+				err = errors.New(fmt.Sprintf("Market %s: %s", market.code, e))
+			}
+			continue
+		}
+		registry[market.code] = &market
+	}
+	return registry, err
+}
+
+func (m *Market) check() (err error) {
+	if m.code == "" || m.code == MARKET_FX || strings.Contains(m.code, ":") {
+		return errors.New("Invalid code")
+	}
+	if strings.Count(m.Symbol, "%s") != 1 {
+		return errors.New(fmt.Sprintf("The symbol \"%s\" must contain the ticker (%%s) once", m.Symbol))
+	}
+	if m.location, err = time.LoadLocation(m.Timezone); err != nil {
+		return err
+	}
+	if (m.Open == "") != (m.Close == "") {
+		return errors.New("The trading hours need an opening and a closing time")
+	}
+	for _, hour := range []string{m.Open, m.Close} {
+		if _, err := parseMarketHour(hour); hour != "" && err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Minutes since midnight of a trading hour ("17:30")
+func parseMarketHour(hour string) (int, error) {
+	t, err := time.Parse("15:04", hour)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("Invalid hour \"%s\"", hour))
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func getMarket(code string) (*Market, error) {
+	if m, ok := markets[strings.ToUpper(code)]; ok {
+		return m, nil
+	}
+	return nil, errors.New(fmt.Sprintf("Unknown market \"%s\" (%s)", code, strings.Join(marketCodes(), ", ")))
+}
+
+// Codes of all the markets, in alphabetical order
+func marketCodes() []string {
+	codes := []string{}
+	for code := range markets {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// Markets in which we look for a ticker without market, in their probe order
+func marketsToTest() []string {
+	probed := []*Market{}
+	for _, m := range markets {
+		if m.Probe > 0 {
+			probed = append(probed, m)
+		}
+	}
+	sort.Slice(probed, func(i, j int) bool {
+		if probed[i].Probe != probed[j].Probe {
+			return probed[i].Probe < probed[j].Probe
+		}
+		return probed[i].code < probed[j].code
+	})
+	codes := []string{}
+	for _, m := range probed {
+		codes = append(codes, m.code)
+	}
+	return codes
+}
+
+// Symbol of a ticker on boursorama
+func (m *Market) symbol(short string) string {
+	return strings.Replace(m.Symbol, "%s", short, 1)
+}
+
+// Market and ticker of a boursorama symbol ("1rPRNO" is "FR:RNO"), the longest prefix wins
+func parseBoursoramaSymbol(symbol string) (market, short string) {
+	prefix := -1
+	for _, m := range markets {
+		template := strings.SplitN(m.Symbol, "%s", 2)
+		if strings.HasPrefix(symbol, template[0]) && strings.HasSuffix(symbol[len(template[0]):], template[1]) &&
+			(len(template[0]) > prefix || len(template[0]) == prefix && m.code < market) {
+			prefix = len(template[0])
+			market, short = m.code, strings.TrimSuffix(symbol[len(template[0]):], template[1])
+		}
+	}
+	if prefix < 0 {
+		return "", symbol
+	}
+	return
+}
+
+// Tells if the market is open, on weekdays during its trading hours
+func (m *Market) isOpen(t time.Time) bool {
+	if m.Open == "" || m.location == nil {
+		return true
+	}
+	t = t.In(m.location)
+	if t.Weekday() == time.Saturday || t.Weekday() == time.Sunday {
+		return false
+	}
+	open, _ := parseMarketHour(m.Open)
+	close, _ := parseMarketHour(m.Close)
+	minutes := t.Hour()*60 + t.Minute()
+	return minutes >= open && minutes < close
+}
+
+func (m *Market) String() string {
+	str := fmt.Sprintf("%s - %s (%s", m.code, m.Label, m.Currency)
+	if m.Open != "" {
+		str += fmt.Sprintf(", %s-%s %s", m.Open, m.Close, m.Timezone)
+	}
+	return str + ")"
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMarkets(t *testing.T) {
+	defer func(registry map[string]*Market) { markets = registry }(markets)
+
+	var err error
+	markets, err = newMarkets(map[string]*Market{
+		"mi": {Label: "Borsa Italiana", Timezone: "Europe/Rome", Open: "09:00", Close: "17:30", Currency: "EUR", Symbol: "1g%s", Probe: 2},
+		"XX": {Label: "Broken", Symbol: "XX"},
+	})
+	if err == nil {
+		t.Fatal("The symbol of XX has no ticker")
+	}
+	if _, err := getMarket("xx"); err == nil {
+		t.Fatal("XX shouldn't be loaded")
+	}
+	if codes := marketsToTest(); len(codes) != 7 || codes[1] != "AM" || codes[2] != "MI" {
+		t.Fatalf("Wrong probe order: %v", codes)
+	}
+
+	for symbol, expected := range map[string]string{"1rPRNO": "FR:RNO", "1gENI": "MI:ENI", "FF11-SOLB": "BE:SOLB", "AAPL": "US:AAPL"} {
+		if market, short := parseBoursoramaSymbol(symbol); market+":"+short != expected {
+			t.Fatalf("%s is %s:%s instead of %s", symbol, market, short, expected)
+		}
+	}
+
+	// Unknown markets are an error of the user
+	if _, err := tryNewStock("XX", "FOO"); err == nil {
+		t.Fatal("XX is unknown")
+	}
+	if url := (&Stock{Market: "MI", Short: "ENI"}).Url(); url != "http://www.boursorama.com/cours.phtml?symbole=1gENI" {
+		t.Fatalf("Wrong URL: %s", url)
+	}
+
+	m, _ := getMarket("FR")
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Skip("No timezone data")
+	}
+	for date, open := range map[string]bool{"2024-05-10 10:00": true, "2024-05-10 17:30": false, "2024-05-11 10:00": false} {
+		d, _ := time.ParseInLocation("2006-01-02 15:04", date, paris)
+		if m.isOpen(d.UTC()) != open {
+			t.Fatalf("%s: open should be %v", date, open)
+		}
+	}
+}
@@ -0,0 +1,1045 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// In-memory storage backend. It behaves like FtsDB but nothing is persisted.
+type MemDB struct {
+	sync.Mutex
+	lastId          int64
+	parameters      map[string]string
+	stocks          map[int64]Stock
+	contacts        map[int64]Contact
+	values          map[int64]Value
+	alerts          map[int64]Alert
+	positionAlerts  map[int64]PositionAlert
+	transactions    map[int64]Transaction
+	portfolios      map[int64]Portfolio
+	portfolioAlerts map[int64]PortfolioAlert
+	triggers        map[int64]AlertTrigger
+	conversions     map[string]CurrencyConversion
+	dailyRates      map[string]DailyRate
+	preferences     map[string]MarketPreference
+	watchlists      map[int64]Watchlist
+	watchlistStocks map[string]WatchlistStock
+	actions         map[int64]CorporateAction
+}
+
+func NewMemDB() *MemDB {
+	return &MemDB{
+		parameters:      make(map[string]string),
+		stocks:          make(map[int64]Stock),
+		contacts:        make(map[int64]Contact),
+		values:          make(map[int64]Value),
+		alerts:          make(map[int64]Alert),
+		positionAlerts:  make(map[int64]PositionAlert),
+		transactions:    make(map[int64]Transaction),
+		portfolios:      make(map[int64]Portfolio),
+		portfolioAlerts: make(map[int64]PortfolioAlert),
+		triggers:        make(map[int64]AlertTrigger),
+		conversions:     make(map[string]CurrencyConversion),
+		dailyRates:      make(map[string]DailyRate),
+		preferences:     make(map[string]MarketPreference),
+		watchlists:      make(map[int64]Watchlist),
+		watchlistStocks: make(map[string]WatchlistStock),
+		actions:         make(map[int64]CorporateAction),
+	}
+}
+
+func (db *MemDB) nextId() int64 {
+	db.lastId += 1
+	return db.lastId
+}
+
+func (db *MemDB) GetStock(market, short string) *Stock {
+	db.Lock()
+	defer db.Unlock()
+	for _, s := range db.stocks {
+		if s.Market == market && s.Short == short {
+			return &s
+		}
+	}
+	return nil
+}
+
+func (db *MemDB) GetStocksFromIsin(isin string) *[]Stock {
+	db.Lock()
+	defer db.Unlock()
+	stocks := []Stock{}
+	for _, s := range db.stocks {
+		if s.Isin == isin {
+			stocks = append(stocks, s)
+		}
+	}
+	sort.Slice(stocks, func(i, j int) bool { return stocks[i].Id < stocks[j].Id })
+	return &stocks
+}
+
+func (db *MemDB) GetStockFromId(id int64) *Stock {
+	db.Lock()
+	defer db.Unlock()
+	if s, ok := db.stocks[id]; ok {
+		return &s
+	}
+	return nil
+}
+
+func (db *MemDB) GetAllStocks() *[]Stock {
+	db.Lock()
+	defer db.Unlock()
+	stocks := []Stock{}
+	for _, s := range db.stocks {
+		stocks = append(stocks, s)
+	}
+	sort.Slice(stocks, func(i, j int) bool { return stocks[i].Id < stocks[j].Id })
+	return &stocks
+}
+
+func (db *MemDB) SaveStock(s *Stock) error {
+	db.Lock()
+	defer db.Unlock()
+	if s.Id == 0 {
+		s.Id = db.nextId()
+	}
+	db.stocks[s.Id] = *s
+	return nil
+}
+
+func (db *MemDB) DeleteStock(s *Stock) error {
+	db.Lock()
+	defer db.Unlock()
+	for id, a := range db.alerts {
+		if a.Stock == s.Id {
+			delete(db.alerts, id)
+		}
+	}
+	for id, a := range db.positionAlerts {
+		if a.Stock == s.Id {
+			delete(db.positionAlerts, id)
+		}
+	}
+	for id, v := range db.values {
+		if v.Stock == s.Id {
+			delete(db.values, id)
+		}
+	}
+	for id, t := range db.transactions {
+		if t.Stock == s.Id {
+			delete(db.transactions, id)
+		}
+	}
+	for id, t := range db.triggers {
+		if t.Stock == s.Id {
+			delete(db.triggers, id)
+		}
+	}
+	for key, ws := range db.watchlistStocks {
+		if ws.Stock == s.Id {
+			delete(db.watchlistStocks, key)
+		}
+	}
+	for id, a := range db.actions {
+		if a.Stock == s.Id {
+			delete(db.actions, id)
+		}
+	}
+	delete(db.stocks, s.Id)
+	return nil
+}
+
+func (db *MemDB) GetContactFromEmail(email string) *Contact {
+	email = strings.SplitN(email, "/", 2)[0]
+
+	db.Lock()
+	defer db.Unlock()
+	for _, c := range db.contacts {
+		if c.Email == email {
+			return &c
+		}
+	}
+	c := Contact{Id: db.nextId(), Email: email}
+	db.contacts[c.Id] = c
+	return &c
+}
+
+func (db *MemDB) GetContactFromId(id int64) *Contact {
+	db.Lock()
+	defer db.Unlock()
+	if c, ok := db.contacts[id]; ok {
+		return &c
+	}
+	return nil
+}
+
+func (db *MemDB) SaveContact(c *Contact) error {
+	db.Lock()
+	defer db.Unlock()
+	if _, ok := db.contacts[c.Id]; !ok {
+		return errors.New("Contact doesn't exist !")
+	}
+	db.contacts[c.Id] = *c
+	return nil
+}
+
+func (db *MemDB) DeleteContact(c *Contact) error {
+	db.Lock()
+	defer db.Unlock()
+	for id, a := range db.alerts {
+		if a.Contact == c.Id {
+			delete(db.alerts, id)
+		}
+	}
+	for id, a := range db.positionAlerts {
+		if a.Contact == c.Id {
+			delete(db.positionAlerts, id)
+		}
+	}
+	for id, t := range db.transactions {
+		if t.Contact == c.Id {
+			delete(db.transactions, id)
+		}
+	}
+	for id, a := range db.portfolioAlerts {
+		if a.Contact == c.Id {
+			delete(db.portfolioAlerts, id)
+		}
+	}
+	for id, p := range db.portfolios {
+		if p.Contact == c.Id {
+			delete(db.portfolios, id)
+		}
+	}
+	for id, t := range db.triggers {
+		if t.Contact == c.Id {
+			delete(db.triggers, id)
+		}
+	}
+	for key, p := range db.preferences {
+		if p.Contact == c.Id {
+			delete(db.preferences, key)
+		}
+	}
+	for id, w := range db.watchlists {
+		if w.Contact == c.Id {
+			db.deleteWatchlist(id)
+		}
+	}
+	delete(db.contacts, c.Id)
+	return nil
+}
+
+func (db *MemDB) selectAlerts(filter func(a *Alert) bool) *[]Alert {
+	db.Lock()
+	defer db.Unlock()
+	alerts := []Alert{}
+	for _, a := range db.alerts {
+		if filter(&a) {
+			alerts = append(alerts, a)
+		}
+	}
+	sort.Slice(alerts, func(i, j int) bool { return alerts[i].Id < alerts[j].Id })
+	return &alerts
+}
+
+func (db *MemDB) GetAlertsForStock(s *Stock) *[]Alert {
+	return db.selectAlerts(func(a *Alert) bool { return a.Stock == s.Id })
+}
+
+func (db *MemDB) GetAlertsForContact(c *Contact) *[]Alert {
+	return db.selectAlerts(func(a *Alert) bool { return a.Contact == c.Id })
+}
+
+func (db *MemDB) SubscribeAlert(s *Stock, c *Contact, per Decimal, direction int, duration int64) (alert *Alert, err error) {
+	if _, err = db.UnsubscribeAlert(s, c); err != nil {
+		return nil, err
+	}
+
+	alert = &Alert{Stock: s.Id, Contact: c.Id, Percent: per, PercentDirection: direction, Duration: duration}
+
+	err = db.SaveAlert(alert)
+
+	return
+}
+
+func (db *MemDB) UnsubscribeAlert(s *Stock, c *Contact) (bool, error) {
+	db.Lock()
+	defer db.Unlock()
+	for id, a := range db.alerts {
+		if a.Stock == s.Id && a.Contact == c.Id {
+			delete(db.alerts, id)
+		}
+	}
+	return false, nil
+}
+
+func (db *MemDB) SaveAlert(a *Alert) error {
+	db.Lock()
+	defer db.Unlock()
+	if a.Id == 0 {
+		a.Id = db.nextId()
+	}
+	db.alerts[a.Id] = *a
+	return nil
+}
+
+func (db *MemDB) DeleteAlert(a *Alert) error {
+	db.Lock()
+	defer db.Unlock()
+	delete(db.alerts, a.Id)
+	return nil
+}
+
+func (db *MemDB) selectPositionAlerts(filter func(a *PositionAlert) bool) *[]PositionAlert {
+	db.Lock()
+	defer db.Unlock()
+	alerts := []PositionAlert{}
+	for _, a := range db.positionAlerts {
+		if filter(&a) {
+			alerts = append(alerts, a)
+		}
+	}
+	sort.Slice(alerts, func(i, j int) bool { return alerts[i].Id < alerts[j].Id })
+	return &alerts
+}
+
+func (db *MemDB) GetPositionAlertsForStock(s *Stock) *[]PositionAlert {
+	return db.selectPositionAlerts(func(a *PositionAlert) bool { return a.Stock == s.Id })
+}
+
+func (db *MemDB) GetPositionAlertsForContact(c *Contact) *[]PositionAlert {
+	return db.selectPositionAlerts(func(a *PositionAlert) bool { return a.Contact == c.Id })
+}
+
+func (db *MemDB) SavePositionAlert(a *PositionAlert) error {
+	db.Lock()
+	defer db.Unlock()
+	if a.Id == 0 {
+		a.Id = db.nextId()
+	}
+	db.positionAlerts[a.Id] = *a
+	return nil
+}
+
+func (db *MemDB) DeletePositionAlert(a *PositionAlert) error {
+	db.Lock()
+	defer db.Unlock()
+	delete(db.positionAlerts, a.Id)
+	return nil
+}
+
+func (db *MemDB) SaveAlertTrigger(t *AlertTrigger) error {
+	db.Lock()
+	defer db.Unlock()
+	if t.Id == 0 {
+		t.Id = db.nextId()
+	}
+	db.triggers[t.Id] = *t
+	return nil
+}
+
+func (db *MemDB) SetAlertTriggerStatus(id int64, status string) error {
+	db.Lock()
+	defer db.Unlock()
+	if t, ok := db.triggers[id]; ok {
+		t.Status = status
+		db.triggers[id] = t
+	}
+	return nil
+}
+
+func (db *MemDB) GetAlertTriggers(c *Contact, s *Stock, since int64) *[]AlertTrigger {
+	db.Lock()
+	defer db.Unlock()
+	triggers := []AlertTrigger{}
+	for _, t := range db.triggers {
+		if t.Contact == c.Id && (s == nil || t.Stock == s.Id) && t.Date >= since {
+			triggers = append(triggers, t)
+		}
+	}
+	sort.Slice(triggers, func(i, j int) bool { return triggers[i].Date < triggers[j].Date })
+	return &triggers
+}
+
+func (db *MemDB) SaveStockValue(stock *Stock, value Decimal, date int64) (err error) {
+	if stock.Value != value {
+		stock.Value = value
+		if err = db.SaveStock(stock); err != nil {
+			return
+		}
+	}
+
+	db.Lock()
+	defer db.Unlock()
+	v := Value{Id: db.nextId(), Stock: stock.Id, Date: date, Value: value}
+	db.values[v.Id] = v
+	return nil
+}
+
+func (db *MemDB) GetStockValue(stock *Stock, date int64) (*Value, error) {
+	db.Lock()
+	defer db.Unlock()
+	var value *Value
+	for _, v := range db.values {
+		if v.Stock == stock.Id && v.Date > date && (value == nil || v.Date > value.Date) {
+			found := v
+			value = &found
+		}
+	}
+	if value == nil {
+		return nil, sql.ErrNoRows
+	}
+	return value, nil
+}
+
+func (db *MemDB) GetStockValueAt(stock *Stock, date int64) (*Value, error) {
+	db.Lock()
+	defer db.Unlock()
+	var value *Value
+	for _, v := range db.values {
+		if v.Stock == stock.Id && v.Date <= date && (value == nil || v.Date > value.Date) {
+			found := v
+			value = &found
+		}
+	}
+	if value == nil {
+		return nil, sql.ErrNoRows
+	}
+	return value, nil
+}
+
+func (db *MemDB) AddStockValues(values []Value) error {
+	db.Lock()
+	defer db.Unlock()
+	for i := range values {
+		values[i].Id = db.nextId()
+		db.values[values[i].Id] = values[i]
+	}
+	return nil
+}
+
+func (db *MemDB) GetStockValues(stock *Stock, from, to int64) *[]Value {
+	db.Lock()
+	defer db.Unlock()
+	values := []Value{}
+	for _, v := range db.values {
+		if v.Stock == stock.Id && v.Date >= from && v.Date < to {
+			values = append(values, v)
+		}
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i].Date < values[j].Date })
+	return &values
+}
+
+func (db *MemDB) GetTransaction(id int64) *Transaction {
+	db.Lock()
+	defer db.Unlock()
+	if t, ok := db.transactions[id]; ok {
+		return &t
+	}
+	return nil
+}
+
+func (db *MemDB) GetTransactions(c *Contact, p *Portfolio, s *Stock) *[]Transaction {
+	db.Lock()
+	defer db.Unlock()
+	transactions := []Transaction{}
+	for _, t := range db.transactions {
+		if t.Contact == c.Id && (p == nil || t.Portfolio == p.Id) && (s == nil || t.Stock == s.Id) {
+			transactions = append(transactions, t)
+		}
+	}
+	sort.Slice(transactions, func(i, j int) bool {
+		if transactions[i].Date != transactions[j].Date {
+			return transactions[i].Date < transactions[j].Date
+		}
+		return transactions[i].Id < transactions[j].Id
+	})
+	return &transactions
+}
+
+func (db *MemDB) SaveTransaction(t *Transaction) error {
+	db.Lock()
+	defer db.Unlock()
+	if t.Id == 0 {
+		t.Id = db.nextId()
+	}
+	db.transactions[t.Id] = *t
+	return nil
+}
+
+func (db *MemDB) DeleteTransaction(t *Transaction) error {
+	db.Lock()
+	defer db.Unlock()
+	delete(db.transactions, t.Id)
+	return nil
+}
+
+func (db *MemDB) GetPortfolios(c *Contact) *[]Portfolio {
+	db.Lock()
+	defer db.Unlock()
+	portfolios := []Portfolio{}
+	for _, p := range db.portfolios {
+		if p.Contact == c.Id {
+			portfolios = append(portfolios, p)
+		}
+	}
+	sort.Slice(portfolios, func(i, j int) bool { return portfolios[i].Id < portfolios[j].Id })
+	return &portfolios
+}
+
+func (db *MemDB) SavePortfolio(p *Portfolio) error {
+	db.Lock()
+	defer db.Unlock()
+	if p.Id == 0 {
+		p.Id = db.nextId()
+	}
+	db.portfolios[p.Id] = *p
+	return nil
+}
+
+func (db *MemDB) DeletePortfolio(p *Portfolio) error {
+	db.Lock()
+	defer db.Unlock()
+	for id, t := range db.transactions {
+		if t.Portfolio == p.Id {
+			delete(db.transactions, id)
+		}
+	}
+	for id, a := range db.portfolioAlerts {
+		if a.Portfolio == p.Id {
+			delete(db.portfolioAlerts, id)
+		}
+	}
+	delete(db.portfolios, p.Id)
+	return nil
+}
+
+func (db *MemDB) selectPortfolioAlerts(filter func(a *PortfolioAlert) bool) *[]PortfolioAlert {
+	db.Lock()
+	defer db.Unlock()
+	alerts := []PortfolioAlert{}
+	for _, a := range db.portfolioAlerts {
+		if filter(&a) {
+			alerts = append(alerts, a)
+		}
+	}
+	sort.Slice(alerts, func(i, j int) bool { return alerts[i].Id < alerts[j].Id })
+	return &alerts
+}
+
+func (db *MemDB) GetPortfolioAlertsForContact(c *Contact) *[]PortfolioAlert {
+	return db.selectPortfolioAlerts(func(a *PortfolioAlert) bool { return a.Contact == c.Id })
+}
+
+// Called with the lock held
+func (db *MemDB) portfolioHasStock(portfolio, stock int64) bool {
+	for _, t := range db.transactions {
+		if t.Portfolio == portfolio && t.Stock == stock {
+			return true
+		}
+	}
+	return false
+}
+
+func (db *MemDB) GetPortfolioAlertsForStock(s *Stock) *[]PortfolioAlert {
+	return db.selectPortfolioAlerts(func(a *PortfolioAlert) bool { return db.portfolioHasStock(a.Portfolio, s.Id) })
+}
+
+func (db *MemDB) SavePortfolioAlert(a *PortfolioAlert) error {
+	db.Lock()
+	defer db.Unlock()
+	if a.Id == 0 {
+		a.Id = db.nextId()
+	}
+	db.portfolioAlerts[a.Id] = *a
+	return nil
+}
+
+func (db *MemDB) DeletePortfolioAlert(a *PortfolioAlert) error {
+	db.Lock()
+	defer db.Unlock()
+	delete(db.portfolioAlerts, a.Id)
+	return nil
+}
+
+func (db *MemDB) GetParameter(name string) *string {
+	db.Lock()
+	defer db.Unlock()
+	if value, ok := db.parameters[name]; ok {
+		return &value
+	}
+	return nil
+}
+
+func (db *MemDB) SetParameter(name, value string) error {
+	db.Lock()
+	defer db.Unlock()
+	db.parameters[name] = value
+	return nil
+}
+
+func (db *MemDB) GetCurrencyConversion(from, to string) *CurrencyConversion {
+	db.Lock()
+	defer db.Unlock()
+	if c, ok := db.conversions[from+"/"+to]; ok {
+		return &c
+	}
+	return nil
+}
+
+func (db *MemDB) SaveCurrencyConversion(c *CurrencyConversion) error {
+	db.Lock()
+	defer db.Unlock()
+	db.conversions[c.From+"/"+c.To] = *c
+	return nil
+}
+
+func (db *MemDB) DeleteCurrencyConversion(c *CurrencyConversion) error {
+	db.Lock()
+	defer db.Unlock()
+	delete(db.conversions, c.From+"/"+c.To)
+	return nil
+}
+
+func (db *MemDB) GetWatchlists(c *Contact) *[]Watchlist {
+	db.Lock()
+	defer db.Unlock()
+	watchlists := []Watchlist{}
+	for _, w := range db.watchlists {
+		if w.Contact == c.Id {
+			watchlists = append(watchlists, w)
+		}
+	}
+	sort.Slice(watchlists, func(i, j int) bool { return watchlists[i].Name < watchlists[j].Name })
+	return &watchlists
+}
+
+func (db *MemDB) SaveWatchlist(w *Watchlist) error {
+	db.Lock()
+	defer db.Unlock()
+	if w.Id == 0 {
+		w.Id = db.nextId()
+	}
+	db.watchlists[w.Id] = *w
+	return nil
+}
+
+func (db *MemDB) deleteWatchlist(id int64) {
+	for key, ws := range db.watchlistStocks {
+		if ws.Watchlist == id {
+			delete(db.watchlistStocks, key)
+		}
+	}
+	delete(db.watchlists, id)
+}
+
+func (db *MemDB) DeleteWatchlist(w *Watchlist) error {
+	db.Lock()
+	defer db.Unlock()
+	db.deleteWatchlist(w.Id)
+	return nil
+}
+
+func watchlistStockKey(watchlist, stock int64) string {
+	return fmt.Sprintf("%d/%d", watchlist, stock)
+}
+
+func (db *MemDB) GetWatchlistStocks(w *Watchlist) *[]Stock {
+	db.Lock()
+	defer db.Unlock()
+	stocks := []Stock{}
+	for _, ws := range db.watchlistStocks {
+		if s, ok := db.stocks[ws.Stock]; ok && ws.Watchlist == w.Id {
+			stocks = append(stocks, s)
+		}
+	}
+	sort.Slice(stocks, func(i, j int) bool {
+		if stocks[i].Market != stocks[j].Market {
+			return stocks[i].Market < stocks[j].Market
+		}
+		return stocks[i].Short < stocks[j].Short
+	})
+	return &stocks
+}
+
+func (db *MemDB) AddWatchlistStock(w *Watchlist, s *Stock) error {
+	db.Lock()
+	defer db.Unlock()
+	db.watchlistStocks[watchlistStockKey(w.Id, s.Id)] = WatchlistStock{Watchlist: w.Id, Stock: s.Id}
+	return nil
+}
+
+func (db *MemDB) RemoveWatchlistStock(w *Watchlist, s *Stock) error {
+	db.Lock()
+	defer db.Unlock()
+	delete(db.watchlistStocks, watchlistStockKey(w.Id, s.Id))
+	return nil
+}
+
+func (db *MemDB) GetCorporateActions(s *Stock) *[]CorporateAction {
+	db.Lock()
+	defer db.Unlock()
+	actions := []CorporateAction{}
+	for _, a := range db.actions {
+		if a.Stock == s.Id {
+			actions = append(actions, a)
+		}
+	}
+	sort.Slice(actions, func(i, j int) bool { return actions[i].Date < actions[j].Date })
+	return &actions
+}
+
+func (db *MemDB) ApplyCorporateAction(a *CorporateAction) error {
+	db.Lock()
+	defer db.Unlock()
+	for _, other := range db.actions {
+		if other.Stock == a.Stock && other.Date == a.Date {
+			return errors.New("The stock already has a corporate action on this date")
+		}
+	}
+	a.Id = db.nextId()
+	db.actions[a.Id] = *a
+
+	var last int64
+	for id, v := range db.values {
+		if v.Stock != a.Stock {
+			continue
+		}
+		if v.Date > last {
+			last = v.Date
+		}
+		if v.Date < a.Date {
+			v.Value = a.price(v.Value)
+			db.values[id] = v
+		}
+	}
+	if s, ok := db.stocks[a.Stock]; ok && last < a.Date {
+		s.Value = a.price(s.Value)
+		db.stocks[a.Stock] = s
+	}
+	for id, al := range db.alerts {
+		if al.Stock == a.Stock && a.adjustsAlert(&al) {
+			db.alerts[id] = al
+		}
+	}
+	for id, t := range db.transactions {
+		if t.Stock == a.Stock && t.Date < a.Date {
+			a.adjustTransaction(&t)
+			db.transactions[id] = t
+		}
+	}
+	return nil
+}
+
+func preferenceKey(contact int64, short string) string {
+	return fmt.Sprintf("%d/%s", contact, short)
+}
+
+func (db *MemDB) GetMarketPreference(c *Contact, short string) *MarketPreference {
+	db.Lock()
+	defer db.Unlock()
+	if p, ok := db.preferences[preferenceKey(c.Id, short)]; ok {
+		return &p
+	}
+	return nil
+}
+
+func (db *MemDB) SaveMarketPreference(p *MarketPreference) error {
+	db.Lock()
+	defer db.Unlock()
+	db.preferences[preferenceKey(p.Contact, p.Short)] = *p
+	return nil
+}
+
+func dailyRateKey(from, to string, date int64) string {
+	return fmt.Sprintf("%s/%s/%d", from, to, date)
+}
+
+func (db *MemDB) GetDailyRate(from, to string, date int64) *DailyRate {
+	db.Lock()
+	defer db.Unlock()
+	if r, ok := db.dailyRates[dailyRateKey(from, to, date)]; ok {
+		return &r
+	}
+	return nil
+}
+
+func (db *MemDB) SaveDailyRate(r *DailyRate) error {
+	db.Lock()
+	defer db.Unlock()
+	db.dailyRates[dailyRateKey(r.From, r.To, r.Date)] = *r
+	return nil
+}
+
+func (db *MemDB) CheckIntegrity(repair bool) (*IntegrityReport, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	report := NewIntegrityReport(repair)
+	for _, check := range orphanChecks {
+		// Tells if the row referencing this contact, stock and portfolio is an orphan
+		orphan := func(contact, stock, portfolio int64) bool {
+			var ok bool
+			switch check.Parent {
+			case TABLE_CONTACT:
+				_, ok = db.contacts[contact]
+			case TABLE_PORTFOLIO:
+				_, ok = db.portfolios[portfolio]
+			default:
+				_, ok = db.stocks[stock]
+			}
+			return !ok
+		}
+		switch check.Table {
+		case TABLE_ALERT:
+			for id, a := range db.alerts {
+				if orphan(a.Contact, a.Stock, 0) {
+					report.Orphans[check] += 1
+					if repair {
+						delete(db.alerts, id)
+					}
+				}
+			}
+		case TABLE_POSITION_ALERT:
+			for id, a := range db.positionAlerts {
+				if orphan(a.Contact, a.Stock, 0) {
+					report.Orphans[check] += 1
+					if repair {
+						delete(db.positionAlerts, id)
+					}
+				}
+			}
+		case TABLE_PORTFOLIO:
+			for id, p := range db.portfolios {
+				if orphan(p.Contact, 0, 0) {
+					report.Orphans[check] += 1
+					if repair {
+						delete(db.portfolios, id)
+					}
+				}
+			}
+		case TABLE_PORTFOLIO_ALERT:
+			for id, a := range db.portfolioAlerts {
+				if orphan(a.Contact, 0, a.Portfolio) {
+					report.Orphans[check] += 1
+					if repair {
+						delete(db.portfolioAlerts, id)
+					}
+				}
+			}
+		case TABLE_TRANSACTION:
+			for id, t := range db.transactions {
+				if orphan(t.Contact, t.Stock, t.Portfolio) {
+					report.Orphans[check] += 1
+					if repair {
+						delete(db.transactions, id)
+					}
+				}
+			}
+		case TABLE_ALERT_TRIGGER:
+			for id, t := range db.triggers {
+				if orphan(t.Contact, t.Stock, 0) {
+					report.Orphans[check] += 1
+					if repair {
+						delete(db.triggers, id)
+					}
+				}
+			}
+		case TABLE_VALUE:
+			for id, v := range db.values {
+				if orphan(0, v.Stock, 0) {
+					report.Orphans[check] += 1
+					if repair {
+						delete(db.values, id)
+					}
+				}
+			}
+		case TABLE_WATCHLIST:
+			for id, w := range db.watchlists {
+				if orphan(w.Contact, 0, 0) {
+					report.Orphans[check] += 1
+					if repair {
+						db.deleteWatchlist(id)
+					}
+				}
+			}
+		case TABLE_WATCHLIST_STOCK:
+			for key, ws := range db.watchlistStocks {
+				_, ok := db.watchlists[ws.Watchlist]
+				if check.Parent == TABLE_STOCK {
+					ok = !orphan(0, ws.Stock, 0)
+				}
+				if !ok {
+					report.Orphans[check] += 1
+					if repair {
+						delete(db.watchlistStocks, key)
+					}
+				}
+			}
+		case TABLE_CORPORATE_ACTION:
+			for id, a := range db.actions {
+				if orphan(0, a.Stock, 0) {
+					report.Orphans[check] += 1
+					if repair {
+						delete(db.actions, id)
+					}
+				}
+			}
+		case TABLE_MARKET_PREFERENCE:
+			for key, p := range db.preferences {
+				if orphan(p.Contact, 0, 0) {
+					report.Orphans[check] += 1
+					if repair {
+						delete(db.preferences, key)
+					}
+				}
+			}
+		}
+	}
+
+	return report, nil
+}
+
+func (db *MemDB) Dump(withValues bool) (*Backup, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	b := &Backup{}
+	for name, value := range db.parameters {
+		b.Parameters = append(b.Parameters, Parameter{Name: name, Value: value})
+	}
+	for _, c := range db.contacts {
+		b.Contacts = append(b.Contacts, c)
+	}
+	for _, s := range db.stocks {
+		b.Stocks = append(b.Stocks, s)
+	}
+	for _, c := range db.conversions {
+		b.Conversions = append(b.Conversions, c)
+	}
+	for _, a := range db.alerts {
+		b.Alerts = append(b.Alerts, a)
+	}
+	for _, a := range db.positionAlerts {
+		b.PositionAlerts = append(b.PositionAlerts, a)
+	}
+	for _, p := range db.portfolios {
+		b.Portfolios = append(b.Portfolios, p)
+	}
+	for _, a := range db.portfolioAlerts {
+		b.PortfolioAlerts = append(b.PortfolioAlerts, a)
+	}
+	for _, t := range db.transactions {
+		b.Transactions = append(b.Transactions, t)
+	}
+	for _, t := range db.triggers {
+		b.Triggers = append(b.Triggers, t)
+	}
+	for _, p := range db.preferences {
+		b.MarketPreferences = append(b.MarketPreferences, p)
+	}
+	for _, w := range db.watchlists {
+		b.Watchlists = append(b.Watchlists, w)
+	}
+	for _, ws := range db.watchlistStocks {
+		b.WatchlistStocks = append(b.WatchlistStocks, ws)
+	}
+	for _, a := range db.actions {
+		b.CorporateActions = append(b.CorporateActions, a)
+	}
+	if withValues {
+		for _, v := range db.values {
+			b.Values = append(b.Values, v)
+		}
+		for _, r := range db.dailyRates {
+			b.DailyRates = append(b.DailyRates, r)
+		}
+	}
+	return b, nil
+}
+
+func (db *MemDB) IsEmpty() bool {
+	db.Lock()
+	defer db.Unlock()
+	return len(db.contacts) == 0 && len(db.stocks) == 0
+}
+
+func (db *MemDB) Restore(b *Backup) error {
+	db.Lock()
+	defer db.Unlock()
+
+	restored := NewMemDB()
+	if version, ok := db.parameters[PARAMETER_DB_VERSION]; ok {
+		restored.parameters[PARAMETER_DB_VERSION] = version
+	}
+
+	for _, row := range b.rows() {
+		var id int64
+		switch r := row.(type) {
+		case *Parameter:
+			restored.parameters[r.Name] = r.Value
+		case *Contact:
+			id, restored.contacts[r.Id] = r.Id, *r
+		case *Stock:
+			id, restored.stocks[r.Id] = r.Id, *r
+		case *CurrencyConversion:
+			restored.conversions[r.From+"/"+r.To] = *r
+		case *Alert:
+			id, restored.alerts[r.Id] = r.Id, *r
+		case *PositionAlert:
+			id, restored.positionAlerts[r.Id] = r.Id, *r
+		case *Portfolio:
+			id, restored.portfolios[r.Id] = r.Id, *r
+		case *PortfolioAlert:
+			id, restored.portfolioAlerts[r.Id] = r.Id, *r
+		case *Transaction:
+			id, restored.transactions[r.Id] = r.Id, *r
+		case *AlertTrigger:
+			id, restored.triggers[r.Id] = r.Id, *r
+		case *Value:
+			id, restored.values[r.Id] = r.Id, *r
+		case *DailyRate:
+			restored.dailyRates[dailyRateKey(r.From, r.To, r.Date)] = *r
+		case *MarketPreference:
+			restored.preferences[preferenceKey(r.Contact, r.Short)] = *r
+		case *Watchlist:
+			id, restored.watchlists[r.Id] = r.Id, *r
+		case *WatchlistStock:
+			restored.watchlistStocks[watchlistStockKey(r.Watchlist, r.Stock)] = *r
+		case *CorporateAction:
+			id, restored.actions[r.Id] = r.Id, *r
+		}
+		if id > restored.lastId {
+			restored.lastId = id
+		}
+	}
+
+	db.lastId = restored.lastId
+	db.parameters = restored.parameters
+	db.contacts = restored.contacts
+	db.stocks = restored.stocks
+	db.conversions = restored.conversions
+	db.alerts = restored.alerts
+	db.positionAlerts = restored.positionAlerts
+	db.portfolios = restored.portfolios
+	db.portfolioAlerts = restored.portfolioAlerts
+	db.transactions = restored.transactions
+	db.triggers = restored.triggers
+	db.values = restored.values
+	db.dailyRates = restored.dailyRates
+	db.preferences = restored.preferences
+	db.watchlists = restored.watchlists
+	db.watchlistStocks = restored.watchlistStocks
+	db.actions = restored.actions
+	return nil
+}
+
+func (db *MemDB) Storage() *Storage {
+	return NewStorage(db)
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// Performance of the shares of a contact over a period, in the currency of the contact
+type Performance struct {
+	Period     string
+	Currency   string
+	Missing    []string // Currencies we couldn't convert, their stocks are ignored
+	From       int64
+	To         int64
+	StartValue Decimal
+	EndValue   Decimal
+	Invested   Decimal // Purchases minus sales made during the period, fees and taxes included
+	Fees       Decimal // Fees paid during the period
+	Taxes      Decimal // Taxes paid during the period
+	Realized   Decimal // Gains of the sales made during the period
+	Unrealized Decimal // Value minus cost of the shares held at the end
+	TWR        Decimal // Time-weighted return, in percent
+	MWR        Decimal // Money-weighted return (internal rate of return over the period), in percent
+}
+
+var perfPeriods = []string{"1d", "1w", "1m", "ytd", "all"}
+
+// Start of a period, 0 for "all"
+func perfPeriodStart(period string, now time.Time) (int64, error) {
+	now = now.UTC()
+	switch period {
+	case "1d":
+		return now.AddDate(0, 0, -1).UnixNano(), nil
+	case "1w":
+		return now.AddDate(0, 0, -7).UnixNano(), nil
+	case "1m":
+		return now.AddDate(0, -1, 0).UnixNano(), nil
+	case "ytd":
+		return time.Date(now.Year(), 1, 1, 0, 0, 0, 0, time.UTC).UnixNano(), nil
+	case "all":
+		return 0, nil
+	}
+	return 0, errors.New(fmt.Sprintf("Unknown period \"%s\" (%s)", period, strings.Join(perfPeriods, ", ")))
+}
+
+// Values shares with the prices known at a date
+type portfolioValuer struct {
+	store      *Storage
+	converter  *currencyConverter
+	now        int64
+	stocks     map[int64]*Stock
+	lastPrices map[int64]Decimal // Price of the last transaction of each stock, used when we don't have any value
+}
+
+func (v *portfolioValuer) stock(stockId int64) *Stock {
+	s, ok := v.stocks[stockId]
+	if !ok {
+		s = v.store.Stocks.GetStockFromId(stockId)
+		v.stocks[stockId] = s
+	}
+	return s
+}
+
+// Converts an amount in the currency of a stock at the rate of a date
+func (v *portfolioValuer) convert(amount Decimal, stockId, date int64) Decimal {
+	if s := v.stock(stockId); s != nil {
+		amount, _ = v.converter.convertAt(amount, s.Currency, date)
+	}
+	return amount
+}
+
+// Price of a stock in its currency
+func (v *portfolioValuer) price(stockId, date int64) Decimal {
+	s := v.stock(stockId)
+	if s == nil {
+		return 0
+	}
+	if date >= v.now && s.Value != 0 {
+		return s.Value
+	}
+	if value, err := v.store.Values.GetStockValueAt(s, date); err == nil {
+		return value.Value
+	}
+	return v.lastPrices[stockId]
+}
+
+// Value of the shares in the reference currency
+func (v *portfolioValuer) value(holdings map[int64]Decimal, date int64) Decimal {
+	total := Decimal(0)
+	for stock, nb := range holdings {
+		total += v.convert(v.price(stock, date).Mul(nb), stock, date)
+	}
+	return total
+}
+
+type cashFlow struct {
+	date   int64
+	amount float64
+}
+
+// Rate r such as start * (1+r) + sum(amount * (1+r)^w) = end, where w is the part of the period that remains
+// after each flow. It is found by bisection, we return 0 if there's none.
+func moneyWeightedReturn(start, end float64, flows []cashFlow, from, to int64) float64 {
+	f := func(r float64) float64 {
+		sum := start*(1+r) - end
+		for _, flow := range flows {
+			w := 1.0
+			if to > from {
+				w = float64(to-flow.date) / float64(to-from)
+			}
+			sum += flow.amount * math.Pow(1+r, w)
+		}
+		return sum
+	}
+
+	low, high := -0.9999, 100.0
+	if f(low)*f(high) > 0 {
+		return 0
+	}
+	for i := 0; i < 100; i++ {
+		middle := (low + high) / 2
+		if f(low)*f(middle) <= 0 {
+			high = middle
+		} else {
+			low = middle
+		}
+	}
+	return (low + high) / 2
+}
+
+// Computes the performance of the shares of a contact from the transactions and the values history. For "all",
+// the period starts with the first dated transaction.
+func computePerformance(store *Storage, c *Contact, period string, now time.Time) (*Performance, error) {
+	from, err := perfPeriodStart(period, now)
+	if err != nil {
+		return nil, err
+	}
+	to := now.UnixNano()
+
+	transactions := *store.Transactions.GetTransactions(c, nil, nil)
+	if from == 0 {
+		from = to
+		for _, t := range transactions {
+			if t.Date != 0 && t.Date < from {
+				from = t.Date
+			}
+		}
+	}
+
+	p := &Performance{Period: period, Currency: c.referenceCurrency(), From: from, To: to}
+	v := &portfolioValuer{
+		store:      store,
+		converter:  newCurrencyConverter(store.Currencies, p.Currency),
+		now:        to,
+		stocks:     make(map[int64]*Stock),
+		lastPrices: make(map[int64]Decimal),
+	}
+	holdings := make(map[int64]Decimal)
+	byKey := make(map[positionKey][]Transaction)
+
+	// Applies a transaction and returns the money it brought in the shares (in the reference currency)
+	apply := func(t Transaction) Decimal {
+		nb := t.Nb
+		if t.Type == TRANSACTION_SELL && nb > holdings[t.Stock] {
+			nb = holdings[t.Stock]
+		}
+		amount := t.Price.Mul(nb)
+		if t.Type == TRANSACTION_SELL {
+			amount, nb = -amount, -nb
+		}
+		holdings[t.Stock] += nb
+		v.lastPrices[t.Stock] = t.Price
+		key := positionKey{portfolio: t.Portfolio, stock: t.Stock}
+		byKey[key] = append(byKey[key], t)
+		return v.convert(amount+t.Fees+t.Taxes, t.Stock, t.Date)
+	}
+	// Each sale is converted at the rate of its date
+	realized := func() Decimal {
+		total := Decimal(0)
+		for key, transactions := range byKey {
+			for _, d := range computePosition(transactions, c.costMethod()).Disposals {
+				total += v.convert(d.Gain(), key.stock, d.Date)
+			}
+		}
+		return total
+	}
+
+	i := 0
+	for ; i < len(transactions) && transactions[i].Date < from; i++ {
+		apply(transactions[i])
+	}
+	realizedBefore := realized()
+	p.StartValue = v.value(holdings, from)
+
+	// The time-weighted return chains the returns between the flows
+	twr := 1.0
+	previous := p.StartValue // Value right after the previous flow
+	flows := []cashFlow{}
+	for ; i < len(transactions) && transactions[i].Date <= to; i++ {
+		t := transactions[i]
+		amount := apply(t)
+		after := v.value(holdings, t.Date)
+		if previous > 0 {
+			twr *= (after - amount).Float() / previous.Float()
+		}
+		previous = after
+		p.Invested += amount
+		p.Fees += v.convert(t.Fees, t.Stock, t.Date)
+		p.Taxes += v.convert(t.Taxes, t.Stock, t.Date)
+		flows = append(flows, cashFlow{date: t.Date, amount: amount.Float()})
+	}
+	p.EndValue = v.value(holdings, to)
+	if previous > 0 {
+		twr *= p.EndValue.Float() / previous.Float()
+	}
+
+	p.TWR = DecimalFromFloat((twr - 1) * 100).Round(4)
+	p.MWR = DecimalFromFloat(moneyWeightedReturn(p.StartValue.Float(), p.EndValue.Float(), flows, from, to) * 100).Round(4)
+
+	p.Realized = realized() - realizedBefore
+	for key, transactions := range byKey {
+		position := computePosition(transactions, c.costMethod())
+		p.Unrealized += v.convert(v.price(key.stock, to).Mul(position.Nb)-position.Cost, key.stock, to)
+	}
+	p.Missing = v.converter.missing()
+
+	return p, nil
+}
+
+func (p *Performance) String() string {
+	str := fmt.Sprintf("Performance (%s, since %s) in %s:\nValue: %.03f -> %.03f, invested: %+.03f, fees: %.02f, taxes: %.02f\nGains: realized %+.03f, unrealized %+.03f\nReturns: time-weighted %+.02f%%, money-weighted %+.02f%%",
+		p.Period, time.Unix(0, p.From).UTC().Format("2006-01-02 15:04"), p.Currency,
+		p.StartValue, p.EndValue, p.Invested, p.Fees, p.Taxes,
+		p.Realized, p.Unrealized,
+		p.TWR, p.MWR)
+	if len(p.Missing) > 0 {
+		str += fmt.Sprintf("\nThe stocks in %s are ignored, we don't know their rate", strings.Join(p.Missing, ", "))
+	}
+	return str
+}
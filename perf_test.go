@@ -0,0 +1,95 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestPerfPeriods(t *testing.T) {
+	now := time.Date(2024, 3, 15, 12, 0, 0, 0, time.UTC)
+	if from, _ := perfPeriodStart("ytd", now); from != time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano() {
+		t.Fatalf("Wrong start: %s", time.Unix(0, from).UTC())
+	}
+	if from, _ := perfPeriodStart("1m", now); from != time.Date(2024, 2, 15, 12, 0, 0, 0, time.UTC).UnixNano() {
+		t.Fatalf("Wrong start: %s", time.Unix(0, from).UTC())
+	}
+	if _, err := perfPeriodStart("2y", now); err == nil {
+		t.Fatal("2y shouldn't be accepted")
+	}
+}
+
+func TestMoneyWeightedReturn(t *testing.T) {
+	// 1000 at the start, 1000 more in the middle of the period, 2200 at the end
+	r := moneyWeightedReturn(1000, 2200, []cashFlow{{date: 50, amount: 1000}}, 0, 100)
+	if math.Abs(1000*(1+r)+1000*math.Sqrt(1+r)-2200) > 1e-6 {
+		t.Fatalf("Wrong return: %f", r)
+	}
+}
+
+func TestPerformance(t *testing.T) {
+	store := NewMemDB().Storage()
+	day := int64(24 * time.Hour)
+	start := time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC).UnixNano()
+	now := time.Unix(0, start+10*day)
+
+	s := &Stock{Market: "FR", Short: "RNO", Currency: "EUR", Value: DecimalFromInt(60)}
+	store.Stocks.SaveStock(s)
+	c := store.Contacts.GetContactFromEmail("florent@clairambault.fr")
+	store.Values.AddStockValues([]Value{
+		{Stock: s.Id, Date: start, Value: DecimalFromInt(40)},
+		{Stock: s.Id, Date: start + 5*day, Value: DecimalFromInt(50)},
+	})
+
+	store.Transactions.SaveTransaction(&Transaction{Contact: c.Id, Stock: s.Id, Date: start, Type: TRANSACTION_BUY, Nb: DecimalFromInt(10), Price: DecimalFromInt(40)})
+	store.Transactions.SaveTransaction(&Transaction{Contact: c.Id, Stock: s.Id, Date: start + 5*day, Type: TRANSACTION_SELL, Nb: DecimalFromInt(5), Price: DecimalFromInt(50), Fees: DecimalFromInt(1)})
+
+	p, err := computePerformance(store, c, "all", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 400 invested, 249 taken out, 300 left
+	if p.StartValue != 0 || p.EndValue != DecimalFromInt(300) || p.Invested != DecimalFromInt(151) || p.Fees != DecimalFromInt(1) {
+		t.Fatalf("Wrong values: %s", p)
+	}
+	// The gain of the sale is net of its fees
+	if p.Realized != DecimalFromInt(49) || p.Unrealized != DecimalFromInt(100) {
+		t.Fatalf("Wrong gains: %s", p)
+	}
+	// 40 -> 50 (minus the fees of the sale) -> 60
+	if twr := (500.0 - 1) / 400 * 300 / 250; p.TWR != DecimalFromFloat((twr-1)*100).Round(4) {
+		t.Fatalf("Wrong time-weighted return: %s", p)
+	}
+
+	// Over the last week, we start with 10 shares at 40
+	if p, err = computePerformance(store, c, "1w", now); err != nil {
+		t.Fatal(err)
+	}
+	if p.StartValue != DecimalFromInt(400) || p.Realized != DecimalFromInt(49) {
+		t.Fatalf("Wrong performance: %s", p)
+	}
+}
+
+func TestPerformanceCurrencies(t *testing.T) {
+	store := NewMemDB().Storage()
+	now := time.Now()
+	store.Currencies.SaveCurrencyConversion(&CurrencyConversion{From: "USD", To: "EUR", Rate: DecimalFromFloat(0.5), LastUpdate: now.UTC().UnixNano()})
+
+	rno := &Stock{Market: "FR", Short: "RNO", Currency: "EUR", Value: DecimalFromInt(50)}
+	store.Stocks.SaveStock(rno)
+	aapl := &Stock{Market: "US", Short: "AAPL", Currency: "USD", Value: DecimalFromInt(200)}
+	store.Stocks.SaveStock(aapl)
+	c := store.Contacts.GetContactFromEmail("florent@clairambault.fr")
+
+	date := now.Add(-time.Hour).UnixNano()
+	store.Transactions.SaveTransaction(&Transaction{Contact: c.Id, Stock: rno.Id, Date: date, Type: TRANSACTION_BUY, Nb: DecimalFromInt(2), Price: DecimalFromInt(50)})
+	store.Transactions.SaveTransaction(&Transaction{Contact: c.Id, Stock: aapl.Id, Date: date, Type: TRANSACTION_BUY, Nb: DecimalFromInt(1), Price: DecimalFromInt(100)})
+
+	p, err := computePerformance(store, c, "all", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Currency != "EUR" || p.EndValue != DecimalFromInt(200) || p.Invested != DecimalFromInt(150) || p.Unrealized != DecimalFromInt(50) {
+		t.Fatalf("Wrong performance: %s", p)
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// How the cost of the shares that are still held is computed
+const (
+	COST_METHOD_AVERAGE = "avg"  // Every sale is made at the average purchase price
+	COST_METHOD_FIFO    = "fifo" // The first shares bought are the first ones sold
+)
+
+// What a contact holds of a stock, computed from the transactions
+type Position struct {
+	Stock     int64
+	Nb        Decimal
+	Cost      Decimal // What the shares still held cost, fees and taxes of their purchase included
+	Realized  Decimal // Gain made on the shares that were sold, net of all the fees and taxes
+	Fees      Decimal // Fees of all the transactions
+	Taxes     Decimal // Taxes of all the transactions
+	Disposals []Disposal
+}
+
+// Shares sold by a transaction, in the currency of the stock
+type Disposal struct {
+	Transaction int64
+	Date        int64
+	Nb          Decimal
+	Cost        Decimal // What the shares sold cost, fees and taxes of their purchase included
+	Proceeds    Decimal // Price of the sale, before its fees and taxes
+	Fees        Decimal
+	Taxes       Decimal
+}
+
+// Gain of a sale, net of all the fees and taxes
+func (d *Disposal) Gain() Decimal {
+	return d.Proceeds - d.Fees - d.Taxes - d.Cost
+}
+
+// Shares bought together
+type lot struct {
+	nb   Decimal
+	cost Decimal // Fees and taxes included
+}
+
+// Average purchase price of the shares still held, fees and taxes included
+func (p *Position) Price() Decimal {
+	return p.Cost.Div(p.Nb)
+}
+
+func (c *Contact) costMethod() string {
+	if c.CostMethod == COST_METHOD_FIFO {
+		return COST_METHOD_FIFO
+	}
+	return COST_METHOD_AVERAGE
+}
+
+// Computes the position from the transactions of one stock, ordered by date. We can't sell more than we have, so
+// the extra shares of a sale are ignored.
+func computePosition(transactions []Transaction, method string) *Position {
+	p := &Position{}
+	lots := []lot{}
+	for _, t := range transactions {
+		p.Stock = t.Stock
+		p.Fees += t.Fees
+		p.Taxes += t.Taxes
+		switch t.Type {
+		case TRANSACTION_BUY:
+			cost := t.Price.Mul(t.Nb) + t.Fees + t.Taxes
+			p.Nb += t.Nb
+			p.Cost += cost
+			lots = append(lots, lot{nb: t.Nb, cost: cost})
+		case TRANSACTION_SELL:
+			nb := t.Nb
+			if nb > p.Nb {
+				nb = p.Nb
+			}
+			if nb == 0 {
+				continue
+			}
+
+			var cost Decimal
+			if method == COST_METHOD_FIFO {
+				for remaining := nb; remaining > 0 && len(lots) > 0; {
+					sold, soldCost := lots[0].nb, lots[0].cost
+					if sold > remaining {
+						sold = remaining
+						soldCost = lots[0].cost.Mul(sold).Div(lots[0].nb)
+					}
+					cost += soldCost
+					remaining -= sold
+					lots[0].nb -= sold
+					lots[0].cost -= soldCost
+					if lots[0].nb == 0 {
+						lots = lots[1:]
+					}
+				}
+			} else {
+				cost = p.Cost.Mul(nb).Div(p.Nb)
+			}
+
+			d := Disposal{Transaction: t.Id, Date: t.Date, Nb: nb, Cost: cost, Proceeds: t.Price.Mul(nb), Fees: t.Fees, Taxes: t.Taxes}
+			p.Nb -= nb
+			p.Cost -= cost
+			p.Realized += d.Gain()
+			p.Disposals = append(p.Disposals, d)
+		}
+	}
+	return p
+}
+
+// Transactions of a stock in a portfolio
+type positionKey struct {
+	portfolio int64
+	stock     int64
+}
+
+func (p *Position) add(o *Position) {
+	p.Nb += o.Nb
+	p.Cost += o.Cost
+	p.Realized += o.Realized
+	p.Fees += o.Fees
+	p.Taxes += o.Taxes
+	p.Disposals = append(p.Disposals, o.Disposals...)
+}
+
+// Computes the positions of each stock from transactions ordered by date. Each portfolio has its own positions,
+// they are added when there are several portfolios. The positions are in the order of their first transaction.
+func computePositions(transactions []Transaction, method string) []*Position {
+	byKey := make(map[positionKey][]Transaction)
+	order := []positionKey{}
+	for _, t := range transactions {
+		key := positionKey{portfolio: t.Portfolio, stock: t.Stock}
+		if _, ok := byKey[key]; !ok {
+			order = append(order, key)
+		}
+		byKey[key] = append(byKey[key], t)
+	}
+
+	positions := []*Position{}
+	byStock := make(map[int64]*Position)
+	for _, key := range order {
+		p := computePosition(byKey[key], method)
+		if total, ok := byStock[key.stock]; ok {
+			total.add(p)
+		} else {
+			byStock[key.stock] = p
+			positions = append(positions, p)
+		}
+	}
+	return positions
+}
+
+// Position of a contact on a stock, in a portfolio or in all of them if p is nil
+func getPosition(store *Storage, c *Contact, p *Portfolio, s *Stock) *Position {
+	if positions := getPositions(store, c, p, s); len(positions) > 0 {
+		return positions[0]
+	}
+	return &Position{Stock: s.Id}
+}
+
+// Positions of a contact in a portfolio (or in all of them if p is nil), on a stock (or all of them if s is nil).
+// Positions whose shares were all sold are returned as well.
+func getPositions(store *Storage, c *Contact, p *Portfolio, s *Stock) []*Position {
+	return computePositions(*store.Transactions.GetTransactions(c, p, s), c.costMethod())
+}
+
+// Describes the positions with one line per stock and a total in the currency of the contact. Positions without
+// shares are skipped, there's no total if there's no line.
+func describePositions(store *Storage, c *Contact, positions []*Position) (lines []string, total string) {
+	totalCost := Decimal(0)
+	totalValue := Decimal(0)
+	currency := c.referenceCurrency()
+	converter := newCurrencyConverter(store.Currencies, currency)
+	for _, p := range positions {
+		s := store.Stocks.GetStockFromId(p.Stock)
+		if s == nil || p.Nb == 0 {
+			continue
+		}
+
+		cost := p.Cost
+		value := s.Value.Mul(p.Nb)
+
+		diff := value - cost
+		per := diff.MulInt(100).Div(cost)
+
+		line := fmt.Sprintf(
+			"%s, %v shares, value: %.03f / %.03f, total: %.03f - %.03f = %+.03f %s (%+.02f%%)",
+			s.String(), p.Nb, s.Value, p.Price(), value, cost, diff, s.Currency, per)
+
+		if convertedValue, ok := converter.convert(value, s.Currency); !ok {
+			line += fmt.Sprintf(", no %s/%s rate", s.Currency, currency)
+		} else {
+			convertedCost, _ := converter.convert(cost, s.Currency)
+			totalValue += convertedValue
+			totalCost += convertedCost
+			if s.Currency != "" && s.Currency != currency {
+				line += fmt.Sprintf(" = %+.03f %s (rate: %v)", convertedValue-convertedCost, currency, converter.rate(s.Currency))
+			}
+		}
+
+		lines = append(lines, line)
+	}
+
+	if len(lines) > 0 {
+		totalDiff := totalValue - totalCost
+		per := totalDiff.MulInt(100).Div(totalCost)
+		total = fmt.Sprintf("Total: %.03f - %.03f = %+.03f %s (%+.02f%%)", totalValue, totalCost, totalDiff, currency, per)
+		if missing := converter.missing(); len(missing) > 0 {
+			total += fmt.Sprintf(", without the stocks in %s", strings.Join(missing, ", "))
+		}
+	}
+	return
+}
+
+func checkPortfolioName(name string) error {
+	if name == "" || strings.HasPrefix(name, "@") || strings.ContainsAny(name, " \t") {
+		return errors.New(fmt.Sprintf("Invalid portfolio name \"%s\"", name))
+	}
+	return nil
+}
+
+func findPortfolio(store *Storage, c *Contact, name string) (*Portfolio, error) {
+	for _, p := range *store.Portfolios.GetPortfolios(c) {
+		if p.Name == name {
+			return &p, nil
+		}
+	}
+	return nil, errors.New(fmt.Sprintf("Unknown portfolio \"%s\"", name))
+}
+
+// Portfolio where the transactions go when none is given. It is created if the contact doesn't have any.
+func defaultPortfolio(store *Storage, c *Contact) (*Portfolio, error) {
+	portfolios := *store.Portfolios.GetPortfolios(c)
+	for _, p := range portfolios {
+		if p.Default {
+			return &p, nil
+		}
+	}
+	if len(portfolios) > 0 {
+		return &portfolios[0], nil
+	}
+
+	p := &Portfolio{Contact: c.Id, Name: DEFAULT_PORTFOLIO, Default: true}
+	return p, store.Portfolios.SavePortfolio(p)
+}
+
+// Makes a portfolio the default one
+func setDefaultPortfolio(store *Storage, c *Contact, p *Portfolio) error {
+	for _, other := range *store.Portfolios.GetPortfolios(c) {
+		if other.Default != (other.Id == p.Id) {
+			other.Default = other.Id == p.Id
+			if err := store.Portfolios.SavePortfolio(&other); err != nil {
+				return err
+			}
+		}
+	}
+	p.Default = true
+	return nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The followers run concurrently and a portfolio alert is considered by the followers of all its stocks
+var portfolioAlertsLock sync.Mutex
+
+// Values the shares currently held in a portfolio with the prices and rates of any date, in the currency of the contact.
+// Comparing values of the same shares means buying or selling some doesn't look like a gain or a loss.
+type portfolioValuation struct {
+	valuer   *portfolioValuer
+	holdings map[int64]Decimal
+}
+
+func newPortfolioValuation(store *Storage, c *Contact, p *Portfolio, now int64) *portfolioValuation {
+	pv := &portfolioValuation{
+		valuer: &portfolioValuer{
+			store:      store,
+			converter:  newCurrencyConverter(store.Currencies, c.referenceCurrency()),
+			now:        now,
+			stocks:     make(map[int64]*Stock),
+			lastPrices: make(map[int64]Decimal),
+		},
+		holdings: make(map[int64]Decimal),
+	}
+	transactions := *store.Transactions.GetTransactions(c, p, nil)
+	for _, t := range transactions {
+		pv.valuer.lastPrices[t.Stock] = t.Price
+	}
+	for _, position := range computePositions(transactions, c.costMethod()) {
+		if position.Nb > 0 {
+			pv.holdings[position.Stock] = position.Nb
+		}
+	}
+	return pv
+}
+
+func (pv *portfolioValuation) value(date int64) Decimal {
+	return pv.valuer.value(pv.holdings, date)
+}
+
+// Checks an alert against the current value of its portfolio. A change is computed from the value at the last
+// trigger (or at the start of the time window), a drawdown from the highest value seen since the alert was defined.
+// A drawdown alert is only triggered once until the portfolio reaches a new peak.
+func considerPortfolioAlert(store *Storage, send chan interface{}, al *PortfolioAlert, now int64) {
+	contact := store.Contacts.GetContactFromId(al.Contact)
+	if contact == nil {
+		log.Info("Portfolio alert %d - Contact missing, deleting alert !", al.Id)
+		store.PortfolioAlerts.DeletePortfolioAlert(al)
+		return
+	}
+	var portfolio *Portfolio
+	for _, p := range *store.Portfolios.GetPortfolios(contact) {
+		if p.Id == al.Portfolio {
+			portfolio = &p
+			break
+		}
+	}
+	if portfolio == nil {
+		log.Info("Portfolio alert %d - Portfolio missing, deleting alert !", al.Id)
+		store.PortfolioAlerts.DeletePortfolioAlert(al)
+		return
+	}
+
+	valuation := newPortfolioValuation(store, contact, portfolio, now)
+	if al.LastDate == 0 {
+		al.LastDate = now
+		al.LastTriggered = now
+		al.LastValue = valuation.value(now)
+		store.PortfolioAlerts.SavePortfolioAlert(al)
+		return
+	}
+	if al.Type == PORTFOLIO_ALERT_CHANGE && al.Duration != 0 && now-al.LastDate > al.Duration {
+		al.LastDate = now - al.Duration
+		al.LastValue = valuation.value(al.LastDate)
+		store.PortfolioAlerts.SavePortfolioAlert(al)
+	}
+
+	reference := valuation.value(al.LastDate)
+	value := valuation.value(now)
+	if reference == 0 || value == 0 {
+		return
+	}
+	per := (value - reference).Div(reference).MulInt(100)
+	log.Info("Portfolio alert %s / %1.2f%%", al.Format(portfolio), per)
+
+	var triggered bool
+	switch al.Type {
+	case PORTFOLIO_ALERT_DRAWDOWN:
+		if value >= reference {
+			al.LastDate = now
+			al.LastValue = value
+			store.PortfolioAlerts.SavePortfolioAlert(al)
+			return
+		}
+		triggered = -per >= al.Percent && al.LastTriggered < al.LastDate
+	default:
+		switch al.PercentDirection {
+		case ALERT_DIRECTION_BOTH:
+			triggered = per.Abs() >= al.Percent
+		case ALERT_DIRECTION_UP:
+			triggered = per > al.Percent
+		case ALERT_DIRECTION_DOWN:
+			triggered = per < -al.Percent
+		}
+	}
+
+	if !triggered {
+		return
+	}
+	if now < contact.PauseUntil {
+		log.Info("Portfolio alert %d - Contact is in pause", al.Id)
+		return
+	}
+
+	log.Info("Portfolio alert %d - Trigger !", al.Id)
+	currency := contact.referenceCurrency()
+	var message string
+	if al.Type == PORTFOLIO_ALERT_DRAWDOWN {
+		message = fmt.Sprintf("Portfolio %s : %.3f %s (%+.2f%%) since its peak of %.3f %s on %s",
+			portfolio.Name, value, currency, per, reference, currency, time.Unix(0, al.LastDate).UTC().Format("2006-01-02 15:04"))
+	} else {
+		timeDiff := time.Duration(now - al.LastTriggered)
+		timeDiff -= timeDiff % time.Second
+		message = fmt.Sprintf("Portfolio %s : %.3f %s (%+.2f%%) in %v", portfolio.Name, value, currency, per, timeDiff)
+		al.LastDate = now
+		al.LastValue = value
+	}
+	if missing := valuation.valuer.converter.missing(); len(missing) > 0 {
+		message += fmt.Sprintf(", without the stocks in %s", strings.Join(missing, ", "))
+	}
+	al.LastTriggered = now
+	store.PortfolioAlerts.SavePortfolioAlert(al)
+
+	send <- &SendChat{Remote: contact.Email, Text: message}
+}
+
+// Defines an alert on a portfolio, a drawdown doesn't have a direction nor a duration
+func definePortfolioAlert(store *Storage, c *Contact, p *Portfolio, alertType string, per Decimal, direction int, duration int64) (*PortfolioAlert, error) {
+	if alertType == PORTFOLIO_ALERT_DRAWDOWN && (direction != ALERT_DIRECTION_BOTH || duration != 0) {
+		return nil, errors.New("A drawdown alert only takes a percentage (Ex: \"pa @pea dd 10\")")
+	}
+	if per <= 0 {
+		return nil, errors.New("The percentage must be positive")
+	}
+
+	now := time.Now().UTC().UnixNano()
+	al := &PortfolioAlert{
+		Contact:          c.Id,
+		Portfolio:        p.Id,
+		Type:             alertType,
+		Percent:          per,
+		PercentDirection: direction,
+		Duration:         duration,
+		LastDate:         now,
+		LastTriggered:    now,
+		LastValue:        newPortfolioValuation(store, c, p, now).value(now),
+	}
+	return al, store.PortfolioAlerts.SavePortfolioAlert(al)
+}
+
+// Considers the alerts of the portfolios holding the stock, after its value changed
+func (sf *StockFollower) considerPortfolioAlerts() {
+	portfolioAlertsLock.Lock()
+	defer portfolioAlertsLock.Unlock()
+
+	now := time.Now().UTC().UnixNano()
+	for _, al := range *sf.store.PortfolioAlerts.GetPortfolioAlertsForStock(sf.Stock) {
+		considerPortfolioAlert(sf.store, sf.send, &al, now)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPortfolioAlerts(t *testing.T) {
+	store := NewMemDB().Storage()
+	send := make(chan interface{}, 10)
+
+	s := &Stock{Market: "FR", Short: "RNO", Currency: "EUR"}
+	store.Stocks.SaveStock(s)
+	c := store.Contacts.GetContactFromEmail("florent@clairambault.fr")
+	p, _ := defaultPortfolio(store, c)
+	store.Transactions.SaveTransaction(&Transaction{Contact: c.Id, Portfolio: p.Id, Stock: s.Id, Date: 1, Type: TRANSACTION_BUY, Nb: DecimalFromInt(10), Price: DecimalFromInt(100), Currency: "EUR"})
+
+	day := int64(time.Hour * 24)
+	now := 10 * day
+	store.Values.SaveStockValue(s, DecimalFromInt(100), now)
+
+	change := &PortfolioAlert{Contact: c.Id, Portfolio: p.Id, Type: PORTFOLIO_ALERT_CHANGE, Percent: DecimalFromInt(5), PercentDirection: ALERT_DIRECTION_DOWN, LastDate: now, LastTriggered: now}
+	store.PortfolioAlerts.SavePortfolioAlert(change)
+	drawdown := &PortfolioAlert{Contact: c.Id, Portfolio: p.Id, Type: PORTFOLIO_ALERT_DRAWDOWN, Percent: DecimalFromInt(10), LastDate: now, LastTriggered: now}
+	store.PortfolioAlerts.SavePortfolioAlert(drawdown)
+
+	// Returns the number of messages sent when the stock gets a new value
+	tick := func(value int64) int {
+		now += day
+		store.Values.SaveStockValue(s, DecimalFromInt(value), now)
+		for _, al := range *store.PortfolioAlerts.GetPortfolioAlertsForStock(s) {
+			considerPortfolioAlert(store, send, &al, now)
+		}
+		nb := len(send)
+		for len(send) > 0 {
+			<-send
+		}
+		return nb
+	}
+
+	if nb := tick(110); nb != 0 {
+		t.Fatalf("Nothing should have been triggered (%d)", nb)
+	}
+
+	// Buying more shares doesn't change the value of the shares
+	store.Transactions.SaveTransaction(&Transaction{Contact: c.Id, Portfolio: p.Id, Stock: s.Id, Date: now, Type: TRANSACTION_BUY, Nb: DecimalFromInt(10), Price: DecimalFromInt(110), Currency: "EUR"})
+	if nb := tick(110); nb != 0 {
+		t.Fatalf("Nothing should have been triggered (%d)", nb)
+	}
+
+	if nb := tick(104); nb != 0 {
+		t.Fatalf("Nothing should have been triggered (%d)", nb)
+	}
+	// -10% since the peak
+	if nb := tick(99); nb != 1 {
+		t.Fatalf("Only the drawdown alert should have been triggered (%d)", nb)
+	}
+	// -6% since the alert was defined, the drawdown alert isn't triggered again until there's a new peak
+	if nb := tick(94); nb != 1 {
+		t.Fatalf("Only the change alert should have been triggered (%d)", nb)
+	}
+	if nb := tick(120); nb != 0 {
+		t.Fatalf("Nothing should have been triggered (%d)", nb)
+	}
+	if nb := tick(107); nb != 1 {
+		t.Fatalf("Only the drawdown alert should have been triggered (%d)", nb)
+	}
+
+	if err := store.Portfolios.DeletePortfolio(p); err != nil {
+		t.Fatal(err)
+	}
+	if alerts := store.PortfolioAlerts.GetPortfolioAlertsForContact(c); len(*alerts) != 0 {
+		t.Fatalf("The alerts should have been deleted with their portfolio: %#v", alerts)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPositions(t *testing.T) {
+	buy := func(nb, price float64) Transaction {
+		return Transaction{Type: TRANSACTION_BUY, Nb: DecimalFromFloat(nb), Price: DecimalFromFloat(price), Fees: DecimalFromInt(1)}
+	}
+	sell := func(nb, price float64) Transaction {
+		return Transaction{Type: TRANSACTION_SELL, Nb: DecimalFromFloat(nb), Price: DecimalFromFloat(price)}
+	}
+	transactions := []Transaction{buy(10, 10), buy(10, 20), sell(15, 30)}
+
+	if p := computePosition(transactions, COST_METHOD_AVERAGE); p.Nb != DecimalFromInt(5) || p.Cost != DecimalFromFloat(75.5) || p.Realized != DecimalFromFloat(223.5) || p.Fees != DecimalFromInt(2) {
+		t.Fatalf("Wrong average cost position: %#v", p)
+	}
+
+	if p := computePosition(transactions, COST_METHOD_FIFO); p.Nb != DecimalFromInt(5) || p.Cost != DecimalFromFloat(100.5) || p.Realized != DecimalFromFloat(248.5) {
+		t.Fatalf("Wrong FIFO position: %#v", p)
+	}
+
+	// We can't sell shares we don't have
+	if p := computePosition([]Transaction{buy(3, 10), sell(5, 20)}, COST_METHOD_FIFO); p.Nb != 0 || p.Cost != 0 || p.Realized != DecimalFromInt(29) {
+		t.Fatalf("Wrong position: %#v", p)
+	}
+
+	// The cost includes the fees and the taxes
+	if p := computePosition([]Transaction{buy(0.5, 10)}, COST_METHOD_AVERAGE); p.Price() != DecimalFromInt(12) {
+		t.Fatalf("Wrong price: %v", p.Price())
+	}
+	taxed := sell(0.25, 20)
+	taxed.Taxes = DecimalFromFloat(0.5)
+	if p := computePosition([]Transaction{buy(0.5, 10), taxed}, COST_METHOD_FIFO); p.Nb != DecimalFromFloat(0.25) || p.Cost != DecimalFromInt(3) || p.Realized != DecimalFromFloat(1.5) || p.Taxes != DecimalFromFloat(0.5) {
+		t.Fatalf("Wrong position: %#v", p)
+	}
+}
+
+func TestContactPositions(t *testing.T) {
+	store := NewMemDB().Storage()
+
+	rno := &Stock{Market: "FR", Short: "RNO", Currency: "EUR"}
+	store.Stocks.SaveStock(rno)
+	air := &Stock{Market: "FR", Short: "AIR", Currency: "EUR"}
+	store.Stocks.SaveStock(air)
+	c := store.Contacts.GetContactFromEmail("florent@clairambault.fr")
+
+	store.Transactions.SaveTransaction(&Transaction{Contact: c.Id, Stock: air.Id, Date: 2, Type: TRANSACTION_BUY, Nb: DecimalFromInt(1), Price: DecimalFromInt(100)})
+	store.Transactions.SaveTransaction(&Transaction{Contact: c.Id, Stock: rno.Id, Date: 3, Type: TRANSACTION_SELL, Nb: DecimalFromInt(5), Price: DecimalFromInt(40)})
+	store.Transactions.SaveTransaction(&Transaction{Contact: c.Id, Stock: rno.Id, Date: 1, Type: TRANSACTION_BUY, Nb: DecimalFromInt(10), Price: DecimalFromInt(30)})
+
+	positions := getPositions(store, c, nil, nil)
+	if len(positions) != 2 || positions[0].Stock != rno.Id || positions[1].Stock != air.Id {
+		t.Fatalf("Wrong positions: %#v", positions)
+	}
+	if p := positions[0]; p.Nb != DecimalFromInt(5) || p.Realized != DecimalFromInt(50) {
+		t.Fatalf("The transactions should be ordered by date: %#v", p)
+	}
+}
+
+func TestPortfolios(t *testing.T) {
+	store := NewMemDB().Storage()
+
+	s := &Stock{Market: "FR", Short: "RNO", Currency: "EUR"}
+	store.Stocks.SaveStock(s)
+	c := store.Contacts.GetContactFromEmail("florent@clairambault.fr")
+
+	main, err := defaultPortfolio(store, c)
+	if err != nil || main.Name != DEFAULT_PORTFOLIO || !main.Default {
+		t.Fatalf("Wrong default portfolio: %#v (%v)", main, err)
+	}
+	pea := &Portfolio{Contact: c.Id, Name: "pea"}
+	store.Portfolios.SavePortfolio(pea)
+
+	store.Transactions.SaveTransaction(&Transaction{Contact: c.Id, Portfolio: main.Id, Stock: s.Id, Date: 1, Type: TRANSACTION_BUY, Nb: DecimalFromInt(10), Price: DecimalFromInt(10)})
+	store.Transactions.SaveTransaction(&Transaction{Contact: c.Id, Portfolio: pea.Id, Stock: s.Id, Date: 2, Type: TRANSACTION_BUY, Nb: DecimalFromInt(10), Price: DecimalFromInt(20)})
+	store.Transactions.SaveTransaction(&Transaction{Contact: c.Id, Portfolio: pea.Id, Stock: s.Id, Date: 3, Type: TRANSACTION_SELL, Nb: DecimalFromInt(5), Price: DecimalFromInt(30)})
+
+	if p := getPosition(store, c, pea, s); p.Nb != DecimalFromInt(5) || p.Cost != DecimalFromInt(100) || p.Realized != DecimalFromInt(50) {
+		t.Fatalf("Wrong position in the PEA: %#v", p)
+	}
+	// The sale only concerns the shares of the PEA
+	if p := getPosition(store, c, nil, s); p.Nb != DecimalFromInt(15) || p.Cost != DecimalFromInt(200) || p.Realized != DecimalFromInt(50) {
+		t.Fatalf("Wrong combined position: %#v", p)
+	}
+
+	if err := setDefaultPortfolio(store, c, pea); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := defaultPortfolio(store, c); p.Id != pea.Id {
+		t.Fatalf("The PEA should be the default portfolio: %#v", p)
+	}
+
+	store.Portfolios.DeletePortfolio(pea)
+	if transactions := store.Transactions.GetTransactions(c, nil, nil); len(*transactions) != 1 {
+		t.Fatalf("The transactions of the PEA should have been deleted: %#v", transactions)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Price that triggers the alert
+func (a *PositionAlert) threshold() Decimal {
+	switch a.Type {
+	case POSITION_ALERT_TAKE_PROFIT:
+		return a.Cost + a.Cost.Mul(a.Percent).Div(DecimalFromInt(100))
+	case POSITION_ALERT_TRAILING_STOP:
+		return a.High - a.High.Mul(a.Percent).Div(DecimalFromInt(100))
+	default:
+		return a.Cost - a.Cost.Mul(a.Percent).Div(DecimalFromInt(100))
+	}
+}
+
+func (a *PositionAlert) reached(price Decimal) bool {
+	if a.Type == POSITION_ALERT_TAKE_PROFIT {
+		return price >= a.threshold()
+	}
+	return price <= a.threshold()
+}
+
+// Highest price of a stock since the shares held were bought: since the last purchase made without any share
+func positionHigh(store *Storage, s *Stock, transactions []Transaction, now int64) Decimal {
+	var opened int64
+	nb := Decimal(0)
+	for _, t := range transactions {
+		if t.Type == TRANSACTION_BUY && nb == 0 {
+			opened = t.Date
+		}
+		if t.Type == TRANSACTION_BUY {
+			nb += t.Nb
+		} else if nb -= t.Nb; nb < 0 {
+			nb = 0
+		}
+	}
+
+	high := s.Value
+	for _, t := range transactions {
+		if t.Type == TRANSACTION_BUY && t.Date >= opened && t.Price > high {
+			high = t.Price
+		}
+	}
+	for _, v := range *store.Values.GetStockValues(s, opened, now+1) {
+		if v.Value > high {
+			high = v.Value
+		}
+	}
+	return high
+}
+
+// Defines an alert relative to the position of a contact, it replaces the alert of the same type on the stock
+func definePositionAlert(store *Storage, c *Contact, s *Stock, alertType string, per Decimal) (*PositionAlert, error) {
+	if per <= 0 || (alertType != POSITION_ALERT_TAKE_PROFIT && per >= DecimalFromInt(100)) {
+		return nil, errors.New(fmt.Sprintf("Invalid percentage %v", per))
+	}
+
+	transactions := *store.Transactions.GetTransactions(c, nil, s)
+	position := computePositions(transactions, c.costMethod())
+	if len(position) == 0 || position[0].Nb <= 0 {
+		return nil, errors.New(fmt.Sprintf("You don't have any share of %s", s))
+	}
+
+	for _, a := range *store.PositionAlerts.GetPositionAlertsForContact(c) {
+		if a.Stock == s.Id && a.Type == alertType {
+			if err := store.PositionAlerts.DeletePositionAlert(&a); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	al := &PositionAlert{
+		Contact: c.Id,
+		Stock:   s.Id,
+		Type:    alertType,
+		Percent: per,
+		Cost:    position[0].Price(),
+		High:    positionHigh(store, s, transactions, time.Now().UTC().UnixNano()),
+	}
+	al.Triggered = al.reached(s.Value)
+	return al, store.PositionAlerts.SavePositionAlert(al)
+}
+
+// Checks an alert against the price of its stock. The cost follows the position, an alert is only triggered once
+// until the price goes back or (unless it's a trailing stop) the cost changes.
+func considerPositionAlert(store *Storage, send chan interface{}, al *PositionAlert, stock *Stock, price Decimal, now int64) {
+	contact := store.Contacts.GetContactFromId(al.Contact)
+	if contact == nil {
+		log.Info("Position alert %d - Contact missing, deleting alert !", al.Id)
+		store.PositionAlerts.DeletePositionAlert(al)
+		return
+	}
+
+	position := getPosition(store, contact, nil, stock)
+	if position.Nb <= 0 {
+		// The shares were sold, the alert will start over with the next purchase
+		if al.Cost != 0 || al.High != 0 || al.Triggered {
+			al.Cost, al.High, al.Triggered = 0, 0, false
+			store.PositionAlerts.SavePositionAlert(al)
+		}
+		return
+	}
+
+	previous := *al
+	if cost := position.Price(); cost != al.Cost {
+		al.Cost = cost
+		if al.Type != POSITION_ALERT_TRAILING_STOP {
+			al.Triggered = false
+		}
+	}
+	if price > al.High {
+		al.High = price
+	}
+
+	if !al.reached(price) {
+		al.Triggered = false
+	} else if !al.Triggered && now >= contact.PauseUntil {
+		log.Info("Position alert %d - Trigger !", al.Id)
+		al.Triggered = true
+		al.LastTriggered = now
+
+		reference, from := al.Cost, "your cost"
+		if al.Type == POSITION_ALERT_TRAILING_STOP {
+			reference, from = al.High, "its high since your purchase"
+		}
+		per := (price - reference).Div(reference).MulInt(100)
+		value := price.Mul(position.Nb)
+		diff := value - position.Cost
+		message := fmt.Sprintf("%s : %.3f (%+.2f%% from %s of %.3f) / %v shares: %.3f - %.3f = %+.3f %s (%+.2f%%)",
+			al.Format(stock), price, per, from, reference, position.Nb, value, position.Cost, diff, stock.Currency, diff.Div(position.Cost).MulInt(100))
+		if contact.ShowUrl {
+			message += " / " + stock.Url()
+		}
+		send <- &SendChat{Remote: contact.Email, Text: message}
+	}
+
+	if *al != previous {
+		store.PositionAlerts.SavePositionAlert(al)
+	}
+}
+
+// Considers the alerts on the positions of the stock
+func (sf *StockFollower) considerPositionAlerts(value Decimal) {
+	if value == 0 {
+		return
+	}
+	now := time.Now().UTC().UnixNano()
+	for _, al := range *sf.store.PositionAlerts.GetPositionAlertsForStock(sf.Stock) {
+		considerPositionAlert(sf.store, sf.send, &al, sf.Stock, value, now)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPositionAlerts(t *testing.T) {
+	store := NewMemDB().Storage()
+	send := make(chan interface{}, 10)
+
+	s := &Stock{Market: "FR", Short: "RNO", Currency: "EUR"}
+	store.Stocks.SaveStock(s)
+	c := store.Contacts.GetContactFromEmail("florent@clairambault.fr")
+	p, _ := defaultPortfolio(store, c)
+
+	if _, err := definePositionAlert(store, c, s, POSITION_ALERT_STOP_LOSS, DecimalFromInt(10)); err == nil {
+		t.Fatal("We shouldn't define an alert without shares")
+	}
+
+	now := int64(10)
+	store.Values.SaveStockValue(s, DecimalFromInt(100), now)
+	store.Transactions.SaveTransaction(&Transaction{Contact: c.Id, Portfolio: p.Id, Stock: s.Id, Date: now, Type: TRANSACTION_BUY, Nb: DecimalFromInt(10), Price: DecimalFromInt(100), Currency: "EUR"})
+	for _, alertType := range []string{POSITION_ALERT_STOP_LOSS, POSITION_ALERT_TAKE_PROFIT, POSITION_ALERT_TRAILING_STOP} {
+		per := DecimalFromInt(10)
+		if alertType == POSITION_ALERT_TAKE_PROFIT {
+			per = DecimalFromInt(20)
+		}
+		if _, err := definePositionAlert(store, c, s, alertType, per); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Returns the number of messages sent when the stock gets a new price
+	tick := func(price int64) int {
+		now += 1
+		store.Values.SaveStockValue(s, DecimalFromInt(price), now)
+		for _, al := range *store.PositionAlerts.GetPositionAlertsForStock(s) {
+			considerPositionAlert(store, send, &al, s, DecimalFromInt(price), now)
+		}
+		nb := len(send)
+		for len(send) > 0 {
+			<-send
+		}
+		return nb
+	}
+
+	for i, step := range []struct {
+		price int64
+		nb    int
+	}{
+		{95, 0},
+		{125, 1}, // Take profit, the trailing stop is now at 112.5
+		{110, 1}, // Trailing stop
+		{105, 0},
+		{89, 1}, // Stop loss
+		{88, 0}, // Only once until the price goes back
+		{95, 0},
+		{90, 1},
+	} {
+		if nb := tick(step.price); nb != step.nb {
+			t.Fatalf("Step %d: %d alerts instead of %d", i, nb, step.nb)
+		}
+	}
+
+	// The cost follows the position: 20 shares at 85, the stop loss is at 76.5
+	store.Transactions.SaveTransaction(&Transaction{Contact: c.Id, Portfolio: p.Id, Stock: s.Id, Date: now, Type: TRANSACTION_BUY, Nb: DecimalFromInt(10), Price: DecimalFromInt(70), Currency: "EUR"})
+	if nb := tick(80); nb != 0 {
+		t.Fatalf("%d alerts instead of 0", nb)
+	}
+	if nb := tick(76); nb != 1 {
+		t.Fatalf("%d alerts instead of 1", nb)
+	}
+
+	store.Transactions.SaveTransaction(&Transaction{Contact: c.Id, Portfolio: p.Id, Stock: s.Id, Date: now, Type: TRANSACTION_SELL, Nb: DecimalFromInt(20), Price: DecimalFromInt(76), Currency: "EUR"})
+	tick(70)
+	for _, al := range *store.PositionAlerts.GetPositionAlertsForStock(s) {
+		if al.Cost != 0 || al.High != 0 || al.Triggered {
+			t.Fatalf("The alert should start over: %#v", al)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// A stock found by a search, it isn't saved
+type stockCandidate struct {
+	Market   string
+	Short    string
+	Isin     string
+	Name     string
+	Currency string
+	rank     int
+}
+
+func (c *stockCandidate) String() string {
+	str := fmt.Sprintf("%s:%s %s", c.Market, c.Short, c.Name)
+	if details := strings.TrimSpace(c.Isin + " " + c.Currency); details != "" {
+		str += " (" + strings.Replace(details, " ", ", ", -1) + ")"
+	}
+	return str
+}
+
+const MAX_SEARCH_RESULTS = 10
+
+var (
+	reSearchRow      = regexp.MustCompile("(?s)<tr[^>]*>(.*?)</tr>")
+	reSearchLink     = regexp.MustCompile("<a [^>]*href=\"[^\"]*symbole=([^\"&]+)\"[^>]*>([^<]+)</a>")
+	reSearchIsin     = regexp.MustCompile("<td[^>]*>\\s*([A-Z]{2}[A-Z0-9]{9}[0-9])\\s*</td>")
+	reSearchCurrency = regexp.MustCompile("<td[^>]*>\\s*([A-Z]{3})\\s*</td>")
+)
+
+// Reads the results of a search page, each result is a row with a link to its page
+func parseSearchResults(body string) []*stockCandidate {
+	candidates := []*stockCandidate{}
+	for _, row := range reSearchRow.FindAllStringSubmatch(body, -1) {
+		link := reSearchLink.FindStringSubmatch(row[1])
+		if link == nil {
+			continue
+		}
+		c := &stockCandidate{Name: strings.TrimSpace(link[2])}
+		c.Market, c.Short = parseBoursoramaSymbol(link[1])
+		if result := reSearchIsin.FindStringSubmatch(row[1]); result != nil {
+			c.Isin = result[1]
+		}
+		if result := reSearchCurrency.FindStringSubmatch(row[1]); result != nil {
+			c.Currency = result[1]
+		}
+		candidates = append(candidates, c)
+	}
+	return candidates
+}
+
+// Sorts the candidates: the exact tickers and ISINs first, then the names starting with the text and then the ones
+// containing it. The markets are in the order in which we look for the tickers.
+func rankCandidates(candidates []*stockCandidate, text string) []*stockCandidate {
+	text = strings.ToUpper(strings.TrimSpace(text))
+	for _, c := range candidates {
+		name := strings.ToUpper(c.Name)
+		switch {
+		case c.Short == text || c.Isin == text:
+			c.rank = 0
+		case name == text:
+			c.rank = 1
+		case strings.HasPrefix(name, text):
+			c.rank = 2
+		case strings.Contains(name, text):
+			c.rank = 3
+		default:
+			c.rank = 4
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].rank != candidates[j].rank {
+			return candidates[i].rank < candidates[j].rank
+		}
+		return marketRank(candidates[i].Market) < marketRank(candidates[j].Market)
+	})
+	if len(candidates) > MAX_SEARCH_RESULTS {
+		candidates = candidates[:MAX_SEARCH_RESULTS]
+	}
+	return candidates
+}
+
+// Looks for stocks by ticker, ISIN or name with the search of boursorama
+func searchStocks(text string) ([]*stockCandidate, error) {
+	resp, err := httpGet("http://www.boursorama.com/recherche/index.phtml?q=" + url.QueryEscape(text))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, errors.New(fmt.Sprintf("Wrong status code %d", resp.StatusCode))
+	}
+
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	// An exact match goes directly to the page of the stock
+	if symbol := resp.Request.URL.Query().Get("symbole"); symbol != "" {
+		c := &stockCandidate{}
+		c.Market, c.Short = parseBoursoramaSymbol(symbol)
+		for _, re := range reName {
+			if result := re.FindStringSubmatch(string(raw)); len(result) > 1 {
+				c.Name = strings.Trim(result[1], " \n\r")
+				break
+			}
+		}
+		if result := reCotation.FindStringSubmatch(string(raw)); len(result) >= 3 {
+			c.Currency = result[2]
+		}
+		return []*stockCandidate{c}, nil
+	}
+
+	return rankCandidates(parseSearchResults(string(raw)), text), nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+func TestSearchResults(t *testing.T) {
+	raw, err := ioutil.ReadFile("testdata/search_renault.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	candidates := parseSearchResults(string(raw))
+	if len(candidates) != 5 {
+		t.Fatalf("%d candidates instead of 5", len(candidates))
+	}
+	if c := candidates[0]; c.Market != "FR" || c.Short != "RNO" || c.Isin != "FR0000131906" || c.Name != "RENAULT" || c.Currency != "EUR" {
+		t.Fatalf("Wrong candidate: %#v", c)
+	}
+
+	expected := []string{"FR:RNO", "US2:RNL", "US:RNLSY", "FR:ALRNO", "W:FR0011574110"}
+	for i, c := range rankCandidates(candidates, "renault") {
+		if symbol := c.Market + ":" + c.Short; symbol != expected[i] {
+			t.Fatalf("%d: %s instead of %s", i, symbol, expected[i])
+		}
+	}
+
+	// An exact ticker comes first
+	if c := rankCandidates(candidates, "rnlsy")[0]; c.Short != "RNLSY" {
+		t.Fatalf("Wrong first candidate: %s", c)
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Columns of the CSV statements of a broker. Profiles are defined in the config file ([statement "<name>"]), the
+// "default" one reads files with the names of the fields of our transactions.
+type StatementProfile struct {
+	Separator  string   // Guessed from the header if not set
+	Date       string   // Name of the columns, Type, Fees, Taxes and Currency are optional
+	DateFormat string   // Go layout ("02/01/2006"), the usual formats are tried if not set
+	Symbol     string   // Ticker ("RNO") or market and ticker ("FR:RNO")
+	Type       string   // Without this column, negative quantities are sales
+	Buy        []string // Values of the type column for purchases and sales
+	Sell       []string
+	Quantity   string
+	Price      string
+	Fees       string
+	Taxes      string
+	Currency   string
+}
+
+const DEFAULT_STATEMENT_PROFILE = "default"
+
+var defaultStatementProfile = StatementProfile{
+	Date:     "date",
+	Symbol:   "stock",
+	Type:     "type",
+	Buy:      []string{TRANSACTION_BUY},
+	Sell:     []string{TRANSACTION_SELL},
+	Quantity: "nb",
+	Price:    "price",
+	Fees:     "fees",
+	Taxes:    "taxes",
+	Currency: "currency",
+}
+
+func statementProfile(name string) (*StatementProfile, error) {
+	if name == "" || name == DEFAULT_STATEMENT_PROFILE {
+		return &defaultStatementProfile, nil
+	}
+	names := []string{DEFAULT_STATEMENT_PROFILE}
+	for n, profile := range config.Statement {
+		if strings.EqualFold(n, name) {
+			return profile, nil
+		}
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return nil, errors.New(fmt.Sprintf("Unknown statement profile \"%s\" (%s)", name, strings.Join(names, ", ")))
+}
+
+// A transaction read from a statement, its stock isn't known yet
+type statementRow struct {
+	Line        int
+	Symbol      string
+	Transaction Transaction
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(strings.TrimSpace(v), value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reads the transactions of a statement, ordered by date
+func readStatementCsv(r io.Reader, profile *StatementProfile) ([]statementRow, error) {
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := csv.NewReader(strings.NewReader(string(raw)))
+	if profile.Separator != "" {
+		reader.Comma = []rune(profile.Separator)[0]
+	} else if header := strings.SplitN(string(raw), "\n", 2)[0]; strings.Contains(header, ";") && !strings.Contains(header, ",") {
+		reader.Comma = ';'
+	}
+	reader.FieldsPerRecord = -1
+
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, errors.New("Empty statement")
+	}
+
+	columns := make(map[string]int)
+	for i, name := range rows[0] {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	// Index of a column, -1 if it's optional and missing
+	column := func(name string, required bool) (int, error) {
+		if i, ok := columns[strings.ToLower(name)]; ok && name != "" {
+			return i, nil
+		}
+		if required {
+			return -1, errors.New(fmt.Sprintf("No \"%s\" column", name))
+		}
+		return -1, nil
+	}
+
+	var dateColumn, symbolColumn, quantityColumn, priceColumn, typeColumn, feesColumn, taxesColumn, currencyColumn int
+	for _, c := range []struct {
+		index    *int
+		name     string
+		required bool
+	}{
+		{&dateColumn, profile.Date, true},
+		{&symbolColumn, profile.Symbol, true},
+		{&quantityColumn, profile.Quantity, true},
+		{&priceColumn, profile.Price, true},
+		{&typeColumn, profile.Type, false},
+		{&feesColumn, profile.Fees, false},
+		{&taxesColumn, profile.Taxes, false},
+		{&currencyColumn, profile.Currency, false},
+	} {
+		if *c.index, err = column(c.name, c.required); err != nil {
+			return nil, err
+		}
+	}
+
+	statement := []statementRow{}
+	for i, row := range rows[1:] {
+		line := i + 2
+		// Empty value of an optional column
+		field := func(index int) string {
+			if index < 0 || index >= len(row) {
+				return ""
+			}
+			return strings.TrimSpace(row[index])
+		}
+		if strings.Join(row, "") == "" {
+			continue
+		}
+		fail := func(err error) ([]statementRow, error) {
+			return nil, errors.New(fmt.Sprintf("Line %d: %s", line, err))
+		}
+
+		t := Transaction{Type: TRANSACTION_BUY, Currency: strings.ToUpper(field(currencyColumn))}
+		if profile.DateFormat != "" {
+			date, err := time.Parse(profile.DateFormat, field(dateColumn))
+			if err != nil {
+				return fail(err)
+			}
+			t.Date = date.UnixNano()
+		} else if t.Date, _, err = parseImportDate(field(dateColumn)); err != nil {
+			return fail(err)
+		}
+
+		if t.Nb, err = parsePrice(field(quantityColumn)); err != nil {
+			return fail(err)
+		}
+		if t.Nb < 0 {
+			t.Nb, t.Type = -t.Nb, TRANSACTION_SELL
+		}
+		if typeColumn != -1 {
+			switch value := field(typeColumn); {
+			case containsFold(profile.Buy, value):
+				t.Type = TRANSACTION_BUY
+			case containsFold(profile.Sell, value):
+				t.Type = TRANSACTION_SELL
+			default:
+				return fail(errors.New(fmt.Sprintf("Unknown type \"%s\"", value)))
+			}
+		}
+		if t.Nb == 0 {
+			return fail(errors.New("No shares"))
+		}
+
+		if t.Price, err = parsePrice(field(priceColumn)); err != nil {
+			return fail(err)
+		}
+		if t.Price <= 0 {
+			return fail(errors.New(fmt.Sprintf("Invalid price %v", t.Price)))
+		}
+		// Brokers often write the fees as negative amounts
+		for _, amount := range []struct {
+			value *Decimal
+			index int
+		}{{&t.Fees, feesColumn}, {&t.Taxes, taxesColumn}} {
+			if value := field(amount.index); value != "" {
+				if *amount.value, err = parsePrice(value); err != nil {
+					return fail(err)
+				}
+				*amount.value = amount.value.Abs()
+			}
+		}
+
+		symbol := strings.ToUpper(field(symbolColumn))
+		if symbol == "" {
+			return fail(errors.New("No stock"))
+		}
+		statement = append(statement, statementRow{Line: line, Symbol: symbol, Transaction: t})
+	}
+
+	// Statements are often in reverse chronological order
+	sort.SliceStable(statement, func(i, j int) bool { return statement[i].Transaction.Date < statement[j].Transaction.Date })
+	return statement, nil
+}
+
+type statementResult struct {
+	DryRun     bool
+	Lines      []string // What was (or would be) done for each transaction and each stock
+	Imported   int
+	Duplicates int
+}
+
+func (r *statementResult) String() string {
+	if r.DryRun {
+		return fmt.Sprintf("Dry run: %d transactions would be imported, %d were already imported", r.Imported, r.Duplicates)
+	}
+	return fmt.Sprintf("%d transactions imported, %d were already imported", r.Imported, r.Duplicates)
+}
+
+// Finds a stock without saving anything: the ones we don't know are looked up on the markets
+func previewStock(store *Storage, c *Contact, symbol string) (*Stock, error) {
+	symbol = strings.ToUpper(symbol)
+	if _, _, ok := parseCurrencyPair(symbol); !ok && !isIsin(symbol) && !strings.Contains(symbol, ":") {
+		market, err := tickerMarket(store, c, symbol)
+		if err != nil {
+			return nil, err
+		}
+		symbol = market + ":" + symbol
+	}
+	if s, err := findStoredStock(store, symbol); err == nil {
+		return s, nil
+	}
+	if tokens := strings.SplitN(symbol, ":", 2); len(tokens) == 2 {
+		return tryNewStock(tokens[0], tokens[1])
+	}
+	for _, market := range marketsToTest() {
+		if s, err := tryNewStock(market, symbol); err == nil && s != nil {
+			return s, nil
+		}
+	}
+	return nil, errors.New(fmt.Sprintf("Unknown stock \"%s\"", symbol))
+}
+
+// Adds the transactions of a statement to a portfolio. The transactions that are already there (same stock, date,
+// type, number of shares and price) are skipped so a statement can be imported again. Nothing is saved if a line
+// is invalid or with a dry run, the stocks are found with resolve.
+func importStatement(store *Storage, c *Contact, p *Portfolio, statement []statementRow, resolve func(symbol string) (*Stock, error), dryRun bool) (*statementResult, error) {
+	result := &statementResult{DryRun: dryRun}
+
+	type key struct {
+		stock     int64
+		date      int64
+		nbType    string
+		nb, price Decimal
+	}
+	existing := make(map[key]int)
+	for _, t := range *store.Transactions.GetTransactions(c, p, nil) {
+		existing[key{t.Stock, t.Date, t.Type, t.Nb, t.Price}] += 1
+	}
+
+	stocks := make(map[string]*Stock)
+	before := make(map[string]Decimal) // Shares of each stock before and after the import
+	after := make(map[string]Decimal)
+	symbols := []string{}
+	transactions := []*Transaction{}
+	for _, row := range statement {
+		s, ok := stocks[row.Symbol]
+		if !ok {
+			var err error
+			if s, err = resolve(row.Symbol); err != nil {
+				return nil, errors.New(fmt.Sprintf("Line %d: %s", row.Line, err))
+			}
+			stocks[row.Symbol] = s
+			symbols = append(symbols, row.Symbol)
+			if s.Id != 0 {
+				before[row.Symbol] = getPosition(store, c, p, s).Nb
+			}
+			after[row.Symbol] = before[row.Symbol]
+		}
+
+		t := row.Transaction
+		t.Contact, t.Portfolio, t.Stock = c.Id, p.Id, s.Id
+		if t.Currency == "" {
+			t.Currency = s.Currency
+		} else if s.Currency != "" && t.Currency != s.Currency {
+			return nil, errors.New(fmt.Sprintf("Line %d: the price is in %s but %s is in %s", row.Line, t.Currency, s, s.Currency))
+		}
+
+		k := key{t.Stock, t.Date, t.Type, t.Nb, t.Price}
+		if s.Id != 0 && existing[k] > 0 {
+			existing[k] -= 1
+			result.Duplicates += 1
+			result.Lines = append(result.Lines, fmt.Sprintf("Line %d: %s, already imported", row.Line, t.Format(s)))
+			continue
+		}
+
+		if t.Type == TRANSACTION_SELL {
+			if t.Nb > after[row.Symbol] {
+				return nil, errors.New(fmt.Sprintf("Line %d: selling %v shares of %s but there are only %v", row.Line, t.Nb, s, after[row.Symbol]))
+			}
+			after[row.Symbol] -= t.Nb
+		} else {
+			after[row.Symbol] += t.Nb
+		}
+		result.Imported += 1
+		result.Lines = append(result.Lines, fmt.Sprintf("Line %d: %s", row.Line, t.Format(s)))
+		transactions = append(transactions, &t)
+	}
+
+	for _, symbol := range symbols {
+		s := stocks[symbol]
+		line := fmt.Sprintf("%s: %v -> %v shares", s, before[symbol], after[symbol])
+		if s.Id == 0 {
+			line += " (new stock)"
+		}
+		result.Lines = append(result.Lines, line)
+	}
+
+	if !dryRun {
+		for _, t := range transactions {
+			if err := store.Transactions.SaveTransaction(t); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return result, nil
+}
+
+func importStatementFile(store *Storage, c *Contact, p *Portfolio, fileName, profileName string, resolve func(symbol string) (*Stock, error), dryRun bool) (*statementResult, error) {
+	profile, err := statementProfile(profileName)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	statement, err := readStatementCsv(file, profile)
+	if err != nil {
+		return nil, err
+	}
+
+	return importStatement(store, c, p, statement, resolve, dryRun)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStatementImport(t *testing.T) {
+	store := NewMemDB().Storage()
+	rno := &Stock{Market: "FR", Short: "RNO", Currency: "EUR"}
+	store.Stocks.SaveStock(rno)
+	psa := &Stock{Market: "FR", Short: "PSA", Currency: "EUR"}
+	store.Stocks.SaveStock(psa)
+	c := store.Contacts.GetContactFromEmail("florent@clairambault.fr")
+	p, _ := defaultPortfolio(store, c)
+	resolve := func(symbol string) (*Stock, error) { return findStoredStock(store, symbol) }
+
+	profile := &StatementProfile{
+		Date:       "Date",
+		DateFormat: "02/01/2006",
+		Symbol:     "Ticker",
+		Type:       "Operation",
+		Buy:        []string{"ACHAT"},
+		Sell:       []string{"VENTE"},
+		Quantity:   "Qty",
+		Price:      "Price",
+		Fees:       "Fees",
+	}
+	// In reverse chronological order, with french decimals and negative fees
+	csv := `Date;Operation;Ticker;Qty;Price;Fees
+20/03/2024;VENTE;RNO;5;50,5;-2,5
+15/02/2024;achat;FR:PSA;2,5;20;0
+10/01/2024;ACHAT;rno;10;40;-4,9
+`
+	statement, err := readStatementCsv(strings.NewReader(csv), profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statement) != 3 || statement[0].Symbol != "RNO" || statement[0].Transaction.Fees != DecimalFromFloat(4.9) || statement[1].Transaction.Nb != DecimalFromFloat(2.5) {
+		t.Fatalf("Wrong statement: %#v", statement)
+	}
+
+	result, err := importStatement(store, c, p, statement, resolve, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Imported != 3 || len(*store.Transactions.GetTransactions(c, nil, nil)) != 0 {
+		t.Fatalf("Nothing should be saved with a dry run: %v", result)
+	}
+	if line := result.Lines[len(result.Lines)-2]; line != rno.String()+": 0 -> 5 shares" {
+		t.Fatalf("Wrong change: %s", line)
+	}
+
+	if result, err = importStatement(store, c, p, statement, resolve, false); err != nil || result.Imported != 3 {
+		t.Fatalf("Import failed: %v / %v", result, err)
+	}
+	if position := getPosition(store, c, p, rno); position.Nb != DecimalFromInt(5) {
+		t.Fatalf("Wrong position: %#v", position)
+	}
+
+	// The same statement can be imported again
+	if result, err = importStatement(store, c, p, statement, resolve, false); err != nil || result.Imported != 0 || result.Duplicates != 3 {
+		t.Fatalf("Transactions imported twice: %v / %v", result, err)
+	}
+
+	// Selling more than what we have is refused, and nothing is imported
+	csv = `date,stock,type,nb,price
+2024-04-01,psa,buy,1,21
+2024-04-02,rno,sell,6,55
+`
+	if statement, err = readStatementCsv(strings.NewReader(csv), &defaultStatementProfile); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = importStatement(store, c, p, statement, resolve, false); err == nil {
+		t.Fatal("We shouldn't sell shares we don't have")
+	}
+	if nb := len(*store.Transactions.GetTransactions(c, nil, nil)); nb != 3 {
+		t.Fatalf("%d transactions instead of 3", nb)
+	}
+
+	// Without a type column, the sign of the quantity tells if it's a sale
+	profile.Type = ""
+	csv = "Date;Ticker;Qty;Price\n01/04/2024;RNO;-2;55\n"
+	if statement, err = readStatementCsv(strings.NewReader(csv), profile); err != nil || statement[0].Transaction.Type != TRANSACTION_SELL || statement[0].Transaction.Nb != DecimalFromInt(2) {
+		t.Fatalf("Wrong statement: %#v / %v", statement, err)
+	}
+}
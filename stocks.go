@@ -4,10 +4,10 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"math"
 	"net/http"
 	"os"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -15,12 +15,17 @@ import (
 )
 
 type StockFollower struct {
-	Stock *Stock
+	sync.Mutex // Held while the stock is checked
+	Stock      *Stock
+	store      *Storage
+	send       chan interface{}
+	splitAsked int64 // When the admins were last asked about the split the alerts wait for
 }
 
 var (
 	reCotation *regexp.Regexp
 	reName     []*regexp.Regexp
+	rePageIsin *regexp.Regexp
 	sleepTime  time.Duration = time.Minute
 )
 
@@ -33,22 +38,20 @@ func init() {
 		regexp.MustCompile("(?s)<[^>]* itemprop=\"name\" title=\"([^\\\"]+)\"[^>]*>"),
 		regexp.MustCompile("(?s)<h1>.*<a.*>(.*)</a>.*</h1>"),
 	}
+
+	rePageIsin = regexp.MustCompile("(?s)ISIN.{0,80}?\\b([A-Z]{2}[A-Z0-9]{9}[0-9])\\b")
 }
 
-func NewStockFollower(s *Stock) *StockFollower {
-	return &StockFollower{Stock: s}
+func NewStockFollower(s *Stock, store *Storage, send chan interface{}) *StockFollower {
+	return &StockFollower{Stock: s, store: store, send: send}
 }
 
 func (sf *StockFollower) run() {
 	t := time.Now().UTC() //.UnixNano()
 	for {
-		v, _, err := sf.Stock.GetValue()
-		if err != nil {
-			log.Warning("Stock %s: %v", sf.Stock.String(), err)
-		} else {
-			log.Info("Stock %s = %f %s", sf.Stock, v, sf.Stock.Currency)
-			sf.considerValue(v)
-		}
+		sf.Lock()
+		sf.check()
+		sf.Unlock()
 		if config.General.ExactTiming {
 			t = t.Add(sleepTime) //.Nanoseconds()
 			sl := t.Sub(time.Now().UTC())
@@ -59,7 +62,24 @@ func (sf *StockFollower) run() {
 	}
 }
 
-func (sf *StockFollower) considerValue(value float32) {
+// Fetches the value of the stock and triggers its alerts
+func (sf *StockFollower) check() {
+	if m, err := getMarket(sf.Stock.Market); err == nil && !m.isOpen(time.Now()) {
+		log.Debug("Stock %s: the %s market is closed", sf.Stock, m.code)
+	} else if v, _, err := sf.Stock.GetValue(sf.store.Stocks); err != nil {
+		log.Warning("Stock %s: %v", sf.Stock.String(), err)
+	} else if now := time.Now().UTC().UnixNano(); v != 0 && sf.waitsForSplit(v, now) {
+		log.Info("Stock %s = %f %s, the alerts wait for the split to be confirmed", sf.Stock, v, sf.Stock.Currency)
+		sf.store.Values.SaveStockValue(sf.Stock, v, now)
+	} else {
+		log.Info("Stock %s = %f %s", sf.Stock, v, sf.Stock.Currency)
+		sf.considerValue(v)
+		sf.considerPositionAlerts(v)
+		sf.considerPortfolioAlerts()
+	}
+}
+
+func (sf *StockFollower) considerValue(value Decimal) {
 
 	now := time.Now().UTC().UnixNano()
 
@@ -68,27 +88,27 @@ func (sf *StockFollower) considerValue(value float32) {
 		return
 	}
 
-	db.SaveStockValue(sf.Stock, value, now)
-	for _, al := range *db.GetAlertsForStock(sf.Stock) {
+	sf.store.Values.SaveStockValue(sf.Stock, value, now)
+	for _, al := range *sf.store.Alerts.GetAlertsForStock(sf.Stock) {
 		if al.LastValue == 0 {
-			value = value * 0.5
+			value = value.Div(DecimalFromInt(2))
 			al.LastValue = value
 			al.LastTriggered = now
-			db.SaveAlert(&al)
+			sf.store.Alerts.SaveAlert(&al)
 
-			contact := db.GetContactFromId(al.Contact)
+			contact := sf.store.Contacts.GetContactFromId(al.Contact)
 			if contact == nil {
 				log.Info("Alert %d - Contact missing, deleting alert !", al.Id)
-				db.DeleteAlert(&al)
+				sf.store.Alerts.DeleteAlert(&al)
 			}
 
 			continue
 		}
 
 		diff := value - al.LastValue
-		per := diff / al.LastValue * 100
-		varPer := float32(math.Abs(float64(per)))
-		log.Info("Alert %s / %1.2f%%", al.String(), per)
+		per := diff.Div(al.LastValue).MulInt(100)
+		varPer := per.Abs()
+		log.Info("Alert %s / %1.2f%%", al.Format(sf.Stock), per)
 
 		var triggered bool
 		switch al.PercentDirection {
@@ -101,10 +121,10 @@ func (sf *StockFollower) considerValue(value float32) {
 		}
 
 		if triggered {
-			contact := db.GetContactFromId(al.Contact)
+			contact := sf.store.Contacts.GetContactFromId(al.Contact)
 			if contact == nil {
 				log.Info("Alert %d - Contact missing, deleting alert !", al.Id)
-				db.DeleteAlert(&al)
+				sf.store.Alerts.DeleteAlert(&al)
 				continue
 			}
 			if now < contact.PauseUntil {
@@ -124,27 +144,42 @@ func (sf *StockFollower) considerValue(value float32) {
 				message += " / " + sf.Stock.Url()
 			}
 
-			db.SaveAlert(&al)
+			sf.store.Alerts.SaveAlert(&al)
 
-			// We might be able to give some valuation data
-			if csv := db.GetContactStockValue(al.Contact, al.Stock); csv.Exists() {
-				cost := float32(csv.Nb) * csv.Value
-				value := float32(csv.Nb) * value
+			// We might be able to give some valuation data, the cost includes the fees and taxes
+			if position := getPosition(sf.store, contact, nil, sf.Stock); position.Nb > 0 {
+				cost := position.Cost
+				value := value.Mul(position.Nb)
 				diff := value - cost
-				per := diff / cost * 100
+				per := diff.Div(cost).MulInt(100)
 				message += fmt.Sprintf(" / %.3f - %.3f = %+.3f (%+.2f%%)", value, cost, diff, per)
 			}
 
-			xm.Send <- &SendChat{Remote: contact.Email, Text: message}
+			trigger := &AlertTrigger{
+				Alert:     al.Id,
+				Contact:   al.Contact,
+				Stock:     al.Stock,
+				Date:      now,
+				Value:     value,
+				Percent:   per,
+				Window:    int64(timeDiff),
+				Transport: TRANSPORT_XMPP,
+				Status:    TRIGGER_STATUS_QUEUED,
+			}
+			if err := sf.store.Triggers.SaveAlertTrigger(trigger); err != nil {
+				log.Error("Alert %d - Could not save trigger: %v", al.Id, err)
+			}
+
+			sf.send <- &SendChat{Remote: contact.Email, Text: message, Trigger: trigger.Id}
 		} else {
 			// If we have a duration, we might have to push the LastDate in the future
 			if al.Duration != 0 && now-al.LastDate > al.Duration {
 				startOfTimeWindow := now - al.Duration
-				if value, err := db.GetStockValue(sf.Stock, startOfTimeWindow); err == nil {
+				if value, err := sf.store.Values.GetStockValue(sf.Stock, startOfTimeWindow); err == nil {
 					al.LastDate = startOfTimeWindow
 					al.LastValue = value.Value
-					db.SaveAlert(&al)
-					log.Info("Alert %s: lastDate = %v, lastValue = %v", al.String(), time.Unix(0, al.LastDate), al.LastValue)
+					sf.store.Alerts.SaveAlert(&al)
+					log.Info("Alert %s: lastDate = %v, lastValue = %v", al.Format(sf.Stock), time.Unix(0, al.LastDate), al.LastValue)
 				} else {
 					log.Error("Cannot find rows for alert %v: %v", sf.Stock, err)
 				}
@@ -168,6 +203,8 @@ func (sf *StockFollower) String() string {
 type StocksMgmt struct {
 	sync.RWMutex
 	stocks map[string]*StockFollower
+	store  *Storage
+	send   chan interface{}
 }
 
 func httpGet(url string) (*http.Response, error) {
@@ -177,8 +214,15 @@ func httpGet(url string) (*http.Response, error) {
 	return r, e
 }
 
+// Boursorama sent us to its search page, it doesn't have the stock
+var errPageNotFound = errors.New("Not found !")
+
 func (this *Stock) PageContent() (body string, err error) {
-	resp, err := httpGet(this.Url())
+	url, err := this.pageUrl()
+	if err != nil {
+		return "", err
+	}
+	resp, err := httpGet(url)
 	if err != nil {
 		return "", err
 	}
@@ -190,7 +234,7 @@ func (this *Stock) PageContent() (body string, err error) {
 	finalUrl := resp.Request.URL.String()
 
 	if strings.Contains(finalUrl, "recherche") {
-		return "", errors.New(fmt.Sprintf("Not found !"))
+		return "", errPageNotFound
 	}
 
 	{ // We get the body
@@ -206,12 +250,17 @@ func (this *Stock) PageContent() (body string, err error) {
 
 func tryNewStock(market, short string) (*Stock, error) {
 	log.Debug("tryNewStock( \"%s\", \"%s\" );", market, short)
+	if _, err := getMarket(market); err != nil {
+		return nil, err
+	}
 	s := &Stock{Market: market, Short: short}
 
 	body, err := s.PageContent()
 
-	if err != nil {
-		return nil, errors.New(fmt.Sprintf("No \"%s\" on %s market !", short, market))
+	if err == errPageNotFound {
+		return nil, &noStockError{Market: market, Short: short}
+	} else if err != nil {
+		return nil, errors.New(fmt.Sprintf("Could not get \"%s\" on %s market: %s", short, market, err))
 	}
 
 	for _, re := range reName { // Second attempt for other quotations
@@ -224,6 +273,8 @@ func tryNewStock(market, short string) (*Stock, error) {
 		}
 	}
 
+	s.readIsin(body)
+
 	if len(s.Name) == 0 { // If we still couldn't get a name
 		// We will save the raw data for future testing
 		os.MkdirAll(TEMPDIR, 0755)
@@ -237,36 +288,137 @@ func tryNewStock(market, short string) (*Stock, error) {
 	return s, nil
 }
 
-var marketsToTest = [...]string{"FR", "AM", "US", "US2", "W", "BE"}
-
-func (s *Stock) boursoramaSymbol() (symbol string) {
-	switch s.Market {
-	case "US": // NASDAQ & NYSE
-		symbol = s.Short
-	case "US2": // XETRA ?
-		symbol = "1z" + s.Short
-	case "FR": // EURONEXT Paris
-		symbol = "1rP" + s.Short
-	case "AM": // EURONEXT Amsterdam
-		symbol = "1rA" + s.Short
-	case "W": // Warrants
-		symbol = "2rP" + s.Short
-	case "W2":
-		symbol = "3rP" + s.Short
-	case "BE": // EURONEXT Bruxelles
-		symbol = "FF11-" + s.Short
-	default:
-		log.Fatal("Unknown market: " + s.Market)
+// The market doesn't have the ticker, unlike the other errors of tryNewStock it doesn't change from a try to another
+type noStockError struct {
+	Market string
+	Short  string
+}
+
+func (e *noStockError) Error() string {
+	return fmt.Sprintf("No \"%s\" on %s market !", e.Short, e.Market)
+}
+
+// Position of a market in the ones we test, the other markets come last
+func marketRank(market string) int {
+	codes := marketsToTest()
+	for i, m := range codes {
+		if m == market {
+			return i
+		}
 	}
-	return
+	return len(codes)
+}
+
+var reIsin = regexp.MustCompile("^[A-Z]{2}[A-Z0-9]{9}[0-9]$")
+
+// Tells if a name is an ISIN: its last digit is the Luhn checksum of the other characters, with letters counting
+// from 10 ("A") to 35 ("Z")
+func isIsin(name string) bool {
+	if !reIsin.MatchString(name) {
+		return false
+	}
+	digits := ""
+	for _, r := range name[:11] {
+		if r >= 'A' && r <= 'Z' {
+			digits += strconv.Itoa(int(r-'A') + 10)
+		} else {
+			digits += string(r)
+		}
+	}
+	sum := 0
+	for i := 0; i < len(digits); i++ {
+		d := int(digits[len(digits)-1-i] - '0')
+		if i%2 == 0 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return (10-sum%10)%10 == int(name[11]-'0')
+}
+
+// Fills the ISIN of the stock from its page, the warrants have it as ticker
+func (s *Stock) readIsin(body string) bool {
+	if s.Isin != "" {
+		return false
+	}
+	if isIsin(s.Short) {
+		s.Isin = s.Short
+	} else if result := rePageIsin.FindStringSubmatch(body); len(result) > 1 && isIsin(result[1]) {
+		s.Isin = result[1]
+	}
+	return s.Isin != ""
+}
+
+// Listings of a company on the markets, linked by their ISIN. The first one is on the market we test first.
+func stockListings(repo StockRepository, isin string) []Stock {
+	if isin == "" {
+		return nil
+	}
+	stocks := *repo.GetStocksFromIsin(isin)
+	sort.SliceStable(stocks, func(i, j int) bool { return marketRank(stocks[i].Market) < marketRank(stocks[j].Market) })
+	return stocks
+}
+
+// Page of the stock on boursorama
+func (s *Stock) pageUrl() (string, error) {
+	if from, to, ok := s.currencyPair(); ok {
+		return fmt.Sprintf("http://www.boursorama.com/taux-de-change-x-%s-%s", from, to), nil
+	}
+	m, err := getMarket(s.Market)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("http://www.boursorama.com/cours.phtml?symbole=%s", m.symbol(s.Short)), nil
 }
 
 func (this *Stock) Url() string {
-	return fmt.Sprintf("http://www.boursorama.com/cours.phtml?symbole=%s", this.boursoramaSymbol())
+	url, _ := this.pageUrl()
+	return url
+}
+
+// Currency pairs are followed like stocks, their value is the rate given by the rate provider
+const MARKET_FX = "FX"
+
+var reCurrencyPair = regexp.MustCompile("^([A-Z]{3})/?([A-Z]{3})$")
+
+// Reads a currency pair: "EUR/USD" or "FX:EURUSD"
+func parseCurrencyPair(name string) (from, to string, ok bool) {
+	name = strings.ToUpper(name)
+	if strings.HasPrefix(name, MARKET_FX+":") {
+		name = name[len(MARKET_FX)+1:]
+	} else if !strings.Contains(name, "/") {
+		return "", "", false
+	}
+	if result := reCurrencyPair.FindStringSubmatch(name); len(result) == 3 && result[1] != result[2] {
+		return result[1], result[2], true
+	}
+	return "", "", false
+}
+
+func (s *Stock) currencyPair() (from, to string, ok bool) {
+	if s.Market != MARKET_FX {
+		return "", "", false
+	}
+	return parseCurrencyPair(s.Market + ":" + s.Short)
+}
+
+// Creates the stock of a currency pair, if the provider has its rate
+func tryNewCurrencyPair(from, to string) (*Stock, error) {
+	rate, err := providerRate(from, to)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("No rate for %s/%s: %s", from, to, err))
+	}
+	return &Stock{Market: MARKET_FX, Short: from + to, Name: from + "/" + to, Value: rate, Currency: to}, nil
 }
 
 func (s *Stock) fetchPage() (string, error) {
-	resp, err := httpGet(fmt.Sprintf("http://www.boursorama.com/cours.phtml?symbole=%s", s.boursoramaSymbol()))
+	url, err := s.pageUrl()
+	if err != nil {
+		return "", err
+	}
+	resp, err := httpGet(url)
 	if err != nil {
 		return "", err
 	}
@@ -291,15 +443,26 @@ func (s *Stock) fetchPage() (string, error) {
 	}
 }
 
-func (s *Stock) GetValue() (value float32, currency string, err error) {
+func (s *Stock) GetValue(repo StockRepository) (value Decimal, currency string, err error) {
+	if from, to, ok := s.currencyPair(); ok {
+		value, err = providerRate(from, to)
+		return value, to, err
+	}
+	if _, err = getMarket(s.Market); err != nil { // Not a failed fetch, the market might come back in the config
+		return
+	}
+
 	body, err := s.fetchPage()
 
 	save := false
+	if err == nil && s.readIsin(body) {
+		log.Info("Updating %v's ISIN", s)
+		save = true
+	}
 
 	result := reCotation.FindStringSubmatch(body)
 	if len(result) >= 2 {
-		v, _ := strconv.ParseFloat(strings.Replace(result[1], " ", "", -1), 32)
-		value = float32(v)
+		value, _ = ParseDecimal(strings.Replace(result[1], " ", "", -1))
 		currency = result[2]
 		if s.FailedFetches != 0 {
 			s.FailedFetches = 0
@@ -316,7 +479,7 @@ func (s *Stock) GetValue() (value float32, currency string, err error) {
 		log.Warning("Could not fetch cotation %s for the %dth time.", s, s.FailedFetches)
 		if s.FailedFetches > 1000 {
 			log.Info("Deleting stock %#v ...", s)
-			db.DeleteStock(s)
+			repo.DeleteStock(s)
 		} else {
 			save = true
 		}
@@ -336,61 +499,213 @@ func (s *Stock) GetValue() (value float32, currency string, err error) {
 
 	if save {
 		log.Info("Updating stock %#v ...", s)
-		db.SaveStock(s)
+		repo.SaveStock(s)
 	}
 
 	return
 }
 
-func NewStocksMgmt() *StocksMgmt {
-	sm := &StocksMgmt{stocks: make(map[string]*StockFollower)}
+func NewStocksMgmt(store *Storage, send chan interface{}) *StocksMgmt {
+	sm := &StocksMgmt{stocks: make(map[string]*StockFollower), store: store, send: send}
 
 	return sm
 }
 
 func (sm *StocksMgmt) getOrCreateStock(market, short string) (s *Stock, e error) {
-	s = db.GetStock(market, short)
-	if s == nil { // If we couldn't get it
+	s = sm.store.Stocks.GetStock(market, short)
+	if s == nil && market == MARKET_FX {
+		from, to, ok := parseCurrencyPair(market + ":" + short)
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("Invalid currency pair \"%s\"", short))
+		}
+		if s, e = tryNewCurrencyPair(from, to); s != nil {
+			e = sm.store.Stocks.SaveStock(s)
+		}
+	} else if s == nil { // If we couldn't get it
 		s, e = tryNewStock(market, short) // We try to get it
 		if s != nil {
-			s.Value, s.Currency, e = s.GetValue() // And we get the value
-			db.SaveStock(s)
+			s.Value, s.Currency, e = s.GetValue(sm.store.Stocks) // And we get the value
+			if m, err := getMarket(market); s.Currency == "" && err == nil {
+				s.Currency = m.Currency
+			}
+			sm.store.Stocks.SaveStock(s)
 		}
 	} else if s.Currency == "" {
-		_, s.Currency, _ = s.GetValue()
-		db.SaveStock(s)
+		_, s.Currency, _ = s.GetValue(sm.store.Stocks)
+		sm.store.Stocks.SaveStock(s)
 	}
 	return
 }
 
-func (sm *StocksMgmt) GetStock(short string) (s *Stock, e error) {
+// A ticker without market that is on several markets, the contact has to choose one
+type ambiguousStockError struct {
+	Short  string
+	Stocks []*Stock
+}
+
+func (e *ambiguousStockError) Error() string {
+	stocks := []string{}
+	for _, s := range e.Stocks {
+		stocks = append(stocks, s.String())
+	}
+	return fmt.Sprintf("\"%s\" is on several markets, use one of %s", e.Short, strings.Join(stocks, ", "))
+}
+
+// How long we remember what a market said about a ticker we don't follow
+const PROBE_CACHE_DURATION = time.Hour
+
+// Number of tickers and markets we remember at most
+const PROBE_CACHE_SIZE = 1000
+
+type probeResult struct {
+	stock *Stock // nil if the market doesn't have the ticker
+	err   error
+	date  time.Time
+}
+
+var (
+	probeCache     = make(map[string]*probeResult) // By market and ticker ("FR:RNO")
+	probeCacheLock sync.Mutex
+)
+
+// Looks for a ticker on the markets we test. The stocks we have are used and the markets where we don't have
+// the ticker are fetched, so that all the markets that have it are found. The fetched stocks aren't saved.
+func probeMarkets(store *Storage, short string) (found []*Stock, err error) {
+	for _, market := range marketsToTest() {
+		if s := store.Stocks.GetStock(market, short); s != nil {
+			found = append(found, s)
+		} else if s, e := probeMarket(market, short); s != nil {
+			found = append(found, s)
+		} else {
+			err = e
+		}
+	}
+	return
+}
+
+// Fetches a ticker on a market, or gives what the market said about it a moment ago. Only the answers of the
+// market are kept: the ticker is tried again after a failure.
+func probeMarket(market, short string) (*Stock, error) {
+	key := market + ":" + short
+	probeCacheLock.Lock()
+	r, ok := probeCache[key]
+	probeCacheLock.Unlock()
+	if ok && time.Since(r.date) < PROBE_CACHE_DURATION {
+		return r.stock, r.err
+	}
+
+	s, err := tryNewStock(market, short)
+	if _, noStock := err.(*noStockError); s == nil && !noStock {
+		return nil, err
+	}
+
+	probeCacheLock.Lock()
+	defer probeCacheLock.Unlock()
+	if len(probeCache) >= PROBE_CACHE_SIZE {
+		pruneProbeCache()
+	}
+	probeCache[key] = &probeResult{stock: s, err: err, date: time.Now()}
+	return s, err
+}
+
+// Removes the expired results, or the oldest one if they're all recent. It's called with the lock held.
+func pruneProbeCache() {
+	oldest := ""
+	for key, r := range probeCache {
+		if time.Since(r.date) >= PROBE_CACHE_DURATION {
+			delete(probeCache, key)
+		} else if oldest == "" || r.date.Before(probeCache[oldest].date) {
+			oldest = key
+		}
+	}
+	if len(probeCache) >= PROBE_CACHE_SIZE {
+		delete(probeCache, oldest)
+	}
+}
+
+// Market of a ticker given without market: the one the contact chose for it or the only one that has it
+func tickerMarket(store *Storage, c *Contact, short string) (string, error) {
+	if c != nil {
+		if p := store.Contacts.GetMarketPreference(c, short); p != nil {
+			return p.Market, nil
+		}
+	}
+	found, err := probeMarkets(store, short)
+	switch len(found) {
+	case 0:
+		return "", err
+	case 1:
+		return found[0].Market, nil
+	}
+	return "", &ambiguousStockError{Short: short, Stocks: found}
+}
+
+// Finds or creates a stock from its ticker, its market and ticker or its ISIN. The contact is optional, it tells
+// which market to use for the tickers that are on several of them.
+func (sm *StocksMgmt) GetStock(c *Contact, short string) (s *Stock, e error) {
 	short = strings.ToUpper(short)
+	if from, to, ok := parseCurrencyPair(short); ok {
+		return sm.getOrCreateStock(MARKET_FX, from+to)
+	}
 	tokens := strings.SplitN(short, ":", 2)
 
 	if len(tokens) == 2 { // Specific market stock
 		market := tokens[0]
 		short = tokens[1]
 		s, e = sm.getOrCreateStock(market, short)
+	} else if isIsin(short) {
+		s, e = sm.getStockFromIsin(short)
 	} else { // Unspecified market stock
-		for _, market := range marketsToTest { // We test all stocks
+		var market string
+		if market, e = tickerMarket(sm.store, c, short); e == nil {
 			s, e = sm.getOrCreateStock(market, short)
-			if s != nil {
-				break
+		}
+	}
+
+	return
+}
+
+// A stock given by its ISIN: a listing we already have, the first one the search finds or the stock that has it as
+// ticker (warrants)
+func (sm *StocksMgmt) getStockFromIsin(isin string) (s *Stock, e error) {
+	if listings := stockListings(sm.store.Stocks, isin); len(listings) > 0 {
+		return &listings[0], nil
+	}
+
+	if candidates, err := searchStocks(isin); err != nil {
+		log.Warning("Could not search %s: %v", isin, err)
+	} else {
+		for _, c := range candidates {
+			// A single result is the page of the stock, which doesn't give the ISIN of the candidate
+			if c.Isin != isin && len(candidates) > 1 {
+				continue
+			}
+			if s, e = sm.getOrCreateStock(c.Market, c.Short); s != nil {
+				if s.Isin == "" {
+					s.Isin = isin
+					sm.store.Stocks.SaveStock(s)
+				}
+				return
 			}
 		}
 	}
 
+	for _, market := range marketsToTest() {
+		if s, e = sm.getOrCreateStock(market, isin); s != nil {
+			break
+		}
+	}
 	return
 }
 
 func (sm *StocksMgmt) LoadStock(s *Stock) {
-	sf := NewStockFollower(s)
+	sf := NewStockFollower(s, sm.store, sm.send)
 	sf.Start()
 	sm.stocks[s.String()] = sf
 }
 
 func (sm *StocksMgmt) LoadStocks() (err error) {
-	stocks := db.GetAllStocks()
+	stocks := sm.store.Stocks.GetAllStocks()
 
 	for _, s := range *stocks {
 		log.Info("Loading %s...", s.String())
@@ -401,8 +716,8 @@ func (sm *StocksMgmt) LoadStocks() (err error) {
 	return nil
 }
 
-func (sm *StocksMgmt) SubscribeAlert(s *Stock, c *Contact, per float32, direction int, duration int64) (alert *Alert, err error) {
-	a, e := db.SubscribeAlert(s, c, per, direction, duration)
+func (sm *StocksMgmt) SubscribeAlert(s *Stock, c *Contact, per Decimal, direction int, duration int64) (alert *Alert, err error) {
+	a, e := sm.store.Alerts.SubscribeAlert(s, c, per, direction, duration)
 
 	sm.Lock()
 	if _, ok := sm.stocks[s.String()]; !ok {
@@ -414,7 +729,7 @@ func (sm *StocksMgmt) SubscribeAlert(s *Stock, c *Contact, per float32, directio
 }
 
 func (sm *StocksMgmt) UnsubscribeAlert(s *Stock, c *Contact) (err error) {
-	_, err = db.UnsubscribeAlert(s, c)
+	_, err = sm.store.Alerts.UnsubscribeAlert(s, c)
 
 	return
 }
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestAlertTrigger(t *testing.T) {
+	store := NewMemDB().Storage()
+	send := make(chan interface{}, 10)
+
+	s := &Stock{Market: "FR", Short: "RNO", Name: "RENAULT", Currency: "EUR"}
+	store.Stocks.SaveStock(s)
+	c := store.Contacts.GetContactFromEmail("florent@clairambault.fr/home")
+
+	a, err := store.Alerts.SubscribeAlert(s, c, DecimalFromInt(5), ALERT_DIRECTION_BOTH, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.LastValue = DecimalFromInt(100)
+	store.Alerts.SaveAlert(a)
+
+	sf := NewStockFollower(s, store, send)
+
+	sf.considerValue(DecimalFromInt(103))
+	if len(send) != 0 {
+		t.Fatal("The alert shouldn't have been triggered")
+	}
+
+	sf.considerValue(DecimalFromInt(94))
+	select {
+	case msg := <-send:
+		if chat := msg.(*SendChat); chat.Remote != "florent@clairambault.fr" {
+			t.Fatalf("Wrong remote: %s", chat.Remote)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The alert should have been triggered")
+	}
+
+	if a = &(*store.Alerts.GetAlertsForStock(s))[0]; a.LastValue != DecimalFromInt(94) {
+		t.Fatalf("Wrong last value: %f", a.LastValue)
+	}
+
+	if s := store.Stocks.GetStockFromId(s.Id); s.Value != DecimalFromInt(94) {
+		t.Fatalf("Wrong stock value: %f", s.Value)
+	}
+
+	if triggers := *store.Triggers.GetAlertTriggers(c, s, 0); len(triggers) != 1 {
+		t.Fatalf("We should have one trigger: %#v", triggers)
+	} else if tr := triggers[0]; tr.Alert != a.Id || tr.Value != DecimalFromInt(94) || tr.Status != TRIGGER_STATUS_QUEUED {
+		t.Fatalf("Wrong trigger: %#v", tr)
+	}
+}
+
+func TestCurrencyPairs(t *testing.T) {
+	for name, expected := range map[string]string{"eur/usd": "EUR/USD", "FX:EURUSD": "EUR/USD", "eurusd": "", "eur/eur": "", "eur/us": "", "FR:RNO": ""} {
+		from, to, ok := parseCurrencyPair(name)
+		if result := from + "/" + to; (ok && result != expected) || (!ok && expected != "") {
+			t.Fatalf("%s: %s instead of %s", name, result, expected)
+		}
+	}
+
+	store := NewMemDB().Storage()
+	sm := NewStocksMgmt(store, nil)
+	s, err := sm.GetStock(nil, "eur/usd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Id == 0 || s.Market != MARKET_FX || s.Short != "EURUSD" || s.Currency != "USD" || s.Value != DecimalFromFloat(1.0772) {
+		t.Fatalf("Wrong stock: %#v", s)
+	}
+	if s2, err := sm.GetStock(nil, "FX:EURUSD"); err != nil || s2.Id != s.Id {
+		t.Fatalf("The pair should have been found: %#v / %v", s2, err)
+	}
+	if _, err := sm.GetStock(nil, "eur/xof"); err == nil {
+		t.Fatal("There's no XOF rate")
+	}
+
+	// The ECB rates are given for one euro
+	if value, currency, err := (&Stock{Market: MARKET_FX, Short: "USDCHF"}).GetValue(store.Stocks); err != nil || currency != "CHF" || value != DecimalFromFloat(0.9767).Div(DecimalFromFloat(1.0772)) {
+		t.Fatalf("Wrong value: %v %s / %v", value, currency, err)
+	}
+}
+
+func TestIsin(t *testing.T) {
+	for _, isin := range []string{"FR0000131906", "US0378331005", "FR0011574110"} {
+		if !isIsin(isin) {
+			t.Fatalf("%s is an ISIN", isin)
+		}
+	}
+	for _, name := range []string{"FR0000131907", "RNO", "FR:RNO"} {
+		if isIsin(name) {
+			t.Fatalf("%s isn't an ISIN", name)
+		}
+	}
+
+	s := &Stock{Market: "FR", Short: "RNO"}
+	if !s.readIsin(`<h2 class="fv-isin">ISIN : <span>FR0000131906</span></h2>`) || s.Isin != "FR0000131906" {
+		t.Fatalf("Wrong ISIN: %s", s.Isin)
+	}
+	if w := (&Stock{Market: "W", Short: "FR0011574110"}); !w.readIsin("") || w.Isin != w.Short {
+		t.Fatalf("Wrong ISIN: %s", w.Isin)
+	}
+
+	// The listings are linked by their ISIN, the one of the market we test first is preferred
+	store := NewMemDB().Storage()
+	store.Stocks.SaveStock(&Stock{Market: "US2", Short: "RNL", Isin: "FR0000131906"})
+	store.Stocks.SaveStock(s)
+	store.Stocks.SaveStock(&Stock{Market: "US", Short: "AAPL", Isin: "US0378331005"})
+	if listings := stockListings(store.Stocks, "FR0000131906"); len(listings) != 2 || listings[0].Id != s.Id {
+		t.Fatalf("Wrong listings: %#v", listings)
+	}
+	for _, name := range []string{"fr0000131906", "rno", "fr:rno"} {
+		if found, err := findStoredStock(store, name); err != nil || found.Id != s.Id {
+			t.Fatalf("%s: %v / %v", name, found, err)
+		}
+	}
+}
+
+// Remembers what the markets said about a ticker, so that the tests don't fetch them
+func setProbes(short string, stocks ...*Stock) {
+	probeCacheLock.Lock()
+	defer probeCacheLock.Unlock()
+	for _, market := range marketsToTest() {
+		probeCache[market+":"+short] = &probeResult{err: &noStockError{Market: market, Short: short}, date: time.Now()}
+	}
+	for _, s := range stocks {
+		probeCache[s.Market+":"+short] = &probeResult{stock: s, date: time.Now()}
+	}
+}
+
+func TestTickerMarket(t *testing.T) {
+	store := NewMemDB().Storage()
+	store.Stocks.SaveStock(&Stock{Market: "FR", Short: "RNO", Name: "RENAULT", Currency: "EUR"})
+	setProbes("RNO", &Stock{Market: "US", Short: "RNO", Name: "RHINO RESOURCE PARTNERS LP"})
+
+	// The stock we have doesn't hide the other markets
+	if _, err := tickerMarket(store, nil, "RNO"); err == nil {
+		t.Fatal("RNO is on two markets")
+	} else if e, ok := err.(*ambiguousStockError); !ok || len(e.Stocks) != 2 || e.Stocks[0].Market != "FR" || e.Stocks[1].Market != "US" {
+		t.Fatalf("Wrong error: %v", err)
+	}
+
+	// The markets aren't fetched again for a ticker we just looked for
+	setProbes("ORA", &Stock{Market: "FR", Short: "ORA"})
+	if market, err := tickerMarket(store, nil, "ORA"); err != nil || market != "FR" {
+		t.Fatalf("Wrong market: %s / %v", market, err)
+	}
+	setProbes("XXXX")
+	if _, err := tickerMarket(store, nil, "XXXX"); err == nil {
+		t.Fatal("XXXX isn't on any market")
+	}
+}
+
+func TestProbeCachePruning(t *testing.T) {
+	probeCacheLock.Lock()
+	defer probeCacheLock.Unlock()
+	defer func(previous map[string]*probeResult) { probeCache = previous }(probeCache)
+
+	probeCache = make(map[string]*probeResult)
+	probeCache["FR:OLD"] = &probeResult{date: time.Now().Add(-PROBE_CACHE_DURATION)}
+	for i := 1; i < PROBE_CACHE_SIZE; i++ {
+		probeCache[fmt.Sprintf("FR:T%d", i)] = &probeResult{date: time.Now().Add(time.Duration(i) * time.Second)}
+	}
+	// The expired results leave enough room
+	pruneProbeCache()
+	if _, ok := probeCache["FR:OLD"]; ok || len(probeCache) != PROBE_CACHE_SIZE-1 {
+		t.Fatalf("Wrong cache size: %d", len(probeCache))
+	}
+	probeCache["FR:NEW"] = &probeResult{date: time.Now().Add(time.Hour)}
+	pruneProbeCache()
+	if _, ok := probeCache["FR:T1"]; ok || len(probeCache) != PROBE_CACHE_SIZE-1 {
+		t.Fatalf("The oldest result should be removed: %d", len(probeCache))
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+)
+
+// The stock followers and the command handlers only access the data through these repositories. FtsDB
+// implements all of them on top of SQLite, MemDB keeps everything in memory (which is handy for tests).
+
+type StockRepository interface {
+	GetStock(market, short string) *Stock
+	GetStockFromId(id int64) *Stock
+	GetStocksFromIsin(isin string) *[]Stock
+	GetAllStocks() *[]Stock
+	SaveStock(s *Stock) error
+	DeleteStock(s *Stock) error
+}
+
+type ContactRepository interface {
+	GetContactFromEmail(email string) *Contact
+	GetContactFromId(id int64) *Contact
+	SaveContact(c *Contact) error
+	DeleteContact(c *Contact) error
+	// Market the contact chose for a ticker given without market
+	GetMarketPreference(c *Contact, short string) *MarketPreference
+	SaveMarketPreference(p *MarketPreference) error
+}
+
+type AlertRepository interface {
+	GetAlertsForStock(s *Stock) *[]Alert
+	GetAlertsForContact(c *Contact) *[]Alert
+	SubscribeAlert(s *Stock, c *Contact, per Decimal, direction int, duration int64) (*Alert, error)
+	UnsubscribeAlert(s *Stock, c *Contact) (bool, error)
+	SaveAlert(a *Alert) error
+	DeleteAlert(a *Alert) error
+}
+
+type PositionAlertRepository interface {
+	GetPositionAlertsForStock(s *Stock) *[]PositionAlert
+	GetPositionAlertsForContact(c *Contact) *[]PositionAlert
+	SavePositionAlert(a *PositionAlert) error
+	DeletePositionAlert(a *PositionAlert) error
+}
+
+type TriggerRepository interface {
+	SaveAlertTrigger(t *AlertTrigger) error
+	SetAlertTriggerStatus(id int64, status string) error
+	// Triggers of a contact since a date, the stock is optional
+	GetAlertTriggers(c *Contact, s *Stock, since int64) *[]AlertTrigger
+}
+
+type ValueRepository interface {
+	SaveStockValue(stock *Stock, value Decimal, date int64) error
+	GetStockValue(stock *Stock, date int64) (*Value, error)
+	// Last value known at a date
+	GetStockValueAt(stock *Stock, date int64) (*Value, error)
+	GetStockValues(stock *Stock, from, to int64) *[]Value
+	AddStockValues(values []Value) error
+}
+
+type TransactionRepository interface {
+	GetTransaction(id int64) *Transaction
+	// Transactions of a contact, for all the portfolios if p is nil and all the stocks if s is nil, ordered by date
+	GetTransactions(c *Contact, p *Portfolio, s *Stock) *[]Transaction
+	SaveTransaction(t *Transaction) error
+	DeleteTransaction(t *Transaction) error
+}
+
+type PortfolioRepository interface {
+	GetPortfolios(c *Contact) *[]Portfolio
+	SavePortfolio(p *Portfolio) error
+	// Deletes a portfolio with its transactions and alerts
+	DeletePortfolio(p *Portfolio) error
+}
+
+type PortfolioAlertRepository interface {
+	GetPortfolioAlertsForContact(c *Contact) *[]PortfolioAlert
+	// Alerts of the portfolios that have transactions of a stock
+	GetPortfolioAlertsForStock(s *Stock) *[]PortfolioAlert
+	SavePortfolioAlert(a *PortfolioAlert) error
+	DeletePortfolioAlert(a *PortfolioAlert) error
+}
+
+type WatchlistRepository interface {
+	GetWatchlists(c *Contact) *[]Watchlist
+	SaveWatchlist(w *Watchlist) error
+	// Deletes a watchlist with its stocks, their alerts are kept
+	DeleteWatchlist(w *Watchlist) error
+	// Stocks of a watchlist, ordered by market and ticker
+	GetWatchlistStocks(w *Watchlist) *[]Stock
+	// Adds a stock to a watchlist, nothing changes if it's already there
+	AddWatchlistStock(w *Watchlist, s *Stock) error
+	RemoveWatchlistStock(w *Watchlist, s *Stock) error
+}
+
+type CorporateActionRepository interface {
+	// Actions of a stock, ordered by date
+	GetCorporateActions(s *Stock) *[]CorporateAction
+	// Saves the action and adjusts the values, the alerts and the transactions of its stock that are older than it
+	ApplyCorporateAction(a *CorporateAction) error
+}
+
+type ParameterRepository interface {
+	GetParameter(name string) *string
+	SetParameter(name, value string) error
+}
+
+type CurrencyRepository interface {
+	GetCurrencyConversion(from, to string) *CurrencyConversion
+	SaveCurrencyConversion(c *CurrencyConversion) error
+	DeleteCurrencyConversion(c *CurrencyConversion) error
+	// Rate of a pair on the day starting at date
+	GetDailyRate(from, to string, date int64) *DailyRate
+	SaveDailyRate(r *DailyRate) error
+}
+
+type IntegrityRepository interface {
+	// Looks for orphan rows and deletes them if repair is set
+	CheckIntegrity(repair bool) (*IntegrityReport, error)
+}
+
+// A backend providing all the repositories at once
+type StorageBackend interface {
+	StockRepository
+	ContactRepository
+	AlertRepository
+	PositionAlertRepository
+	TriggerRepository
+	ValueRepository
+	TransactionRepository
+	PortfolioRepository
+	PortfolioAlertRepository
+	WatchlistRepository
+	CorporateActionRepository
+	ParameterRepository
+	CurrencyRepository
+	IntegrityRepository
+	BackupRepository
+}
+
+type Storage struct {
+	Stocks          StockRepository
+	Contacts        ContactRepository
+	Alerts          AlertRepository
+	PositionAlerts  PositionAlertRepository
+	Triggers        TriggerRepository
+	Values          ValueRepository
+	Transactions    TransactionRepository
+	Portfolios      PortfolioRepository
+	PortfolioAlerts PortfolioAlertRepository
+	Watchlists      WatchlistRepository
+	Actions         CorporateActionRepository
+	Parameters      ParameterRepository
+	Currencies      CurrencyRepository
+	Integrity       IntegrityRepository
+	Backups         BackupRepository
+}
+
+func NewStorage(backend StorageBackend) *Storage {
+	return &Storage{
+		Stocks:          backend,
+		Contacts:        backend,
+		Alerts:          backend,
+		PositionAlerts:  backend,
+		Triggers:        backend,
+		Values:          backend,
+		Transactions:    backend,
+		Portfolios:      backend,
+		PortfolioAlerts: backend,
+		Watchlists:      backend,
+		Actions:         backend,
+		Parameters:      backend,
+		Currencies:      backend,
+		Integrity:       backend,
+		Backups:         backend,
+	}
+}
+
+// Describes an alert with the name of its stock
+func (st *Storage) AlertString(a *Alert) string {
+	return a.Format(st.Stocks.GetStockFromId(a.Stock))
+}
+
+// Rows of Table whose Column doesn't reference any row of Parent (which has a column of the same name)
+type OrphanCheck struct {
+	Table  string
+	Column string
+	Parent string
+}
+
+var orphanChecks = []OrphanCheck{
+	{Table: TABLE_ALERT, Column: "contact_id", Parent: TABLE_CONTACT},
+	{Table: TABLE_ALERT, Column: "stock_id", Parent: TABLE_STOCK},
+	{Table: TABLE_POSITION_ALERT, Column: "contact_id", Parent: TABLE_CONTACT},
+	{Table: TABLE_POSITION_ALERT, Column: "stock_id", Parent: TABLE_STOCK},
+	{Table: TABLE_PORTFOLIO, Column: "contact_id", Parent: TABLE_CONTACT},
+	{Table: TABLE_TRANSACTION, Column: "contact_id", Parent: TABLE_CONTACT},
+	{Table: TABLE_TRANSACTION, Column: "portfolio_id", Parent: TABLE_PORTFOLIO},
+	{Table: TABLE_TRANSACTION, Column: "stock_id", Parent: TABLE_STOCK},
+	{Table: TABLE_PORTFOLIO_ALERT, Column: "contact_id", Parent: TABLE_CONTACT},
+	{Table: TABLE_PORTFOLIO_ALERT, Column: "portfolio_id", Parent: TABLE_PORTFOLIO},
+	{Table: TABLE_VALUE, Column: "stock_id", Parent: TABLE_STOCK},
+	{Table: TABLE_ALERT_TRIGGER, Column: "contact_id", Parent: TABLE_CONTACT},
+	{Table: TABLE_ALERT_TRIGGER, Column: "stock_id", Parent: TABLE_STOCK},
+	{Table: TABLE_MARKET_PREFERENCE, Column: "contact_id", Parent: TABLE_CONTACT},
+	{Table: TABLE_WATCHLIST, Column: "contact_id", Parent: TABLE_CONTACT},
+	{Table: TABLE_WATCHLIST_STOCK, Column: "watchlist_id", Parent: TABLE_WATCHLIST},
+	{Table: TABLE_WATCHLIST_STOCK, Column: "stock_id", Parent: TABLE_STOCK},
+	{Table: TABLE_CORPORATE_ACTION, Column: "stock_id", Parent: TABLE_STOCK},
+}
+
+type IntegrityReport struct {
+	Orphans  map[OrphanCheck]int64
+	Repaired bool
+}
+
+func NewIntegrityReport(repair bool) *IntegrityReport {
+	return &IntegrityReport{Orphans: make(map[OrphanCheck]int64), Repaired: repair}
+}
+
+func (r *IntegrityReport) String() string {
+	str := ""
+	total := int64(0)
+	for _, check := range orphanChecks {
+		if nb := r.Orphans[check]; nb != 0 {
+			total += nb
+			str += fmt.Sprintf("\n%s: %d rows without %s", check.Table, nb, check.Parent)
+		}
+	}
+	if total == 0 {
+		return "No orphan found."
+	}
+	if r.Repaired {
+		str += fmt.Sprintf("\n%d orphans deleted.", total)
+	} else {
+		str += fmt.Sprintf("\n%d orphans found, use \"fsck repair\" to delete them.", total)
+	}
+	return str[1:]
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sales of a contact during a year, with their gains in the currency of the contact
+type TaxReport struct {
+	Year      int
+	Currency  string
+	Disposals []*taxDisposal
+	Missing   []string // Currencies we couldn't convert, their sales aren't in the totals
+	Cost      Decimal
+	Proceeds  Decimal
+	Fees      Decimal
+	Taxes     Decimal
+	Gain      Decimal
+}
+
+// A sale converted at the rate of its date
+type taxDisposal struct {
+	Disposal
+	Stock     *Stock
+	Portfolio string
+	Rate      Decimal // From the currency of the stock to the currency of the report, 0 if we don't know it
+}
+
+func (d *taxDisposal) convert(amount Decimal) Decimal {
+	return amount.Mul(d.Rate)
+}
+
+// Parses the year of a report, it can't be in the future
+func parseTaxYear(s string, now time.Time) (int, error) {
+	year, err := strconv.Atoi(s)
+	if err != nil || year < 1900 || year > now.UTC().Year() {
+		return 0, errors.New(fmt.Sprintf("Invalid year \"%s\"", s))
+	}
+	return year, nil
+}
+
+// Lists the sales of the year from all the transactions, as the cost of the shares sold depends on their purchases
+func computeTaxReport(store *Storage, c *Contact, year int) *TaxReport {
+	r := &TaxReport{Year: year, Currency: c.referenceCurrency()}
+	from := time.Date(year, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano()
+	to := time.Date(year+1, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano()
+
+	portfolios := make(map[int64]string)
+	for _, p := range *store.Portfolios.GetPortfolios(c) {
+		portfolios[p.Id] = p.Name
+	}
+	byKey := make(map[positionKey][]Transaction)
+	for _, t := range *store.Transactions.GetTransactions(c, nil, nil) {
+		key := positionKey{portfolio: t.Portfolio, stock: t.Stock}
+		byKey[key] = append(byKey[key], t)
+	}
+
+	converter := newCurrencyConverter(store.Currencies, r.Currency)
+	missing := make(map[string]bool)
+	for key, transactions := range byKey {
+		s := store.Stocks.GetStockFromId(key.stock)
+		if s == nil {
+			continue
+		}
+		for _, d := range computePosition(transactions, c.costMethod()).Disposals {
+			if d.Date < from || d.Date >= to {
+				continue
+			}
+			td := &taxDisposal{Disposal: d, Stock: s, Portfolio: portfolios[key.portfolio]}
+			td.Rate, _ = converter.convertAt(DECIMAL_UNIT, s.Currency, d.Date)
+			r.Disposals = append(r.Disposals, td)
+			if td.Rate == 0 {
+				missing[s.Currency] = true
+				continue
+			}
+			r.Cost += td.convert(d.Cost)
+			r.Proceeds += td.convert(d.Proceeds)
+			r.Fees += td.convert(d.Fees)
+			r.Taxes += td.convert(d.Taxes)
+			r.Gain += td.convert(d.Gain())
+		}
+	}
+	sort.Slice(r.Disposals, func(i, j int) bool {
+		if r.Disposals[i].Date != r.Disposals[j].Date {
+			return r.Disposals[i].Date < r.Disposals[j].Date
+		}
+		return r.Disposals[i].Transaction < r.Disposals[j].Transaction
+	})
+
+	for currency := range missing {
+		r.Missing = append(r.Missing, currency)
+	}
+	sort.Strings(r.Missing)
+	return r
+}
+
+// A line per sale and the totals
+func (r *TaxReport) Lines() []string {
+	lines := []string{}
+	for _, d := range r.Disposals {
+		line := fmt.Sprintf("%s %s @%s: %v shares, ", time.Unix(0, d.Date).UTC().Format("2006-01-02"), d.Stock.Symbol(), d.Portfolio, d.Nb)
+		if d.Rate == 0 {
+			line += fmt.Sprintf("gain %+.2f %s (no rate)", d.Gain(), d.Stock.Currency)
+		} else {
+			line += fmt.Sprintf("cost %.2f, proceeds %.2f, fees %.2f, taxes %.2f, gain %+.2f %s",
+				d.convert(d.Cost), d.convert(d.Proceeds), d.convert(d.Fees), d.convert(d.Taxes), d.convert(d.Gain()), r.Currency)
+			if d.Stock.Currency != "" && d.Stock.Currency != r.Currency {
+				line += fmt.Sprintf(" (%s at %v)", d.Stock.Currency, d.Rate)
+			}
+		}
+		lines = append(lines, line)
+	}
+	total := fmt.Sprintf("%d: %d sales, cost %.2f, proceeds %.2f, fees %.2f, taxes %.2f, gain %+.2f %s",
+		r.Year, len(r.Disposals), r.Cost, r.Proceeds, r.Fees, r.Taxes, r.Gain, r.Currency)
+	if len(r.Missing) > 0 {
+		total += fmt.Sprintf(", without the sales in %s", strings.Join(r.Missing, ", "))
+	}
+	return append(lines, total)
+}
+
+type disposalRecord struct {
+	Date      string  `json:"date"`
+	Stock     string  `json:"stock"`
+	Name      string  `json:"name"`
+	Portfolio string  `json:"portfolio"`
+	Nb        Decimal `json:"nb"`
+	Cost      Decimal `json:"cost"`
+	Proceeds  Decimal `json:"proceeds"`
+	Fees      Decimal `json:"fees"`
+	Taxes     Decimal `json:"taxes"`
+	Gain      Decimal `json:"gain"`
+	Currency  string  `json:"currency"`
+	Rate      Decimal `json:"rate"` // From the currency of the stock, the amounts aren't converted without it
+}
+
+func (r *disposalRecord) csvHeader() []string {
+	return []string{"date", "stock", "name", "portfolio", "nb", "cost", "proceeds", "fees", "taxes", "gain", "currency", "rate"}
+}
+
+func (r *disposalRecord) csvRow() []string {
+	return []string{r.Date, r.Stock, r.Name, r.Portfolio, fmt.Sprint(r.Nb), fmt.Sprint(r.Cost), fmt.Sprint(r.Proceeds),
+		fmt.Sprint(r.Fees), fmt.Sprint(r.Taxes), fmt.Sprint(r.Gain), r.Currency, fmt.Sprint(r.Rate)}
+}
+
+func exportTaxReport(r *TaxReport) []exportRecord {
+	records := []exportRecord{}
+	for _, d := range r.Disposals {
+		record := &disposalRecord{
+			Date:      formatExportDate(d.Date),
+			Stock:     d.Stock.Symbol(),
+			Name:      d.Stock.Name,
+			Portfolio: d.Portfolio,
+			Nb:        d.Nb,
+			Cost:      d.Cost,
+			Proceeds:  d.Proceeds,
+			Fees:      d.Fees,
+			Taxes:     d.Taxes,
+			Gain:      d.Gain(),
+			Currency:  d.Stock.Currency,
+			Rate:      d.Rate,
+		}
+		if d.Rate != 0 {
+			record.Cost, record.Proceeds = d.convert(d.Cost), d.convert(d.Proceeds)
+			record.Fees, record.Taxes, record.Gain = d.convert(d.Fees), d.convert(d.Taxes), d.convert(d.Gain())
+			record.Currency = r.Currency
+		}
+		records = append(records, record)
+	}
+	return records
+}
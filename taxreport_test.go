@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTaxReport(t *testing.T) {
+	store := NewMemDB().Storage()
+	store.Currencies.SaveCurrencyConversion(&CurrencyConversion{From: "USD", To: "EUR", Rate: DecimalFromFloat(0.8), LastUpdate: time.Now().UTC().UnixNano()})
+	rno := &Stock{Market: "FR", Short: "RNO", Currency: "EUR"}
+	store.Stocks.SaveStock(rno)
+	aapl := &Stock{Market: "US", Short: "AAPL", Currency: "USD"}
+	store.Stocks.SaveStock(aapl)
+	c := store.Contacts.GetContactFromEmail("florent@clairambault.fr")
+	p, _ := defaultPortfolio(store, c)
+
+	date := func(s string) int64 {
+		d, _ := time.Parse("2006-01-02", s)
+		return d.UnixNano()
+	}
+	// Sales are converted at the rate of their day
+	store.Currencies.SaveDailyRate(&DailyRate{From: "USD", To: "EUR", Date: date("2024-05-10"), Rate: DecimalFromFloat(0.9)})
+	for _, tx := range []Transaction{
+		{Stock: rno.Id, Date: date("2023-03-01"), Type: TRANSACTION_BUY, Nb: DecimalFromInt(10), Price: DecimalFromInt(40), Fees: DecimalFromInt(2)},
+		{Stock: rno.Id, Date: date("2023-06-01"), Type: TRANSACTION_SELL, Nb: DecimalFromInt(2), Price: DecimalFromInt(45)},
+		{Stock: rno.Id, Date: date("2024-02-01"), Type: TRANSACTION_SELL, Nb: DecimalFromInt(4), Price: DecimalFromInt(50), Fees: DecimalFromInt(1), Taxes: DecimalFromInt(1)},
+		{Stock: aapl.Id, Date: date("2024-01-10"), Type: TRANSACTION_BUY, Nb: DecimalFromInt(5), Price: DecimalFromInt(100)},
+		{Stock: aapl.Id, Date: date("2024-05-10"), Type: TRANSACTION_SELL, Nb: DecimalFromInt(5), Price: DecimalFromInt(120)},
+	} {
+		tx.Contact, tx.Portfolio = c.Id, p.Id
+		store.Transactions.SaveTransaction(&tx)
+	}
+
+	r := computeTaxReport(store, c, 2024)
+	if len(r.Disposals) != 2 || r.Disposals[0].Stock.Id != rno.Id {
+		t.Fatalf("Wrong disposals: %#v", r.Disposals)
+	}
+	// 4 shares of RNO cost 4 * 40.2 = 160.8 and are sold 200 - 2, 5 shares of AAPL make 100 USD
+	if r.Cost != DecimalFromFloat(610.8) || r.Proceeds != DecimalFromInt(740) || r.Gain != DecimalFromFloat(127.2) {
+		t.Fatalf("Wrong totals: %v", r.Lines())
+	}
+	if line := r.Lines()[1]; !strings.Contains(line, "gain +90.00 EUR (USD at 0.9)") {
+		t.Fatalf("Wrong line: %s", line)
+	}
+
+	buffer := &bytes.Buffer{}
+	if err := writeExport(buffer, EXPORT_FORMAT_CSV, exportTaxReport(r)); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(buffer.String()), "\n"); len(lines) != 3 || lines[1] != "2024-02-01T00:00:00Z,FR:RNO,,main,4,160.8,200,1,1,37.2,EUR,1" {
+		t.Fatalf("Wrong export: %s", buffer)
+	}
+
+	if _, err := parseTaxYear("2100", time.Now()); err == nil {
+		t.Fatal("The year is in the future")
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+func checkWatchlistName(name string) error {
+	if name == "" || strings.HasPrefix(name, "@") || strings.ContainsAny(name, " \t") {
+		return errors.New(fmt.Sprintf("Invalid watchlist name \"%s\"", name))
+	}
+	return nil
+}
+
+func findWatchlist(store *Storage, c *Contact, name string) (*Watchlist, error) {
+	for _, w := range *store.Watchlists.GetWatchlists(c) {
+		if w.Name == name {
+			return &w, nil
+		}
+	}
+	return nil, errors.New(fmt.Sprintf("Unknown watchlist \"%s\"", name))
+}
+
+// Alert rule of the watchlist, empty if it doesn't have any
+func (w *Watchlist) rule() string {
+	if w.Percent == 0 {
+		return ""
+	}
+	return formatAlertRule(w.Percent, w.PercentDirection, w.Duration)
+}
+
+func (w *Watchlist) String() string {
+	str := w.Name
+	if rule := w.rule(); rule != "" {
+		str += " (alert " + rule + ")"
+	}
+	return str
+}
+
+// Alert of a contact on a stock, nil if there's none
+func contactAlert(store *Storage, c *Contact, s *Stock) *Alert {
+	for _, al := range *store.Alerts.GetAlertsForContact(c) {
+		if al.Stock == s.Id {
+			return &al
+		}
+	}
+	return nil
+}
+
+// Tells if an alert is the one of the watchlist, the alerts with another rule were defined on their own
+func (w *Watchlist) owns(al *Alert) bool {
+	return w.Percent != 0 && al.Percent == w.Percent && al.PercentDirection == w.PercentDirection && al.Duration == w.Duration
+}
+
+// Adds stocks to a watchlist, they get its alert rule. The stocks that already have an alert of their own keep it,
+// they are returned.
+func addToWatchlist(store *Storage, sm *StocksMgmt, c *Contact, w *Watchlist, stocks []*Stock) (kept []*Stock, err error) {
+	for _, s := range stocks {
+		if err = store.Watchlists.AddWatchlistStock(w, s); err != nil {
+			return
+		}
+		if w.Percent == 0 {
+			continue
+		}
+		if al := contactAlert(store, c, s); al != nil {
+			if !w.owns(al) {
+				kept = append(kept, s)
+			}
+			continue
+		}
+		if _, err = sm.SubscribeAlert(s, c, w.Percent, w.PercentDirection, w.Duration); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Sets the alert rule of a watchlist and subscribes it for all its stocks, a percent of 0 unsubscribes them. Only the
+// alerts of the previous rule are replaced, the stocks that have an alert of their own keep it and are returned.
+func setWatchlistAlert(store *Storage, sm *StocksMgmt, c *Contact, w *Watchlist, per Decimal, direction int, duration int64) (kept []*Stock, err error) {
+	previous := *w
+	w.Percent, w.PercentDirection, w.Duration = per, direction, duration
+	if err = store.Watchlists.SaveWatchlist(w); err != nil {
+		return
+	}
+	for _, s := range *store.Watchlists.GetWatchlistStocks(w) {
+		stock := s
+		al := contactAlert(store, c, &stock)
+		if al != nil && !previous.owns(al) {
+			kept = append(kept, &stock)
+			continue
+		}
+		if per == 0 {
+			if al != nil {
+				err = sm.UnsubscribeAlert(&stock, c)
+			}
+		} else {
+			_, err = sm.SubscribeAlert(&stock, c, per, direction, duration)
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Start of the day in the timezone of the market of the stock
+func (s *Stock) dayStart(now time.Time) int64 {
+	location := time.UTC
+	if m, err := getMarket(s.Market); err == nil && m.location != nil {
+		location = m.location
+	}
+	now = now.In(location)
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, location).UnixNano()
+}
+
+// A line per stock with its last value and its change since the last value of the previous day
+func watchlistTable(store *Storage, w *Watchlist, now time.Time) []string {
+	stocks := *store.Watchlists.GetWatchlistStocks(w)
+	lines := []string{fmt.Sprintf("%s: %d stocks", w, len(stocks))}
+	for _, s := range stocks {
+		name := s.Name
+		if len(name) > 20 {
+			name = name[:20]
+		}
+		line := fmt.Sprintf("%-10s %-20s %10.3f %-3s", s.Symbol(), name, s.Value, s.Currency)
+		if previous, err := store.Values.GetStockValueAt(&s, s.dayStart(now)); err == nil && previous.Value != 0 {
+			line += fmt.Sprintf(" %+7.2f%%", (s.Value - previous.Value).Div(previous.Value).MulInt(100))
+		} else {
+			line += "       n/a"
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWatchlist(t *testing.T) {
+	store := NewMemDB().Storage()
+	rno := &Stock{Market: "FR", Short: "RNO", Name: "RENAULT", Currency: "EUR"}
+	store.Stocks.SaveStock(rno)
+	psa := &Stock{Market: "FR", Short: "PSA", Name: "PEUGEOT", Currency: "EUR"}
+	store.Stocks.SaveStock(psa)
+	c := store.Contacts.GetContactFromEmail("florent@clairambault.fr")
+
+	// The stocks are already followed, we don't want to fetch them
+	sm := NewStocksMgmt(store, nil)
+	for _, s := range []*Stock{rno, psa} {
+		sm.stocks[s.String()] = NewStockFollower(s, store, nil)
+	}
+
+	w := &Watchlist{Contact: c.Id, Name: "autos"}
+	store.Watchlists.SaveWatchlist(w)
+	if _, err := addToWatchlist(store, sm, c, w, []*Stock{rno}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := setWatchlistAlert(store, sm, c, w, DecimalFromInt(5), ALERT_DIRECTION_DOWN, 0); err != nil {
+		t.Fatal(err)
+	}
+	// The new stocks get the alert of the watchlist
+	if _, err := addToWatchlist(store, sm, c, w, []*Stock{psa}); err != nil {
+		t.Fatal(err)
+	}
+	alerts := *store.Alerts.GetAlertsForContact(c)
+	if len(alerts) != 2 || alerts[1].Stock != psa.Id || alerts[1].Percent != DecimalFromInt(5) || alerts[1].PercentDirection != ALERT_DIRECTION_DOWN {
+		t.Fatalf("Wrong alerts: %#v", alerts)
+	}
+
+	now := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+	store.Values.SaveStockValue(psa, DecimalFromInt(20), now.Add(-20*time.Hour).UnixNano())
+	store.Values.SaveStockValue(psa, DecimalFromInt(21), now.Add(-2*time.Hour).UnixNano())
+	lines := watchlistTable(store, w, now)
+	if len(lines) != 3 || lines[0] != "autos (alert -5.00%): 2 stocks" {
+		t.Fatalf("Wrong table: %v", lines)
+	}
+	if !strings.HasPrefix(lines[1], "FR:PSA") || !strings.HasSuffix(lines[1], "+5.00%") || !strings.HasSuffix(lines[2], "n/a") {
+		t.Fatalf("Wrong table: %v", lines)
+	}
+
+	if _, err := setWatchlistAlert(store, sm, c, w, 0, ALERT_DIRECTION_BOTH, 0); err != nil {
+		t.Fatal(err)
+	}
+	if alerts := *store.Alerts.GetAlertsForContact(c); len(alerts) != 0 {
+		t.Fatalf("Wrong alerts: %#v", alerts)
+	}
+
+	// The alerts defined on their own are kept
+	ora := &Stock{Market: "FR", Short: "ORA", Name: "ORANGE", Currency: "EUR"}
+	store.Stocks.SaveStock(ora)
+	sm.stocks[ora.String()] = NewStockFollower(ora, store, nil)
+	if _, err := sm.SubscribeAlert(ora, c, DecimalFromInt(2), ALERT_DIRECTION_BOTH, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := setWatchlistAlert(store, sm, c, w, DecimalFromInt(5), ALERT_DIRECTION_DOWN, 0); err != nil {
+		t.Fatal(err)
+	}
+	if kept, err := addToWatchlist(store, sm, c, w, []*Stock{ora}); err != nil || len(kept) != 1 || kept[0].Id != ora.Id {
+		t.Fatalf("Wrong kept stocks: %v / %v", kept, err)
+	}
+	if kept, err := setWatchlistAlert(store, sm, c, w, 0, ALERT_DIRECTION_BOTH, 0); err != nil || len(kept) != 1 {
+		t.Fatalf("Wrong kept stocks: %v / %v", kept, err)
+	}
+	if alerts := *store.Alerts.GetAlertsForContact(c); len(alerts) != 1 || alerts[0].Stock != ora.Id || alerts[0].Percent != DecimalFromInt(2) {
+		t.Fatalf("Wrong alerts: %#v", alerts)
+	}
+
+	// The stocks go with the watchlist
+	store.Contacts.DeleteContact(c)
+	if stocks := *store.Watchlists.GetWatchlistStocks(w); len(stocks) != 0 {
+		t.Fatalf("Wrong stocks: %#v", stocks)
+	}
+}
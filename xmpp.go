@@ -1,10 +1,12 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"github.com/mattn/go-xmpp"
 	"math"
+	"path"
 	"strconv"
 	"strings"
 	"time"
@@ -17,20 +19,90 @@ type FtsXmpp struct {
 	StartTime    time.Time
 	lastRcvdData time.Time
 	checkTicker  *time.Ticker
+	store        *Storage
+	stocks       *StocksMgmt
+	choices      map[string]*stockChoice // Stocks the contacts have to choose from, by address
 }
 
+// A command waiting for the contact to choose between the markets of a ticker
+type stockChoice struct {
+	text   string
+	short  string
+	stocks []*Stock
+}
+
+// Exports bigger than this can only be sent as a link
+const MAX_INLINE_EXPORT = 32 * 1024
+
 type SendChat struct {
 	Remote, Text string
+	Trigger      int64 // Alert trigger whose delivery status we must update
 }
 
-func NewFtsXmpp() *FtsXmpp {
+func NewFtsXmpp(store *Storage) *FtsXmpp {
 	return &FtsXmpp{
+		store:        store,
 		Recv:         make(chan interface{}, 10),
 		Send:         make(chan interface{}, 10),
 		StartTime:    time.Now().UTC(),
 		checkTicker:  time.NewTicker(time.Minute * 5),
 		lastRcvdData: time.Now().UTC(),
+		choices:      make(map[string]*stockChoice),
+	}
+}
+
+func isAdmin(remote string) bool {
+	email := strings.SplitN(remote, "/", 2)[0]
+	for _, admin := range config.Xmpp.Admin {
+		if strings.EqualFold(admin, email) {
+			return true
+		}
+	}
+	return false
+}
+
+// Address of the contact, without the resource
+func bareAddress(remote string) string {
+	return strings.ToLower(strings.SplitN(remote, "/", 2)[0])
+}
+
+// Gets a stock for a contact, who might have chosen a market for its ticker
+func (x *FtsXmpp) getStock(remote, name string) (*Stock, error) {
+	return x.stocks.GetStock(x.store.Contacts.GetContactFromEmail(remote), name)
+}
+
+// Asks the contact to choose one of the markets of a ticker, the answer comes in the next message
+func (x *FtsXmpp) askStockChoice(remote, text string, ambiguous *ambiguousStockError) {
+	x.choices[bareAddress(remote)] = &stockChoice{text: text, short: ambiguous.Short, stocks: ambiguous.Stocks}
+	lines := []string{fmt.Sprintf("\"%s\" is on several markets, answer with the number of the one you want:", ambiguous.Short)}
+	for i, s := range ambiguous.Stocks {
+		line := fmt.Sprintf("%d. %s", i+1, s)
+		if m, err := getMarket(s.Market); err == nil {
+			line += " - " + m.Label
+		}
+		lines = append(lines, line)
+	}
+	x.sendLines(remote, lines)
+}
+
+// Remembers the market the contact chose for the ticker and runs the command again
+func (x *FtsXmpp) chooseStock(v *xmpp.Chat, choice *stockChoice, n int) error {
+	if n < 1 || n > len(choice.stocks) {
+		x.choices[bareAddress(v.Remote)] = choice
+		return errors.New(fmt.Sprintf("Answer with a number between 1 and %d", len(choice.stocks)))
+	}
+	contact := x.store.Contacts.GetContactFromEmail(v.Remote)
+	if contact == nil {
+		return errors.New("Could not get contact !")
+	}
+	stock := choice.stocks[n-1]
+	if err := x.store.Contacts.SaveMarketPreference(&MarketPreference{Contact: contact.Id, Short: choice.short, Market: stock.Market}); err != nil {
+		return err
 	}
+	x.Send <- &SendChat{Remote: v.Remote, Text: fmt.Sprintf("\"%s\" is now %s for you", choice.short, stock.Symbol())}
+
+	v.Text = choice.text
+	return x.handle_chat(v)
 }
 
 func (x *FtsXmpp) handle_chat(v *xmpp.Chat) (err error) {
@@ -38,6 +110,15 @@ func (x *FtsXmpp) handle_chat(v *xmpp.Chat) (err error) {
 		return nil
 	}
 
+	// Any other message than a number cancels the choice
+	if choice, ok := x.choices[bareAddress(v.Remote)]; ok {
+		delete(x.choices, bareAddress(v.Remote))
+		if n, err := strconv.Atoi(strings.TrimSpace(v.Text)); err == nil {
+			return x.chooseStock(v, choice, n)
+		}
+	}
+
+	original := v.Text
 	v.Text = strings.ToLower(strings.TrimSpace(v.Text))
 
 	tokens := strings.SplitN(v.Text, " ", -1)
@@ -64,15 +145,73 @@ s <stock> (+|-)<per> (<duration>) - Subscribe to variation about a stock (Ex: "s
 
 u <stock> - Unsubscribe from a stock (Ex: "u rno")
 
-g <stock> - Get data about a stock (Ex: "g rno")
+Currency pairs can be followed like stocks (Ex: "s eur/usd 1", "u eur/usd")
+
+When a ticker is on several markets, answer with the number of the one you want, it's remembered for your next commands
+
+fx <amount> <from> <to> - Convert an amount (Ex: "fx 100 eur usd")
+
+g <stock> - Get data about a stock, by ticker or ISIN (Ex: "g rno", "g fr0000131906")
+
+find <text> - Look for a stock by name, ticker or ISIN on all the markets (Ex: "find renault")
 
 ls - List currently monitored stocks
 
+wl - List your watchlists
+
+wl add|del <name> <stock> ... - Add stocks to a watchlist or remove them (Ex: "wl add autos rno psa"), "wl del <name>" deletes it
+
+wl show <name> - Show the values of the stocks of a watchlist with their daily change
+
+wl alert <name> (+|-)<per> (<duration>)|off - Subscribe to variations of all the stocks of a watchlist, including the ones added later (Ex: "wl alert autos -3 24h")
+
+markets - List the markets
+
+history (<stock>) (<period>) - List the alerts you received (Ex: "history", "history rno 30d")
+
 v - Get the value of our stocks
 
 v <stock> - Get the value of a particular stock
 
-v <stock> <nb> (<cost>) - Register the number of shares and the cost of a particular stock
+v @<portfolio> - Get the value of the stocks of a portfolio
+
+pf - List your portfolios
+
+pf create|delete|default <name> - Create, delete or choose the default portfolio (Ex: "pf create pea")
+
+pf rename <name> <new name> - Rename a portfolio
+
+buy|sell <stock> <nb> <price> (<fees> (<taxes>)) (<date>) (@<portfolio>) - Register a transaction, the number of shares can be a fraction (Ex: "buy rno 10 45.2 4.9 2024-01-15 @pea", "buy cw8 0.35 480 0 0.5")
+
+tx (<stock>) (@<portfolio>) - List your transactions
+
+tx del <id> - Delete a transaction
+
+pos <stock> -<per>|+<per> - Get an alert when the price of a stock is a percentage below or above what your shares cost (Ex: "pos rno -15", "pos rno +30")
+
+pos <stock> trail <per> - Get an alert when the price of a stock goes a percentage below its high since you bought it (Ex: "pos rno trail 10")
+
+pos - List your position alerts, "pos del <id>" deletes one
+
+pa (@<portfolio>) (+|-)<per> (<duration>) - Get an alert when the value of a portfolio changes (Ex: "pa @pea -5 7d")
+
+pa (@<portfolio>) dd <per> - Get an alert when a portfolio loses more than a percentage from its peak (Ex: "pa @pea dd 10")
+
+pa - List your portfolio alerts, "pa del <id>" deletes one
+
+perf (1d|1w|1m|ytd|all) - Get the gains and the returns of your shares over a period (Ex: "perf ytd")
+
+taxreport <year> (csv|json) - List your sales of a year with their cost, proceeds, fees and gain in your currency (Ex: "taxreport 2024", "taxreport 2024 csv")
+
+currency (<currency>) - Set the currency of your totals (Ex: "currency usd")
+
+cost (avg|fifo) - Compute the cost of your shares with their average price or first in, first out
+
+import statement (<profile>) (@<portfolio>) (dry) - Import the transactions of a broker statement pasted on the next lines, "dry" only shows what would change
+
+export values <stock> (<period>) (csv|json) - Export the values of a stock (Ex: "export values rno 30d")
+
+export alerts|holdings (csv|json) - Export your alerts or your stocks values
 
 pause <days> - Pause alerts for X days (Ex: "pause 30")
 
@@ -89,7 +228,7 @@ ping <data> - Ping test
 		}
 	case "me":
 		{
-			contact := db.GetContactFromEmail(v.Remote)
+			contact := x.store.Contacts.GetContactFromEmail(v.Remote)
 			x.Send <- &SendChat{Remote: v.Remote, Text: fmt.Sprintf("You are contact %d (%s)", contact.Id, contact.Email)}
 		}
 	case "g":
@@ -98,14 +237,50 @@ ping <data> - Ping test
 				return errors.New("No stock provided !")
 			}
 			short := tokens[1]
-			stock, err := stocks.GetStock(short)
+			stock, err := x.getStock(v.Remote, short)
 			if err == nil {
-				value, _, _ := stock.GetValue()
-				x.Send <- &SendChat{Remote: v.Remote, Text: fmt.Sprintf("Stock %s : %.3f %s", stock, value, stock.Currency)}
+				value, _, _ := stock.GetValue(x.store.Stocks)
+				text := fmt.Sprintf("Stock %s : %.3f %s", stock, value, stock.Currency)
+				if stock.Isin != "" { // The other markets of the company
+					text += " / ISIN " + stock.Isin
+					others := []string{}
+					for _, listing := range stockListings(x.store.Stocks, stock.Isin) {
+						if listing.Id != stock.Id {
+							others = append(others, listing.Symbol())
+						}
+					}
+					if len(others) > 0 {
+						text += ", also on " + strings.Join(others, ", ")
+					}
+				}
+				x.Send <- &SendChat{Remote: v.Remote, Text: text}
+			} else if _, ok := err.(*ambiguousStockError); ok {
+				return err
 			} else {
 				x.Send <- &SendChat{Remote: v.Remote, Text: fmt.Sprintf("Could not find stock \"%s\".", short)}
 			}
 		}
+	case "find":
+		{
+			if len(tokens) < 2 {
+				return errors.New("Usage: find <text> (Ex: \"find renault\")")
+			}
+
+			candidates, err := searchStocks(strings.Join(tokens[1:], " "))
+			if err != nil {
+				return err
+			}
+			if len(candidates) == 0 {
+				return errors.New("Nothing found !")
+			}
+
+			lines := []string{}
+			for i, c := range candidates {
+				lines = append(lines, fmt.Sprintf("%d. %s", i+1, c))
+			}
+			lines = append(lines, "Use the market and the ticker to follow one (Ex: \"s "+strings.ToLower(candidates[0].Market+":"+candidates[0].Short)+" 5\")")
+			x.sendLines(v.Remote, lines)
+		}
 	case "s":
 		{
 			if len(tokens) < 3 {
@@ -113,40 +288,26 @@ ping <data> - Ping test
 			}
 			short := tokens[1]
 
-			stock, err := stocks.GetStock(short)
+			stock, err := x.getStock(v.Remote, short)
 
-			if err != nil {
+			if _, ok := err.(*ambiguousStockError); ok {
+				return err
+			} else if err != nil {
 				return errors.New(fmt.Sprintf("Could not find the stock \"%s\".", short))
 			}
 
-			contact := db.GetContactFromEmail(v.Remote)
+			contact := x.store.Contacts.GetContactFromEmail(v.Remote)
 
 			if contact == nil {
 				return errors.New("Could not get contact !")
 			}
 
-			value := tokens[2]
-
-			// We remove the "%" if there's one
-			value = strings.SplitN(value, "%", 2)[0]
-
-			per, err := strconv.ParseFloat(value, 32)
+			per, direction, err := parsePercent(tokens[2])
 
 			if err != nil {
 				return err
 			}
 
-			per = math.Abs(per)
-			var direction int
-			switch value[0] {
-			case '-':
-				direction = ALERT_DIRECTION_DOWN
-			case '+':
-				direction = ALERT_DIRECTION_UP
-			default:
-				direction = ALERT_DIRECTION_BOTH
-			}
-
 			duration := int64(0)
 
 			if len(tokens) >= 4 { // For duration
@@ -157,12 +318,12 @@ ping <data> - Ping test
 				}
 			}
 
-			alert, err := stocks.SubscribeAlert(stock, contact, float32(per), direction, duration)
+			alert, err := x.stocks.SubscribeAlert(stock, contact, per, direction, duration)
 			if err != nil {
 				return err
 			}
 
-			message := fmt.Sprintf("Defined alert %s", alert.String())
+			message := fmt.Sprintf("Defined alert %s", alert.Format(stock))
 			x.Send <- &SendChat{Remote: v.Remote, Text: message}
 
 		}
@@ -174,19 +335,19 @@ ping <data> - Ping test
 
 			short := tokens[1]
 
-			stock, err := stocks.GetStock(short)
+			stock, err := x.getStock(v.Remote, short)
 
 			if err != nil {
 				return err
 			}
 
-			contact := db.GetContactFromEmail(v.Remote)
+			contact := x.store.Contacts.GetContactFromEmail(v.Remote)
 
 			if contact == nil {
 				return errors.New("Could not get contact !")
 			}
 
-			err = stocks.UnsubscribeAlert(stock, contact)
+			err = x.stocks.UnsubscribeAlert(stock, contact)
 
 			if err != nil {
 				return err
@@ -198,7 +359,7 @@ ping <data> - Ping test
 	case "l":
 	case "ls":
 		{
-			c := db.GetContactFromEmail(v.Remote)
+			c := x.store.Contacts.GetContactFromEmail(v.Remote)
 
 			if c == nil {
 				return errors.New("Could not get contact !")
@@ -206,15 +367,15 @@ ping <data> - Ping test
 			i := 0
 			msg := ""
 			//log.Println("Contact", c)
-			for _, al := range *db.GetAlertsForContact(c) {
+			for _, al := range *x.store.Alerts.GetAlertsForContact(c) {
 				//log.Println(al)
 				i++
-				s := db.GetStockFromId(al.Stock)
+				s := x.store.Stocks.GetStockFromId(al.Stock)
 				if s == nil {
-					db.DeleteAlert(&al)
+					x.store.Alerts.DeleteAlert(&al)
 					continue
 				}
-				msg += fmt.Sprintf("\n%s", al.String())
+				msg += fmt.Sprintf("\n%s", al.Format(s))
 
 				if i%config.Xmpp.LinesPerMessage == 0 {
 					x.Send <- &SendChat{Remote: v.Remote, Text: msg}
@@ -228,178 +389,675 @@ ping <data> - Ping test
 				x.Send <- &SendChat{Remote: v.Remote, Text: msg}
 			}
 		}
+	case "history":
+		{
+			contact := x.store.Contacts.GetContactFromEmail(v.Remote)
+			if contact == nil {
+				return errors.New("Could not get contact !")
+			}
+
+			var stock *Stock
+			period := time.Hour * 24 * 7
+			for _, token := range tokens[1:] {
+				if d, err := parseDuration(token); err == nil {
+					period = d
+				} else if stock, err = x.stocks.GetStock(contact, token); err != nil {
+					return err
+				}
+			}
+
+			since := time.Now().UTC().Add(-period)
+			i := 0
+			msg := ""
+			for _, t := range *x.store.Triggers.GetAlertTriggers(contact, stock, since.UnixNano()) {
+				i++
+				s := x.store.Stocks.GetStockFromId(t.Stock)
+				msg += fmt.Sprintf("\n%s %s : %.3f (%+.2f%%) in %v [%s: %s]",
+					time.Unix(0, t.Date).UTC().Format("2006-01-02 15:04"), s, t.Value, t.Percent, time.Duration(t.Window), t.Transport, t.Status)
+
+				if i%config.Xmpp.LinesPerMessage == 0 {
+					x.Send <- &SendChat{Remote: v.Remote, Text: msg}
+					msg = ""
+				}
+			}
+			if i == 0 {
+				x.Send <- &SendChat{Remote: v.Remote, Text: fmt.Sprintf("No alert since %s.", since.Format("2006-01-02 15:04"))}
+			}
+			if msg != "" {
+				x.Send <- &SendChat{Remote: v.Remote, Text: msg}
+			}
+		}
 	case "v":
 		{
 
 			// We get the contact
-			contact := db.GetContactFromEmail(v.Remote)
+			contact := x.store.Contacts.GetContactFromEmail(v.Remote)
 			if contact == nil {
 				return errors.New("Could not get contact !")
 			}
 
-			if len(tokens) > 1 {
-				// We get the stock
-				stock, err := stocks.GetStock(tokens[1])
-				if err != nil {
+			tokens, name := portfolioArgument(tokens)
+			var portfolio *Portfolio
+			if name != "" {
+				if portfolio, err = findPortfolio(x.store, contact, name); err != nil {
 					return err
 				}
+			}
 
-				save := false
-
-				csv := db.GetContactStockValue(contact.Id, stock.Id)
+			var stock *Stock
+			if len(tokens) > 2 {
+				return errors.New("Shares are now registered with the \"buy\" and \"sell\" commands")
+			} else if len(tokens) == 2 {
+				if stock, err = x.stocks.GetStock(contact, tokens[1]); err != nil {
+					return err
+				}
+			}
 
-				if len(tokens) >= 3 {
-					v, err := strconv.ParseInt(tokens[2], 10, 32)
-					if err != nil {
-						return err
-					}
-					csv.Nb = int32(v)
-					if csv.Nb > 0 {
-						save = true
-					} else {
-						db.DeleteContactStockValue(csv)
-					}
+			// With several portfolios, each one gets its own total
+			portfolios := []*Portfolio{portfolio}
+			if all := *x.store.Portfolios.GetPortfolios(contact); portfolio == nil && len(all) > 1 {
+				portfolios = nil
+				for i := range all {
+					portfolios = append(portfolios, &all[i])
 				}
+			}
 
-				if len(tokens) >= 4 {
-					v, err := strconv.ParseFloat(tokens[3], 32)
-					if err != nil {
-						return err
-					}
-					csv.Value = float32(v)
+			lines := []string{}
+			for _, p := range portfolios {
+				positions, total := describePositions(x.store, contact, getPositions(x.store, contact, p, stock))
+				if len(positions) == 0 {
+					continue
+				}
+				if len(portfolios) > 1 {
+					lines = append(lines, fmt.Sprintf("Portfolio %s:", p.Name))
 				}
+				lines = append(lines, positions...)
+				lines = append(lines, total)
+			}
 
-				if save {
-					if err := db.SaveContactStockValue(csv); err != nil {
-						return err
-					}
+			if len(lines) == 0 {
+				x.Send <- &SendChat{Remote: v.Remote, Text: "You don't have any shares."}
+				return nil
+			}
+			if len(portfolios) > 1 {
+				_, total := describePositions(x.store, contact, getPositions(x.store, contact, nil, stock))
+				lines = append(lines, "All portfolios, "+strings.ToLower(total[:1])+total[1:])
+			}
+			x.sendLines(v.Remote, lines)
+		}
+	case "buy", "sell":
+		{
+			tokens, name := portfolioArgument(tokens)
+			if len(tokens) < 4 {
+				return errors.New(fmt.Sprintf("Usage: %s <stock> <nb> <price> (<fees> (<taxes>)) (<date>) (@<portfolio>)", cmd))
+			}
 
-					x.Send <- &SendChat{Remote: v.Remote, Text: fmt.Sprintf("Saved %s with %d x %.02f = %.02f %s [%d]", stock, csv.Nb, csv.Value, (float32(csv.Nb) * csv.Value), stock.Currency, csv.Id)}
-				}
+			contact := x.store.Contacts.GetContactFromEmail(v.Remote)
+			if contact == nil {
+				return errors.New("Could not get contact !")
 			}
 
-			{ // We send the the message
-				i := 0
-				msg := ""
-				totalCost := float32(0)
-				totalValue := float32(0)
-				for _, csv := range *db.GetContactStockValuesFromContact(contact) {
-					s := db.GetStockFromId(csv.Stock)
-					if s == nil {
-						db.DeleteContactStockValue(&csv)
-						continue
-					}
+			var portfolio *Portfolio
+			if name != "" {
+				portfolio, err = findPortfolio(x.store, contact, name)
+			} else {
+				portfolio, err = defaultPortfolio(x.store, contact)
+			}
+			if err != nil {
+				return err
+			}
+
+			stock, err := x.stocks.GetStock(contact, tokens[1])
+			if err != nil {
+				return err
+			}
 
-					i++
+			t := &Transaction{Contact: contact.Id, Portfolio: portfolio.Id, Stock: stock.Id, Date: time.Now().UTC().UnixNano(), Type: cmd, Currency: stock.Currency}
+			if t.Nb, err = parsePrice(tokens[2]); err != nil || t.Nb <= 0 {
+				return errors.New(fmt.Sprintf("Invalid number of shares \"%s\"", tokens[2]))
+			}
+			if t.Price, err = parsePrice(tokens[3]); err != nil {
+				return err
+			}
+			if t.Price <= 0 {
+				return errors.New(fmt.Sprintf("Invalid price \"%s\"", tokens[3]))
+			}
+			// The first amount is the fees, the second one the taxes
+			amounts := []*Decimal{&t.Fees, &t.Taxes}
+			for _, arg := range tokens[4:] {
+				if date, err := parseExportDate(arg); err == nil {
+					t.Date = date
+				} else if len(amounts) == 0 {
+					return errors.New(fmt.Sprintf("Unexpected argument \"%s\"", arg))
+				} else if *amounts[0], err = parsePrice(arg); err != nil {
+					return err
+				} else {
+					amounts = amounts[1:]
+				}
+			}
 
-					cost := float32(csv.Nb) * csv.Value
-					value := float32(csv.Nb) * s.Value
+			if t.Type == TRANSACTION_SELL {
+				if position := getPosition(x.store, contact, portfolio, stock); t.Nb > position.Nb {
+					return errors.New(fmt.Sprintf("You only have %v shares of %s in %s", position.Nb, stock, portfolio.Name))
+				}
+			}
 
-					totalCost += cost
-					totalValue += value
+			if err := x.store.Transactions.SaveTransaction(t); err != nil {
+				return err
+			}
 
-					diff := value - cost
-					per := diff * 100 / cost
+			position := getPosition(x.store, contact, portfolio, stock)
+			x.Send <- &SendChat{Remote: v.Remote, Text: fmt.Sprintf("%s [%d], you now have %v shares at %.03f %s in %s", t.Format(stock), t.Id, position.Nb, position.Price(), stock.Currency, portfolio.Name)}
+		}
+	case "tx":
+		{
+			contact := x.store.Contacts.GetContactFromEmail(v.Remote)
+			if contact == nil {
+				return errors.New("Could not get contact !")
+			}
 
-					msg += fmt.Sprintf(
-						"\n%s, %d shares, value: %.03f / %.03f, total: %.03f - %.03f = %+.03f %s (%+.02f%%)",
-						s.String(), csv.Nb, s.Value, csv.Value, value, cost, diff, s.Currency, per)
+			if len(tokens) == 3 && tokens[1] == "del" {
+				id, err := strconv.ParseInt(tokens[2], 10, 64)
+				if err != nil {
+					return err
+				}
+				t := x.store.Transactions.GetTransaction(id)
+				if t == nil || t.Contact != contact.Id {
+					return errors.New(fmt.Sprintf("Unknown transaction %d", id))
+				}
+				if err := x.store.Transactions.DeleteTransaction(t); err != nil {
+					return err
+				}
+				x.Send <- &SendChat{Remote: v.Remote, Text: fmt.Sprintf("Transaction %d deleted.", id)}
+				return nil
+			}
 
-					if i%config.Xmpp.LinesPerMessage == 0 {
-						x.Send <- &SendChat{Remote: v.Remote, Text: msg}
-						msg = ""
-					}
+			tokens, name := portfolioArgument(tokens)
+			var portfolio *Portfolio
+			if name != "" {
+				if portfolio, err = findPortfolio(x.store, contact, name); err != nil {
+					return err
+				}
+			}
 
+			var stock *Stock
+			if len(tokens) >= 2 {
+				if stock, err = x.stocks.GetStock(contact, tokens[1]); err != nil {
+					return err
 				}
-				if i == 0 {
-					x.Send <- &SendChat{Remote: v.Remote, Text: "You didn't register any stock value."}
-				} else {
-					totalDiff := totalValue - totalCost
-					per := totalDiff * 100 / totalCost
-					msg += fmt.Sprintf("\nTotal: %.03f - %.03f = %+.03f %s (%+.02f%%)", totalValue, totalCost, totalDiff, "EUR", per)
+			}
+
+			i := 0
+			msg := ""
+			for _, t := range *x.store.Transactions.GetTransactions(contact, portfolio, stock) {
+				s := x.store.Stocks.GetStockFromId(t.Stock)
+				if s == nil {
+					continue
+				}
+				i++
+				msg += fmt.Sprintf("\n[%d] %s", t.Id, t.Format(s))
+
+				if i%config.Xmpp.LinesPerMessage == 0 {
+					x.Send <- &SendChat{Remote: v.Remote, Text: msg}
+					msg = ""
 				}
+			}
+			if i == 0 {
+				x.Send <- &SendChat{Remote: v.Remote, Text: "You didn't register any transaction."}
+			}
+			if msg != "" {
 				x.Send <- &SendChat{Remote: v.Remote, Text: msg}
 			}
-
 		}
-	case "pause":
+	case "pf":
 		{
-			if len(tokens) != 2 {
-				return errors.New("You have to specify a number of days !")
-			}
-			contact := db.GetContactFromEmail(v.Remote)
-
+			contact := x.store.Contacts.GetContactFromEmail(v.Remote)
 			if contact == nil {
 				return errors.New("Could not get contact !")
 			}
 
-			var nb int64
-			nb, err = strconv.ParseInt(tokens[1], 10, 64)
+			if len(tokens) >= 2 {
+				if err := x.handlePortfolioCommand(contact, tokens[1:]); err != nil {
+					return err
+				}
+			}
 
-			if err != nil {
+			if _, err := defaultPortfolio(x.store, contact); err != nil {
 				return err
 			}
-
-			contact.PauseUntil = time.Now().UTC().UnixNano() + time.Hour.Nanoseconds()*24*nb
-
-			db.SaveContact(contact)
-
-			x.Send <- &SendChat{Remote: v.Remote, Text: fmt.Sprintf("OK, no alert for %d days.", nb)}
+			msg := "Your portfolios:"
+			for _, p := range *x.store.Portfolios.GetPortfolios(contact) {
+				msg += "\n" + p.Name
+				if p.Default {
+					msg += " (default)"
+				}
+			}
+			x.Send <- &SendChat{Remote: v.Remote, Text: msg}
 		}
-	case "resume":
+	case "pos":
 		{
-			contact := db.GetContactFromEmail(v.Remote)
-
+			contact := x.store.Contacts.GetContactFromEmail(v.Remote)
 			if contact == nil {
 				return errors.New("Could not get contact !")
 			}
 
-			contact.PauseUntil = 0
+			if len(tokens) >= 2 {
+				if err := x.handlePositionAlertCommand(contact, tokens[1:]); err != nil {
+					return err
+				}
+			}
 
-			db.SaveContact(contact)
-			x.Send <- &SendChat{Remote: v.Remote, Text: "OK, back to work !"}
+			lines := []string{}
+			for _, al := range *x.store.PositionAlerts.GetPositionAlertsForContact(contact) {
+				s := x.store.Stocks.GetStockFromId(al.Stock)
+				if s == nil {
+					continue
+				}
+				line := al.Format(s)
+				if al.Cost != 0 {
+					line += fmt.Sprintf(": %.3f %s", al.threshold(), s.Currency)
+				}
+				lines = append(lines, line)
+			}
+			if len(lines) == 0 {
+				x.Send <- &SendChat{Remote: v.Remote, Text: "You don't have any position alert."}
+			} else {
+				x.sendLines(v.Remote, lines)
+			}
 		}
-	case "url":
-	case "nourl":
+	case "pa":
 		{
-			contact := db.GetContactFromEmail(v.Remote)
+			contact := x.store.Contacts.GetContactFromEmail(v.Remote)
 			if contact == nil {
 				return errors.New("Could not get contact !")
 			}
 
-			contact.ShowUrl = (cmd == "!url")
-			db.SaveContact(contact)
-			x.Send <- &SendChat{Remote: v.Remote, Text: fmt.Sprintf("OK (ShowUrl=%v)", contact.ShowUrl)}
+			if len(tokens) >= 2 {
+				if err := x.handlePortfolioAlertCommand(contact, tokens[1:]); err != nil {
+					return err
+				}
+			}
+
+			portfolios := make(map[int64]*Portfolio)
+			for _, p := range *x.store.Portfolios.GetPortfolios(contact) {
+				portfolio := p
+				portfolios[p.Id] = &portfolio
+			}
+			lines := []string{}
+			for _, al := range *x.store.PortfolioAlerts.GetPortfolioAlertsForContact(contact) {
+				lines = append(lines, al.Format(portfolios[al.Portfolio]))
+			}
+			if len(lines) == 0 {
+				x.Send <- &SendChat{Remote: v.Remote, Text: "You don't have any portfolio alert."}
+			} else {
+				x.sendLines(v.Remote, lines)
+			}
 		}
-	case "forgetme":
+	case "wl":
 		{
-			contact := db.GetContactFromEmail(v.Remote)
-
+			contact := x.store.Contacts.GetContactFromEmail(v.Remote)
 			if contact == nil {
 				return errors.New("Could not get contact !")
 			}
 
-			x.Send <- &SendChat{Remote: v.Remote, Text: "Who are you ?"}
+			if len(tokens) >= 2 {
+				return x.handleWatchlistCommand(v.Remote, contact, tokens[1:])
+			}
 
-			db.DeleteContact(contact)
+			lines := []string{}
+			for _, w := range *x.store.Watchlists.GetWatchlists(contact) {
+				lines = append(lines, fmt.Sprintf("%s: %d stocks", &w, len(*x.store.Watchlists.GetWatchlistStocks(&w))))
+			}
+			if len(lines) == 0 {
+				x.Send <- &SendChat{Remote: v.Remote, Text: "You don't have any watchlist."}
+			} else {
+				x.sendLines(v.Remote, lines)
+			}
 		}
-	case "uptime":
+	case "perf":
 		{
-			diff := time.Now().UTC().Sub(x.StartTime)
-			diff -= diff % time.Second
-			x.Send <- &SendChat{Remote: v.Remote, Text: fmt.Sprintf("Uptime: %s", diff)}
+			contact := x.store.Contacts.GetContactFromEmail(v.Remote)
+			if contact == nil {
+				return errors.New("Could not get contact !")
+			}
+
+			period := "all"
+			if len(tokens) >= 2 {
+				period = tokens[1]
+			}
+
+			perf, err := computePerformance(x.store, contact, period, time.Now())
+			if err != nil {
+				return err
+			}
+
+			x.Send <- &SendChat{Remote: v.Remote, Text: perf.String()}
 		}
-	case "quit":
+	case "markets":
 		{
-			x.Send <- &SendChat{Remote: v.Remote, Text: "Bye bye!"}
-			time.Sleep(time.Second * 5)
-			waitForRc <- 1
+			lines := []string{}
+			for _, code := range marketCodes() {
+				lines = append(lines, markets[code].String())
+			}
+			x.sendLines(v.Remote, lines)
 		}
-	case "version":
+	case "fx":
 		{
-			x.Send <- &SendChat{Remote: v.Remote, Text: "version = " + FTS_VERSION}
-		}
-	case "what?":
+			if len(tokens) != 4 {
+				return errors.New("Usage: fx <amount> <from> <to> (Ex: \"fx 100 eur usd\")")
+			}
+
+			amount, err := parsePrice(tokens[1])
+			if err != nil {
+				return err
+			}
+			from, to := strings.ToUpper(tokens[2]), strings.ToUpper(tokens[3])
+
+			rate := CurrencyRate(x.store.Currencies, from, to)
+			if rate == 0 {
+				return errors.New(fmt.Sprintf("Could not get the %s/%s rate", from, to))
+			}
+
+			x.Send <- &SendChat{Remote: v.Remote, Text: fmt.Sprintf("%v %s = %.2f %s (1 %s = %v %s)", amount, from, amount.Mul(rate), to, from, rate, to)}
+		}
+	case "taxreport":
+		{
+			if len(tokens) < 2 || len(tokens) > 3 {
+				return errors.New("Usage: taxreport <year> (csv|json)")
+			}
+
+			contact := x.store.Contacts.GetContactFromEmail(v.Remote)
+			if contact == nil {
+				return errors.New("Could not get contact !")
+			}
+
+			year, err := parseTaxYear(tokens[1], time.Now())
+			if err != nil {
+				return err
+			}
+
+			report := computeTaxReport(x.store, contact, year)
+			if len(tokens) == 3 {
+				return x.sendExport(v.Remote, fmt.Sprintf("taxreport_%d_%s", year, contact.Email), tokens[2], exportTaxReport(report))
+			}
+			x.sendLines(v.Remote, report.Lines())
+		}
+	case "currency":
+		{
+			contact := x.store.Contacts.GetContactFromEmail(v.Remote)
+			if contact == nil {
+				return errors.New("Could not get contact !")
+			}
+
+			if len(tokens) == 2 {
+				currency := strings.ToUpper(tokens[1])
+				if len(currency) != 3 {
+					return errors.New(fmt.Sprintf("Invalid currency \"%s\"", tokens[1]))
+				}
+				// The totals would ignore all the stocks
+				if CurrencyRate(x.store.Currencies, CURRENCY_PIVOT, currency) == 0 {
+					return errors.New(fmt.Sprintf("Unknown currency \"%s\", we don't have its rate", tokens[1]))
+				}
+				contact.Currency = currency
+				if err := x.store.Contacts.SaveContact(contact); err != nil {
+					return err
+				}
+			}
+
+			x.Send <- &SendChat{Remote: v.Remote, Text: fmt.Sprintf("Your totals are in %s", contact.referenceCurrency())}
+		}
+	case "cost":
+		{
+			contact := x.store.Contacts.GetContactFromEmail(v.Remote)
+			if contact == nil {
+				return errors.New("Could not get contact !")
+			}
+
+			if len(tokens) == 2 {
+				if tokens[1] != COST_METHOD_AVERAGE && tokens[1] != COST_METHOD_FIFO {
+					return errors.New(fmt.Sprintf("Unknown method \"%s\" (%s or %s)", tokens[1], COST_METHOD_AVERAGE, COST_METHOD_FIFO))
+				}
+				contact.CostMethod = tokens[1]
+				if err := x.store.Contacts.SaveContact(contact); err != nil {
+					return err
+				}
+			}
+
+			x.Send <- &SendChat{Remote: v.Remote, Text: fmt.Sprintf("Cost method: %s", contact.costMethod())}
+		}
+	case "export":
+		{
+			if len(tokens) < 2 {
+				return errors.New("What do you want to export (values, alerts or holdings) ?")
+			}
+
+			contact := x.store.Contacts.GetContactFromEmail(v.Remote)
+			if contact == nil {
+				return errors.New("Could not get contact !")
+			}
+
+			args := tokens[2:]
+			format := EXPORT_FORMAT_CSV
+			if n := len(args); n > 0 && (args[n-1] == EXPORT_FORMAT_CSV || args[n-1] == EXPORT_FORMAT_JSON) {
+				format = args[n-1]
+				args = args[:n-1]
+			}
+
+			var records []exportRecord
+			var name string
+			switch tokens[1] {
+			case "values":
+				if len(args) < 1 {
+					return errors.New("No stock provided !")
+				}
+				stock, err := x.stocks.GetStock(contact, args[0])
+				if err != nil {
+					return err
+				}
+				from := int64(0)
+				if len(args) >= 2 {
+					period, err := parseDuration(args[1])
+					if err != nil {
+						return err
+					}
+					from = time.Now().UTC().Add(-period).UnixNano()
+				}
+				name = "values_" + stock.Symbol()
+				records = exportValues(x.store, stock, from, math.MaxInt64)
+			case "alerts":
+				name = "alerts_" + contact.Email
+				records = exportAlerts(x.store, contact)
+			case "holdings":
+				name = "holdings_" + contact.Email
+				records = exportHoldings(x.store, contact)
+			default:
+				return errors.New(fmt.Sprintf("Cannot export \"%s\" (values, alerts or holdings)", tokens[1]))
+			}
+
+			return x.sendExport(v.Remote, name, format, records)
+		}
+	case "pause":
+		{
+			if len(tokens) != 2 {
+				return errors.New("You have to specify a number of days !")
+			}
+			contact := x.store.Contacts.GetContactFromEmail(v.Remote)
+
+			if contact == nil {
+				return errors.New("Could not get contact !")
+			}
+
+			var nb int64
+			nb, err = strconv.ParseInt(tokens[1], 10, 64)
+
+			if err != nil {
+				return err
+			}
+
+			contact.PauseUntil = time.Now().UTC().UnixNano() + time.Hour.Nanoseconds()*24*nb
+
+			x.store.Contacts.SaveContact(contact)
+
+			x.Send <- &SendChat{Remote: v.Remote, Text: fmt.Sprintf("OK, no alert for %d days.", nb)}
+		}
+	case "resume":
+		{
+			contact := x.store.Contacts.GetContactFromEmail(v.Remote)
+
+			if contact == nil {
+				return errors.New("Could not get contact !")
+			}
+
+			contact.PauseUntil = 0
+
+			x.store.Contacts.SaveContact(contact)
+			x.Send <- &SendChat{Remote: v.Remote, Text: "OK, back to work !"}
+		}
+	case "url":
+	case "nourl":
+		{
+			contact := x.store.Contacts.GetContactFromEmail(v.Remote)
+			if contact == nil {
+				return errors.New("Could not get contact !")
+			}
+
+			contact.ShowUrl = (cmd == "!url")
+			x.store.Contacts.SaveContact(contact)
+			x.Send <- &SendChat{Remote: v.Remote, Text: fmt.Sprintf("OK (ShowUrl=%v)", contact.ShowUrl)}
+		}
+	case "forgetme":
+		{
+			contact := x.store.Contacts.GetContactFromEmail(v.Remote)
+
+			if contact == nil {
+				return errors.New("Could not get contact !")
+			}
+
+			x.Send <- &SendChat{Remote: v.Remote, Text: "Who are you ?"}
+
+			x.store.Contacts.DeleteContact(contact)
+		}
+	case "uptime":
+		{
+			diff := time.Now().UTC().Sub(x.StartTime)
+			diff -= diff % time.Second
+			x.Send <- &SendChat{Remote: v.Remote, Text: fmt.Sprintf("Uptime: %s", diff)}
+		}
+	case "fsck":
+		{
+			if !isAdmin(v.Remote) {
+				return errors.New("You're not allowed to do that !")
+			}
+
+			report, err := x.store.Integrity.CheckIntegrity(len(tokens) >= 2 && tokens[1] == "repair")
+			if err != nil {
+				return err
+			}
+
+			x.Send <- &SendChat{Remote: v.Remote, Text: report.String()}
+		}
+	case "import":
+		{
+			if len(tokens) > 1 && strings.HasPrefix(tokens[1], "statement") {
+				return x.handleStatementImport(v.Remote, original)
+			}
+			if !isAdmin(v.Remote) {
+				return errors.New("You're not allowed to do that !")
+			}
+
+			// The original text is used because the file name might not be in lower case
+			args := strings.Fields(strings.TrimSpace(original))[1:]
+			if len(args) < 3 || args[0] != "values" {
+				return errors.New("Usage: import values <stock> <file> (<currency>)")
+			}
+
+			stock, err := x.getStock(v.Remote, args[1])
+			if err != nil {
+				return err
+			}
+
+			currency := ""
+			if len(args) >= 4 {
+				currency = args[3]
+			}
+
+			result, err := importValuesFile(x.store, stock, args[2], currency)
+			if err != nil {
+				return err
+			}
+
+			x.Send <- &SendChat{Remote: v.Remote, Text: fmt.Sprintf("%s: %s", stock, result)}
+		}
+	case "split":
+		{
+			if !isAdmin(v.Remote) {
+				return errors.New("You're not allowed to do that !")
+			}
+			if len(tokens) < 2 || len(tokens) > 4 {
+				return errors.New("Usage: split <stock> (<new>:<old> (<date>)|ignore)")
+			}
+
+			stock, err := x.getStock(v.Remote, tokens[1])
+			if err != nil {
+				return err
+			}
+
+			hold := x.stocks.splitHold(stock)
+			if len(tokens) == 2 {
+				lines := []string{stock.String() + ":"}
+				for _, a := range *x.store.Actions.GetCorporateActions(stock) {
+					lines = append(lines, a.String())
+				}
+				if hold != 0 {
+					lines = append(lines, "Alerts waiting for a split since "+formatExportDate(hold))
+				}
+				x.sendLines(v.Remote, lines)
+				return nil
+			}
+
+			if tokens[2] == "ignore" {
+				if err := x.stocks.releaseSplitHold(stock); err != nil {
+					return err
+				}
+				x.Send <- &SendChat{Remote: v.Remote, Text: fmt.Sprintf("The alerts of %s run again", stock)}
+				return nil
+			}
+
+			newShares, oldShares, err := parseSplitRatio(tokens[2])
+			if err != nil {
+				return err
+			}
+			// By default the split is at the jump of the value, or at the start of the day
+			date := hold
+			if len(tokens) == 4 {
+				if date, err = stock.parseDay(tokens[3]); err != nil {
+					return err
+				}
+			} else if date == 0 {
+				date = stock.dayStart(time.Now())
+			}
+
+			a, err := applySplit(x.store, stock, newShares, oldShares, date)
+			if err != nil {
+				return err
+			}
+			// The follower gets the adjusted value
+			if err := x.stocks.releaseSplitHold(stock); err != nil {
+				return err
+			}
+			x.Send <- &SendChat{Remote: v.Remote, Text: fmt.Sprintf("%s: %s applied, the values, alerts and holdings before it are adjusted", stock, a)}
+		}
+	case "quit":
+		{
+			x.Send <- &SendChat{Remote: v.Remote, Text: "Bye bye!"}
+			time.Sleep(time.Second * 5)
+			waitForRc <- 1
+		}
+	case "version":
+		{
+			x.Send <- &SendChat{Remote: v.Remote, Text: "version = " + FTS_VERSION}
+		}
+	case "what?":
 		{
 			log.Warning("Potential feedback loop: %s", v.Text)
 			return nil
@@ -413,6 +1071,438 @@ ping <data> - Ping test
 	return nil
 }
 
+// Creates, renames, deletes or chooses the default portfolio
+func (x *FtsXmpp) handlePortfolioCommand(contact *Contact, args []string) error {
+	usage := errors.New("Usage: pf create|delete|default <name>, pf rename <name> <new name>")
+	if len(args) < 2 {
+		return usage
+	}
+
+	switch args[0] {
+	case "create":
+		if err := checkPortfolioName(args[1]); err != nil {
+			return err
+		}
+		if _, err := findPortfolio(x.store, contact, args[1]); err == nil {
+			return errors.New(fmt.Sprintf("You already have a portfolio \"%s\"", args[1]))
+		}
+		// The first portfolio is the default one
+		p := &Portfolio{Contact: contact.Id, Name: args[1], Default: len(*x.store.Portfolios.GetPortfolios(contact)) == 0}
+		return x.store.Portfolios.SavePortfolio(p)
+	case "rename":
+		if len(args) != 3 {
+			return usage
+		}
+		p, err := findPortfolio(x.store, contact, args[1])
+		if err != nil {
+			return err
+		}
+		if err := checkPortfolioName(args[2]); err != nil {
+			return err
+		}
+		if _, err := findPortfolio(x.store, contact, args[2]); err == nil {
+			return errors.New(fmt.Sprintf("You already have a portfolio \"%s\"", args[2]))
+		}
+		p.Name = args[2]
+		return x.store.Portfolios.SavePortfolio(p)
+	case "delete":
+		p, err := findPortfolio(x.store, contact, args[1])
+		if err != nil {
+			return err
+		}
+		if len(args) != 3 || args[2] != "confirm" {
+			nb := len(*x.store.Transactions.GetTransactions(contact, p, nil))
+			return errors.New(fmt.Sprintf("This would delete %d transactions, use \"pf delete %s confirm\" to do it", nb, p.Name))
+		}
+		return x.store.Portfolios.DeletePortfolio(p)
+	case "default":
+		p, err := findPortfolio(x.store, contact, args[1])
+		if err != nil {
+			return err
+		}
+		return setDefaultPortfolio(x.store, contact, p)
+	}
+	return usage
+}
+
+// Defines or deletes an alert relative to the cost of a position
+func (x *FtsXmpp) handlePositionAlertCommand(contact *Contact, args []string) error {
+	usage := errors.New("Usage: pos <stock> -<per>|+<per>, pos <stock> trail <per>, pos del <id>")
+	if len(args) != 2 && len(args) != 3 {
+		return usage
+	}
+
+	if args[0] == "del" {
+		id, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Invalid alert id \"%s\"", args[1]))
+		}
+		for _, al := range *x.store.PositionAlerts.GetPositionAlertsForContact(contact) {
+			if al.Id == id {
+				return x.store.PositionAlerts.DeletePositionAlert(&al)
+			}
+		}
+		return errors.New(fmt.Sprintf("You don't have a position alert %d", id))
+	}
+
+	stock, err := x.stocks.GetStock(contact, args[0])
+	if err != nil {
+		return err
+	}
+
+	var alertType string
+	var per Decimal
+	if len(args) == 3 {
+		if args[1] != "trail" {
+			return usage
+		}
+		alertType = POSITION_ALERT_TRAILING_STOP
+		if per, _, err = parsePercent(args[2]); err != nil {
+			return err
+		}
+	} else {
+		var direction int
+		if per, direction, err = parsePercent(args[1]); err != nil {
+			return err
+		}
+		switch direction {
+		case ALERT_DIRECTION_DOWN:
+			alertType = POSITION_ALERT_STOP_LOSS
+		case ALERT_DIRECTION_UP:
+			alertType = POSITION_ALERT_TAKE_PROFIT
+		default:
+			return errors.New("The percentage needs a sign: -15 for a stop loss, +30 to take profit")
+		}
+	}
+
+	al, err := definePositionAlert(x.store, contact, stock, alertType, per)
+	if err != nil {
+		return err
+	}
+	x.Send <- &SendChat{Remote: contact.Email, Text: fmt.Sprintf("Defined alert %s: %.3f %s", al.Format(stock), al.threshold(), stock.Currency)}
+	return nil
+}
+
+// Defines or deletes an alert on a portfolio
+func (x *FtsXmpp) handlePortfolioAlertCommand(contact *Contact, args []string) error {
+	if args[0] == "del" {
+		if len(args) != 2 {
+			return errors.New("Usage: pa del <id>")
+		}
+		id, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Invalid alert id \"%s\"", args[1]))
+		}
+		for _, al := range *x.store.PortfolioAlerts.GetPortfolioAlertsForContact(contact) {
+			if al.Id == id {
+				return x.store.PortfolioAlerts.DeletePortfolioAlert(&al)
+			}
+		}
+		return errors.New(fmt.Sprintf("You don't have a portfolio alert %d", id))
+	}
+
+	args, name := portfolioArgument(args)
+	var p *Portfolio
+	var err error
+	if name != "" {
+		p, err = findPortfolio(x.store, contact, name)
+	} else {
+		p, err = defaultPortfolio(x.store, contact)
+	}
+	if err != nil {
+		return err
+	}
+
+	alertType := PORTFOLIO_ALERT_CHANGE
+	if len(args) > 0 && args[0] == "dd" {
+		alertType, args = PORTFOLIO_ALERT_DRAWDOWN, args[1:]
+	}
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("Usage: pa (@<portfolio>) (+|-)<per> (<duration>), pa (@<portfolio>) dd <per>, pa del <id>")
+	}
+	per, direction, err := parsePercent(args[0])
+	if err != nil {
+		return err
+	}
+	duration := int64(0)
+	if len(args) == 2 {
+		d, err := parseDuration(args[1])
+		if err != nil {
+			return err
+		}
+		duration = int64(d)
+	}
+
+	al, err := definePortfolioAlert(x.store, contact, p, alertType, per, direction, duration)
+	if err != nil {
+		return err
+	}
+	x.Send <- &SendChat{Remote: contact.Email, Text: fmt.Sprintf("Defined alert %s", al.Format(p))}
+	return nil
+}
+
+// Tells about the stocks of a watchlist whose own alert was kept
+func keptAlertsMessage(stocks []*Stock) string {
+	symbols := []string{}
+	for _, s := range stocks {
+		symbols = append(symbols, s.Symbol())
+	}
+	return fmt.Sprintf("%s kept their own alert (\"u <stock>\" removes it).", strings.Join(symbols, ", "))
+}
+
+// Handles the "wl" commands that work on a watchlist
+func (x *FtsXmpp) handleWatchlistCommand(remote string, contact *Contact, args []string) error {
+	usage := errors.New("Usage: wl add|del|show <name> (<stock> ...), wl alert <name> (+|-)<per> (<duration>)|off")
+	if len(args) < 2 {
+		return usage
+	}
+	command, name, args := args[0], args[1], args[2:]
+
+	if command == "add" {
+		if len(args) == 0 {
+			return usage
+		}
+		w, err := findWatchlist(x.store, contact, name)
+		if err != nil { // It's created with its first stocks
+			if err := checkWatchlistName(name); err != nil {
+				return err
+			}
+			w = &Watchlist{Contact: contact.Id, Name: name}
+		}
+		stocks := []*Stock{}
+		for _, arg := range args {
+			s, err := x.stocks.GetStock(contact, arg)
+			if err != nil {
+				return err
+			}
+			stocks = append(stocks, s)
+		}
+		if w.Id == 0 {
+			if err := x.store.Watchlists.SaveWatchlist(w); err != nil {
+				return err
+			}
+		}
+		kept, err := addToWatchlist(x.store, x.stocks, contact, w, stocks)
+		if err != nil {
+			return err
+		}
+		lines := watchlistTable(x.store, w, time.Now())
+		if len(kept) > 0 {
+			lines = append(lines, keptAlertsMessage(kept))
+		}
+		x.sendLines(remote, lines)
+		return nil
+	}
+
+	w, err := findWatchlist(x.store, contact, name)
+	if err != nil {
+		return err
+	}
+	switch command {
+	case "show":
+		x.sendLines(remote, watchlistTable(x.store, w, time.Now()))
+	case "del":
+		if len(args) == 0 {
+			if err := x.store.Watchlists.DeleteWatchlist(w); err != nil {
+				return err
+			}
+			x.Send <- &SendChat{Remote: remote, Text: fmt.Sprintf("Watchlist %s deleted, the alerts of its stocks are kept.", w.Name)}
+			return nil
+		}
+		for _, arg := range args {
+			s, err := findStoredStock(x.store, arg)
+			if err != nil {
+				return err
+			}
+			if err := x.store.Watchlists.RemoveWatchlistStock(w, s); err != nil {
+				return err
+			}
+		}
+		x.sendLines(remote, watchlistTable(x.store, w, time.Now()))
+	case "alert":
+		if len(args) < 1 || len(args) > 2 {
+			return usage
+		}
+		per, direction, duration := Decimal(0), ALERT_DIRECTION_BOTH, int64(0)
+		if args[0] != "off" {
+			if per, direction, err = parsePercent(args[0]); err != nil {
+				return err
+			}
+			if len(args) == 2 {
+				d, err := parseDuration(args[1])
+				if err != nil {
+					return err
+				}
+				duration = int64(d)
+			}
+		}
+		kept, err := setWatchlistAlert(x.store, x.stocks, contact, w, per, direction, duration)
+		if err != nil {
+			return err
+		}
+		text := fmt.Sprintf("Defined alert %s for the stocks of %s, the ones added later will get it too.", w.rule(), w.Name)
+		if per == 0 {
+			text = fmt.Sprintf("The stocks of %s don't have the alert of the watchlist anymore.", w.Name)
+		}
+		if len(kept) > 0 {
+			text += " " + keptAlertsMessage(kept)
+		}
+		x.Send <- &SendChat{Remote: remote, Text: text}
+	default:
+		return usage
+	}
+	return nil
+}
+
+// Parses a percentage of variation ("2", "-2%", "+2.5"), the sign gives the direction
+func parsePercent(value string) (Decimal, int, error) {
+	// We remove the "%" if there's one
+	value = strings.SplitN(value, "%", 2)[0]
+
+	per, err := ParseDecimal(value)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	direction := ALERT_DIRECTION_BOTH
+	switch value[0] {
+	case '-':
+		direction = ALERT_DIRECTION_DOWN
+	case '+':
+		direction = ALERT_DIRECTION_UP
+	}
+	return per.Abs(), direction, nil
+}
+
+// Removes the "@<portfolio>" argument from the tokens
+func portfolioArgument(tokens []string) ([]string, string) {
+	remaining := []string{}
+	name := ""
+	for _, token := range tokens {
+		if len(token) > 1 && token[0] == '@' {
+			name = token[1:]
+		} else {
+			remaining = append(remaining, token)
+		}
+	}
+	return remaining, name
+}
+
+// Imports the broker statement pasted after the first line of the message:
+// "import statement (<profile>) (@<portfolio>) (dry)" and the CSV lines
+func (x *FtsXmpp) handleStatementImport(remote, text string) error {
+	usage := errors.New("Usage: import statement (<profile>) (@<portfolio>) (dry), followed by the CSV lines of the statement")
+	lines := strings.SplitN(strings.TrimSpace(text), "\n", 2)
+	if len(lines) < 2 {
+		return usage
+	}
+	args, name := portfolioArgument(strings.Fields(strings.ToLower(lines[0]))[2:])
+
+	dryRun, profileName := false, ""
+	for _, arg := range args {
+		if arg == "dry" {
+			dryRun = true
+		} else if profileName == "" {
+			profileName = arg
+		} else {
+			return usage
+		}
+	}
+	profile, err := statementProfile(profileName)
+	if err != nil {
+		return err
+	}
+
+	contact := x.store.Contacts.GetContactFromEmail(remote)
+	if contact == nil {
+		return errors.New("Could not get contact !")
+	}
+	var portfolio *Portfolio
+	if name != "" {
+		portfolio, err = findPortfolio(x.store, contact, name)
+	} else {
+		portfolio, err = defaultPortfolio(x.store, contact)
+	}
+	if err != nil {
+		return err
+	}
+
+	statement, err := readStatementCsv(strings.NewReader(lines[1]), profile)
+	if err != nil {
+		return err
+	}
+
+	resolve := func(symbol string) (*Stock, error) { return x.stocks.GetStock(contact, symbol) }
+	if dryRun {
+		resolve = func(symbol string) (*Stock, error) { return previewStock(x.store, contact, symbol) }
+	}
+	result, err := importStatement(x.store, contact, portfolio, statement, resolve, dryRun)
+	if err != nil {
+		return err
+	}
+
+	x.sendLines(remote, append(result.Lines, fmt.Sprintf("%s: %s", portfolio.Name, result)))
+	return nil
+}
+
+// Sends lines in as many messages as needed
+func (x *FtsXmpp) sendLines(remote string, lines []string) {
+	msg := ""
+	for i, line := range lines {
+		msg += "\n" + line
+		if (i+1)%config.Xmpp.LinesPerMessage == 0 {
+			x.Send <- &SendChat{Remote: remote, Text: msg}
+			msg = ""
+		}
+	}
+	if msg != "" {
+		x.Send <- &SendChat{Remote: remote, Text: msg}
+	}
+}
+
+// Sends an export as a link when the export directory is served, inline otherwise
+func (x *FtsXmpp) sendExport(remote, name, format string, records []exportRecord) error {
+	if config.Export.Url != "" {
+		fileName, err := writeExportFile(name, format, records)
+		if err != nil {
+			return err
+		}
+		x.Send <- &SendChat{Remote: remote, Text: fmt.Sprintf("%d rows: %s/%s", len(records), strings.TrimRight(config.Export.Url, "/"), path.Base(fileName))}
+		return nil
+	}
+
+	buffer := &bytes.Buffer{}
+	if err := writeExport(buffer, format, records); err != nil {
+		return err
+	}
+	if buffer.Len() > MAX_INLINE_EXPORT {
+		return errors.New(fmt.Sprintf("%d rows is too much for a chat message, try a shorter period", len(records)))
+	}
+	x.Send <- &SendChat{Remote: remote, Text: buffer.String()}
+	return nil
+}
+
+// Same as time.ParseDuration but also accepts days ("30d") and weeks ("2w")
+func parseDuration(s string) (time.Duration, error) {
+	if len(s) > 1 {
+		unit := time.Duration(0)
+		switch s[len(s)-1] {
+		case 'd':
+			unit = time.Hour * 24
+		case 'w':
+			unit = time.Hour * 24 * 7
+		}
+		if unit != 0 {
+			nb, err := strconv.ParseFloat(s[:len(s)-1], 64)
+			if err != nil {
+				return 0, err
+			}
+			return time.Duration(nb * float64(unit)), nil
+		}
+	}
+	return time.ParseDuration(s)
+}
+
 func (x *FtsXmpp) runRecv() {
 	for {
 		msg := <-x.Recv
@@ -422,8 +1512,11 @@ func (x *FtsXmpp) runRecv() {
 			if v.Text != "" {
 				log.Debug("[CHAT] %s --> \"%s\"", v.Remote, v.Text)
 			}
+			text := v.Text
 			err := x.handle_chat(&v)
-			if err != nil {
+			if ambiguous, ok := err.(*ambiguousStockError); ok {
+				x.askStockChoice(v.Remote, text, ambiguous)
+			} else if err != nil {
 				x.Send <- &SendChat{Remote: v.Remote, Text: fmt.Sprint("Error:", err)}
 			}
 		default:
@@ -443,7 +1536,15 @@ func (x *FtsXmpp) runSend() {
 				log.Error("Cannot send on a nil XMPP !")
 				time.Sleep(5)
 			}
-			x.clt.Send(xmpp.Chat{Type: "chat", Remote: v.Remote, Text: v.Text})
+			_, err := x.clt.Send(xmpp.Chat{Type: "chat", Remote: v.Remote, Text: v.Text})
+			if v.Trigger != 0 {
+				status := TRIGGER_STATUS_SENT
+				if err != nil {
+					log.Error("Could not send trigger %d: %v", v.Trigger, err)
+					status = TRIGGER_STATUS_FAILED
+				}
+				x.store.Triggers.SetAlertTriggerStatus(v.Trigger, status)
+			}
 		}
 	}
 }
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"github.com/mattn/go-xmpp"
+	"strings"
+	"testing"
+)
+
+func TestStockChoice(t *testing.T) {
+	store := NewMemDB().Storage()
+	rno := &Stock{Market: "FR", Short: "RNO", Name: "RENAULT", Currency: "EUR"}
+	store.Stocks.SaveStock(rno)
+	rhino := &Stock{Market: "US", Short: "RNO", Name: "RHINO RESOURCE PARTNERS LP", Currency: "USD"}
+	store.Stocks.SaveStock(rhino)
+	c := store.Contacts.GetContactFromEmail("florent@clairambault.fr")
+
+	x := NewFtsXmpp(store)
+	x.stocks = NewStocksMgmt(store, nil)
+	remote := "florent@clairambault.fr/home"
+	x.askStockChoice(remote, "tx rno", &ambiguousStockError{Short: "RNO", Stocks: []*Stock{rno, rhino}})
+	if msg := (<-x.Send).(*SendChat); !strings.Contains(msg.Text, "2. "+rhino.String()) {
+		t.Fatalf("Wrong question: %s", msg.Text)
+	}
+
+	// The choice is kept until we get a valid answer
+	if err := x.handle_chat(&xmpp.Chat{Remote: remote, Text: "3"}); err == nil {
+		t.Fatal("There are only 2 stocks")
+	}
+	if err := x.handle_chat(&xmpp.Chat{Remote: remote, Text: "2"}); err != nil {
+		t.Fatal(err)
+	}
+	if p := store.Contacts.GetMarketPreference(c, "RNO"); p == nil || p.Market != "US" {
+		t.Fatalf("Wrong preference: %#v", p)
+	}
+	if msg := (<-x.Send).(*SendChat); msg.Text != "\"RNO\" is now US:RNO for you" {
+		t.Fatalf("Wrong answer: %s", msg.Text)
+	}
+	// The command was run again
+	if msg := (<-x.Send).(*SendChat); msg.Text != "You didn't register any transaction." {
+		t.Fatalf("Wrong answer: %s", msg.Text)
+	}
+
+	// The ticker now gives the stock we chose
+	if s, err := x.getStock(remote, "rno"); err != nil || s.Id != rhino.Id {
+		t.Fatalf("Wrong stock: %v / %v", s, err)
+	}
+	if len(x.choices) != 0 {
+		t.Fatal("The choice is done")
+	}
+}
+
+func TestCurrencyCommand(t *testing.T) {
+	store := NewMemDB().Storage()
+	c := store.Contacts.GetContactFromEmail("florent@clairambault.fr")
+	x := NewFtsXmpp(store)
+	x.stocks = NewStocksMgmt(store, nil)
+	remote := "florent@clairambault.fr/home"
+
+	// Without its rate, the totals would ignore all the stocks
+	if err := x.handle_chat(&xmpp.Chat{Remote: remote, Text: "currency xyz"}); err == nil {
+		t.Fatal("The currency shouldn't be accepted")
+	}
+	if err := x.handle_chat(&xmpp.Chat{Remote: remote, Text: "currency usd"}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := (<-x.Send).(*SendChat); msg.Text != "Your totals are in USD" {
+		t.Fatalf("Wrong answer: %s", msg.Text)
+	}
+	if c = store.Contacts.GetContactFromId(c.Id); c.Currency != "USD" {
+		t.Fatalf("Wrong currency: %s", c.Currency)
+	}
+}